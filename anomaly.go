@@ -0,0 +1,307 @@
+package chaindataagg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+// AnomalyMethod scores a daily volume against its trailing history.
+type AnomalyMethod string
+
+const (
+	// AnomalyNone disables anomaly detection (default).
+	AnomalyNone AnomalyMethod = "none"
+	// AnomalyZScore scores the distance to the mean in standard deviations.
+	AnomalyZScore AnomalyMethod = "zscore"
+	// AnomalyMAD scores the distance to the median in scaled median absolute
+	// deviations, which outliers in the history do not inflate.
+	AnomalyMAD AnomalyMethod = "mad"
+)
+
+// ParseAnomalyMethod parses anomaly method from string value.
+func ParseAnomalyMethod(s string) (AnomalyMethod, error) {
+	switch method := AnomalyMethod(strings.ToLower(s)); method {
+	case AnomalyNone, AnomalyZScore, AnomalyMAD:
+		return method, nil
+	case "":
+		return AnomalyNone, nil
+	default:
+		return "", fmt.Errorf("unknown anomaly method: %s", s)
+	}
+}
+
+// AnomalyMode defines what happens when anomalies are found.
+type AnomalyMode string
+
+const (
+	// AnomalyWarn reports the anomalies and keeps the data (default).
+	AnomalyWarn AnomalyMode = "warn"
+	// AnomalyFail rejects the data, so it is not loaded.
+	AnomalyFail AnomalyMode = "fail"
+)
+
+// ParseAnomalyMode parses anomaly mode from string value.
+func ParseAnomalyMode(s string) (AnomalyMode, error) {
+	switch mode := AnomalyMode(strings.ToLower(s)); mode {
+	case AnomalyWarn, AnomalyFail:
+		return mode, nil
+	case "":
+		return AnomalyWarn, nil
+	default:
+		return "", fmt.Errorf("unknown anomaly mode: %s", s)
+	}
+}
+
+// AnomalyHistoryWarehouse reads the history from the ClickHouse daily rollup.
+const AnomalyHistoryWarehouse = "warehouse"
+
+// AnomalyOptions configures DetectAnomalies.
+type AnomalyOptions struct {
+	Method AnomalyMethod
+	// Threshold is the score above which a volume is flagged.
+	Threshold float64
+	// Window is the number of trailing days compared against.
+	Window int
+	// MinHistory is the number of days of history below which a volume is
+	// not scored.
+	MinHistory int
+}
+
+// Anomaly is a daily project volume far from its trailing history.
+type Anomaly struct {
+	Date      string  `json:"date"`
+	ProjectID string  `json:"project_id"`
+	VolumeUSD float64 `json:"volume_usd"`
+	// Baseline is the mean or median of the history and Spread its standard
+	// deviation or scaled median absolute deviation.
+	Baseline    float64       `json:"baseline"`
+	Spread      float64       `json:"spread"`
+	Score       float64       `json:"score"`
+	Method      AnomalyMethod `json:"method"`
+	HistoryDays int           `json:"history_days"`
+}
+
+// madScale scales the median absolute deviation to the standard deviation of
+// normally distributed volumes.
+const madScale = 1.4826
+
+// minSpread is the smallest spread relative to the baseline, so a change after
+// a flat history is scored by its relative size.
+const minSpread = 0.01
+
+// DetectAnomalies scores the USD volume of every project and day against the
+// volumes of the project in the trailing window. The history and the earlier
+// days of data make up the window; data overrides history for the same day.
+// Rows without an exchange rate are left out of the volumes.
+func DetectAnomalies(data []AggregatedData, history []DailyVolume, opts AnomalyOptions) ([]Anomaly, error) {
+	if opts.Method == AnomalyNone || opts.Method == "" {
+		return nil, nil
+	}
+	if opts.Window <= 0 || opts.MinHistory <= 0 {
+		return nil, fmt.Errorf("anomaly window and min history must be positive")
+	}
+
+	// Volumes by project and day.
+	current := dailyVolumes(data)
+	volumes := make(map[string]map[string]float64)
+	for _, entry := range history {
+		if volumes[entry.ProjectID] == nil {
+			volumes[entry.ProjectID] = make(map[string]float64)
+		}
+		volumes[entry.ProjectID][entry.Date] = entry.VolumeUSD
+	}
+	for projectID, days := range current {
+		if volumes[projectID] == nil {
+			volumes[projectID] = make(map[string]float64)
+		}
+		for date, volume := range days {
+			volumes[projectID][date] = volume
+		}
+	}
+
+	var anomalies []Anomaly
+	for projectID, days := range current {
+		for date, volume := range days {
+			day, err := time.Parse(DateFormat, date)
+			if err != nil {
+				return nil, fmt.Errorf("invalid date %s: %w", date, err)
+			}
+			from := day.AddDate(0, 0, -opts.Window).Format(DateFormat)
+			var window []float64
+			for historyDate, historyVolume := range volumes[projectID] {
+				if historyDate >= from && historyDate < date {
+					window = append(window, historyVolume)
+				}
+			}
+			if len(window) < opts.MinHistory {
+				continue
+			}
+
+			baseline, spread := spreadOf(opts.Method, window)
+			spread = max(spread, minSpread*math.Abs(baseline))
+			if spread == 0 {
+				// A history of zero volumes.
+				spread = minSpread
+			}
+			score := math.Abs(volume-baseline) / spread
+			if score > opts.Threshold {
+				anomalies = append(anomalies, Anomaly{
+					Date:        date,
+					ProjectID:   projectID,
+					VolumeUSD:   volume,
+					Baseline:    baseline,
+					Spread:      spread,
+					Score:       score,
+					Method:      opts.Method,
+					HistoryDays: len(window),
+				})
+			}
+		}
+	}
+
+	sort.Slice(anomalies, func(i, j int) bool {
+		if anomalies[i].Date != anomalies[j].Date {
+			return anomalies[i].Date < anomalies[j].Date
+		}
+		return anomalies[i].ProjectID < anomalies[j].ProjectID
+	})
+	return anomalies, nil
+}
+
+// dailyVolumes sums the USD volumes of the rows by project and day.
+func dailyVolumes(data []AggregatedData) map[string]map[string]float64 {
+	volumes := make(map[string]map[string]float64)
+	for _, entry := range data {
+		if volumes[entry.ProjectID] == nil {
+			volumes[entry.ProjectID] = make(map[string]float64)
+		}
+		volume := entry.TotalVolumeUSD
+		if entry.RateMissing {
+			volume = 0
+		}
+		volumes[entry.ProjectID][entry.Date] += volume
+	}
+	return volumes
+}
+
+// spreadOf returns the baseline and spread of the values for a method.
+func spreadOf(method AnomalyMethod, values []float64) (float64, float64) {
+	if method == AnomalyMAD {
+		center := median(values)
+		deviations := make([]float64, len(values))
+		for i, value := range values {
+			deviations[i] = math.Abs(value - center)
+		}
+		return center, madScale * median(deviations)
+	}
+
+	var sum float64
+	for _, value := range values {
+		sum += value
+	}
+	mean := sum / float64(len(values))
+	var squares float64
+	for _, value := range values {
+		squares += (value - mean) * (value - mean)
+	}
+	return mean, math.Sqrt(squares / float64(len(values)))
+}
+
+func median(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[middle-1] + sorted[middle]) / 2
+	}
+	return sorted[middle]
+}
+
+// ReadVolumeHistory reads transformed data (local path or gs://bucket/object)
+// as daily volumes.
+func ReadVolumeHistory(ctx context.Context, source string) ([]DailyVolume, error) {
+	content, err := ReadInput(ctx, source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read volume history: %w", err)
+	}
+	var data []AggregatedData
+	if err := json.Unmarshal(content, &data); err != nil {
+		return nil, fmt.Errorf("failed to parse volume history %s: %w", source, err)
+	}
+
+	var history []DailyVolume
+	index := make(map[string]int)
+	for _, entry := range data {
+		key := entry.Date + "_" + entry.ProjectID
+		i, ok := index[key]
+		if !ok {
+			i = len(history)
+			index[key] = i
+			history = append(history, DailyVolume{Date: entry.Date, ProjectID: entry.ProjectID})
+		}
+		history[i].Transactions += entry.Transactions
+		if !entry.RateMissing {
+			history[i].VolumeUSD += entry.TotalVolumeUSD
+		}
+	}
+	return history, nil
+}
+
+// ReadWarehouseHistory reads the daily volumes of all projects between two
+// dates, inclusive, page by page.
+func ReadWarehouseHistory(ctx context.Context, store AnalyticsStore, from, to string) ([]DailyVolume, error) {
+	var history []DailyVolume
+	for offset := 0; ; offset += MaxPageSize {
+		volumes, err := store.DailyVolumes(ctx, "", from, to, Page{Limit: MaxPageSize, Offset: offset})
+		if err != nil {
+			return nil, err
+		}
+		history = append(history, volumes...)
+		if len(volumes) < MaxPageSize {
+			return history, nil
+		}
+	}
+}
+
+// HistoryRange returns the dates of the history needed to score data.
+func HistoryRange(data []AggregatedData, window int) (string, string) {
+	from, to := dateRange(AggregatedDates(data))
+	start, err := time.Parse(DateFormat, from)
+	if err != nil {
+		return from, to
+	}
+	return start.AddDate(0, 0, -window).Format(DateFormat), to
+}
+
+// WriteAnomalies records anomalies found by a run in the
+// marketplace_analytics_anomalies table.
+func WriteAnomalies(ctx context.Context, conn driver.Conn, runID string, anomalies []Anomaly) error {
+	if len(anomalies) == 0 {
+		return nil
+	}
+	batch, err := conn.PrepareBatch(ctx, `
+		INSERT INTO marketplace_analytics_anomalies (date, project_id, volume_usd, baseline, spread, score, method, history_days, run_id)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to write anomalies: %w", err)
+	}
+	defer batch.Abort()
+
+	for _, anomaly := range anomalies {
+		err := batch.Append(anomaly.Date, anomaly.ProjectID, anomaly.VolumeUSD, anomaly.Baseline, anomaly.Spread, anomaly.Score, string(anomaly.Method), uint32(anomaly.HistoryDays), runID)
+		if err != nil {
+			return fmt.Errorf("failed to write anomalies: %w", err)
+		}
+	}
+	if err := batch.Send(); err != nil {
+		return fmt.Errorf("failed to write anomalies: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package chaindataagg_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	chaindataagg "github.com/atkachyshyn/chain-data-agg"
+	"github.com/stretchr/testify/require"
+)
+
+// volumeHistory returns days of history of a project with volumes around 100.
+func volumeHistory(projectID string, days int) []chaindataagg.DailyVolume {
+	history := make([]chaindataagg.DailyVolume, 0, days)
+	for day := 1; day <= days; day++ {
+		history = append(history, chaindataagg.DailyVolume{
+			Date:      fmt.Sprintf("2024-04-%02d", day),
+			ProjectID: projectID,
+			VolumeUSD: 100 + float64(day%3*10),
+		})
+	}
+	return history
+}
+
+func TestDetectAnomalies(t *testing.T) {
+	history := append(volumeHistory("4974", 14), volumeHistory("1660", 14)...)
+	data := []chaindataagg.AggregatedData{
+		{Date: "2024-04-15", ProjectID: "4974", TotalVolumeUSD: 5000},
+		{Date: "2024-04-15", ProjectID: "1660", TotalVolumeUSD: 115},
+		// Rows without an exchange rate have no volume.
+		{Date: "2024-04-15", ProjectID: "1660", TotalVolumeUSD: 1e6, RateMissing: true},
+		// Too little history to be scored.
+		{Date: "2024-04-15", ProjectID: "new", TotalVolumeUSD: 1e6},
+	}
+
+	for _, method := range []chaindataagg.AnomalyMethod{chaindataagg.AnomalyZScore, chaindataagg.AnomalyMAD} {
+		t.Run(string(method), func(t *testing.T) {
+			anomalies, err := chaindataagg.DetectAnomalies(data, history, chaindataagg.AnomalyOptions{
+				Method:     method,
+				Threshold:  5,
+				Window:     28,
+				MinHistory: 7,
+			})
+			require.NoError(t, err)
+			require.Len(t, anomalies, 1)
+			require.Equal(t, "4974", anomalies[0].ProjectID)
+			require.Equal(t, 14, anomalies[0].HistoryDays)
+			require.InDelta(t, 110, anomalies[0].Baseline, 1)
+			require.Greater(t, anomalies[0].Score, 5.0)
+		})
+	}
+
+	t.Run("window", func(t *testing.T) {
+		// The history is older than the window.
+		anomalies, err := chaindataagg.DetectAnomalies(data, history, chaindataagg.AnomalyOptions{
+			Method:     chaindataagg.AnomalyZScore,
+			Threshold:  5,
+			Window:     3,
+			MinHistory: 7,
+		})
+		require.NoError(t, err)
+		require.Empty(t, anomalies)
+	})
+
+	t.Run("flat history", func(t *testing.T) {
+		flat := []chaindataagg.DailyVolume{
+			{Date: "2024-04-13", ProjectID: "4974", VolumeUSD: 100},
+			{Date: "2024-04-14", ProjectID: "4974", VolumeUSD: 100},
+		}
+		anomalies, err := chaindataagg.DetectAnomalies(data[:1], flat, chaindataagg.AnomalyOptions{
+			Method:     chaindataagg.AnomalyMAD,
+			Threshold:  5,
+			Window:     7,
+			MinHistory: 2,
+		})
+		require.NoError(t, err)
+		require.Len(t, anomalies, 1)
+		require.Equal(t, 1.0, anomalies[0].Spread)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		anomalies, err := chaindataagg.DetectAnomalies(data, history, chaindataagg.AnomalyOptions{Method: chaindataagg.AnomalyNone})
+		require.NoError(t, err)
+		require.Empty(t, anomalies)
+	})
+}
+
+func TestReadVolumeHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "transformed.json")
+	content, err := json.Marshal([]chaindataagg.AggregatedData{
+		{Date: "2024-04-14", ProjectID: "4974", Transactions: 2, TotalVolumeUSD: 20},
+		{Date: "2024-04-14", ProjectID: "4974", Transactions: 1, TotalVolumeUSD: 3, RateMissing: true},
+		{Date: "2024-04-14", ProjectID: "1660", Transactions: 1, TotalVolumeUSD: 5},
+	})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, content, 0o600))
+
+	history, err := chaindataagg.ReadVolumeHistory(context.Background(), path)
+	require.NoError(t, err)
+	require.Equal(t, []chaindataagg.DailyVolume{
+		{Date: "2024-04-14", ProjectID: "4974", Transactions: 3, VolumeUSD: 20},
+		{Date: "2024-04-14", ProjectID: "1660", Transactions: 1, VolumeUSD: 5},
+	}, history)
+}
+
+func TestReadWarehouseHistory(t *testing.T) {
+	volumes := make([]chaindataagg.DailyVolume, chaindataagg.MaxPageSize+5)
+	for i := range volumes {
+		volumes[i] = chaindataagg.DailyVolume{Date: "2024-04-14", ProjectID: fmt.Sprint(i)}
+	}
+	store := &fakeStore{volumes: volumes}
+
+	history, err := chaindataagg.ReadWarehouseHistory(context.Background(), store, "2024-04-01", "2024-04-30")
+	require.NoError(t, err)
+	require.Equal(t, volumes, history)
+	require.Equal(t, 2, store.queries)
+}
@@ -0,0 +1,525 @@
+package chaindataagg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+// API page sizes.
+const (
+	DefaultPageSize = 100
+	MaxPageSize     = 1000
+	DefaultTopN     = 10
+)
+
+// Page selects a page of a list.
+type Page struct {
+	Limit  int
+	Offset int
+}
+
+// DailyVolume is the volume of a project on a day.
+type DailyVolume struct {
+	Date         string  `json:"date"`
+	ProjectID    string  `json:"project_id"`
+	Transactions int     `json:"transactions"`
+	VolumeUSD    float64 `json:"volume_usd"`
+}
+
+// ProjectVolume is the volume of a project over a date range.
+type ProjectVolume struct {
+	ProjectID    string  `json:"project_id"`
+	Transactions int     `json:"transactions"`
+	VolumeUSD    float64 `json:"volume_usd"`
+}
+
+// CurrencyVolume is the volume of a project in a reporting currency over a
+// date range.
+type CurrencyVolume struct {
+	ProjectID string  `json:"project_id"`
+	Currency  string  `json:"currency"`
+	Volume    float64 `json:"volume"`
+}
+
+// PipelineStatus describes the data loaded by the pipeline.
+type PipelineStatus struct {
+	EarliestDate    string `json:"earliest_date,omitempty"`
+	LatestDate      string `json:"latest_date,omitempty"`
+	Rows            int    `json:"rows"`
+	Projects        int    `json:"projects"`
+	RateMissingRows int    `json:"rate_missing_rows"`
+	SchemaVersion   int    `json:"schema_version"`
+}
+
+// AnalyticsStore answers the queries of the analytics API. Dates are
+// inclusive and formatted as DateFormat; an empty project ID selects all
+// projects.
+type AnalyticsStore interface {
+	// DailyVolumes returns volumes ordered by date and project.
+	DailyVolumes(ctx context.Context, projectID, from, to string, page Page) ([]DailyVolume, error)
+	// TopProjects returns projects ordered by descending USD volume.
+	TopProjects(ctx context.Context, from, to string, page Page) ([]ProjectVolume, error)
+	// CurrencyVolumes returns volumes ordered by project and currency.
+	CurrencyVolumes(ctx context.Context, projectID, from, to string, page Page) ([]CurrencyVolume, error)
+	Status(ctx context.Context) (PipelineStatus, error)
+}
+
+// API serves the analytics of an AnalyticsStore, and the pipeline runs of a
+// RunStore, as read-only JSON. Responses are cached in process for the cache
+// TTL.
+type API struct {
+	store AnalyticsStore
+	runs  RunStore
+	cache *responseCache
+	mux   *http.ServeMux
+	// now is the current time, used for the default date range.
+	now func() time.Time
+}
+
+// NewAPI constructs the API over the stores. Runs are not served without a
+// run store. A cache TTL of zero disables the cache.
+func NewAPI(store AnalyticsStore, runs RunStore, cacheTTL time.Duration) *API {
+	api := &API{
+		store: store,
+		runs:  runs,
+		cache: newResponseCache(cacheTTL),
+		mux:   http.NewServeMux(),
+		now:   time.Now,
+	}
+	api.mux.HandleFunc("GET /v1/volumes", api.cached(api.volumes))
+	api.mux.HandleFunc("GET /v1/projects/top", api.cached(api.topProjects))
+	api.mux.HandleFunc("GET /v1/currencies", api.cached(api.currencies))
+	api.mux.HandleFunc("GET /v1/status", api.cached(api.status))
+	if runs != nil {
+		api.mux.HandleFunc("GET /v1/runs", api.cached(api.listRuns))
+		api.mux.HandleFunc("GET /v1/runs/{id}", api.cached(api.getRun))
+	}
+	api.mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	return api
+}
+
+func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mux.ServeHTTP(w, r)
+}
+
+// listResponse is a page of a list.
+type listResponse struct {
+	Data       any        `json:"data"`
+	Pagination pagination `json:"pagination"`
+}
+
+type pagination struct {
+	Limit  int `json:"limit"`
+	Offset int `json:"offset"`
+	// NextOffset is set if there are more items.
+	NextOffset *int `json:"next_offset,omitempty"`
+}
+
+// errBadRequest marks errors in the request parameters.
+var errBadRequest = errors.New("bad request")
+
+// handlerFunc returns the response body of a request.
+type handlerFunc func(r *http.Request) (any, error)
+
+func (a *API) volumes(r *http.Request) (any, error) {
+	from, to, err := a.dateRange(r.URL.Query())
+	if err != nil {
+		return nil, err
+	}
+	page, err := parsePage(r.URL.Query(), DefaultPageSize)
+	if err != nil {
+		return nil, err
+	}
+	volumes, err := a.store.DailyVolumes(r.Context(), r.URL.Query().Get("project_id"), from, to, page.next())
+	if err != nil {
+		return nil, err
+	}
+	return paginate(volumes, page), nil
+}
+
+func (a *API) topProjects(r *http.Request) (any, error) {
+	from, to, err := a.dateRange(r.URL.Query())
+	if err != nil {
+		return nil, err
+	}
+	page, err := parsePage(r.URL.Query(), DefaultTopN)
+	if err != nil {
+		return nil, err
+	}
+	projects, err := a.store.TopProjects(r.Context(), from, to, page.next())
+	if err != nil {
+		return nil, err
+	}
+	return paginate(projects, page), nil
+}
+
+func (a *API) currencies(r *http.Request) (any, error) {
+	from, to, err := a.dateRange(r.URL.Query())
+	if err != nil {
+		return nil, err
+	}
+	page, err := parsePage(r.URL.Query(), DefaultPageSize)
+	if err != nil {
+		return nil, err
+	}
+	volumes, err := a.store.CurrencyVolumes(r.Context(), r.URL.Query().Get("project_id"), from, to, page.next())
+	if err != nil {
+		return nil, err
+	}
+	return paginate(volumes, page), nil
+}
+
+func (a *API) status(r *http.Request) (any, error) {
+	return a.store.Status(r.Context())
+}
+
+func (a *API) listRuns(r *http.Request) (any, error) {
+	page, err := parsePage(r.URL.Query(), DefaultPageSize)
+	if err != nil {
+		return nil, err
+	}
+	// The store lists the latest runs only, the page is cut from them.
+	runs, err := a.runs.List(r.Context(), page.Offset+page.Limit+1)
+	if err != nil {
+		return nil, err
+	}
+	return paginate(runs[min(page.Offset, len(runs)):], page), nil
+}
+
+func (a *API) getRun(r *http.Request) (any, error) {
+	return a.runs.Get(r.Context(), r.PathValue("id"))
+}
+
+// cached serves a handler as JSON, from the cache if the same request was
+// answered within the cache TTL.
+func (a *API) cached(handler handlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.URL.Path + "?" + r.URL.Query().Encode()
+		if body, ok := a.cache.get(key); ok {
+			w.Header().Set("X-Cache", "HIT")
+			writeJSON(w, http.StatusOK, body)
+			return
+		}
+
+		response, err := handler(r)
+		if errors.Is(err, errBadRequest) {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if errors.Is(err, ErrRunNotFound) {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		if err != nil {
+			slog.Error("API request failed", slog.String("path", r.URL.Path), slog.String("error", err.Error()))
+			writeError(w, http.StatusInternalServerError, errors.New("internal error"))
+			return
+		}
+		body, err := json.Marshal(response)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		a.cache.put(key, body)
+		w.Header().Set("X-Cache", "MISS")
+		writeJSON(w, http.StatusOK, body)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, body []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	body, _ := json.Marshal(map[string]string{"error": err.Error()})
+	writeJSON(w, status, body)
+}
+
+// dateRange parses the from and to parameters, defaulting to the last 30
+// days.
+func (a *API) dateRange(query url.Values) (string, string, error) {
+	to := a.now().UTC()
+	if value := query.Get("to"); value != "" {
+		parsed, err := time.Parse(DateFormat, value)
+		if err != nil {
+			return "", "", fmt.Errorf("%w: invalid to date: %s", errBadRequest, value)
+		}
+		to = parsed
+	}
+	from := to.AddDate(0, 0, -29)
+	if value := query.Get("from"); value != "" {
+		parsed, err := time.Parse(DateFormat, value)
+		if err != nil {
+			return "", "", fmt.Errorf("%w: invalid from date: %s", errBadRequest, value)
+		}
+		from = parsed
+	}
+	if from.After(to) {
+		return "", "", fmt.Errorf("%w: from date is after to date", errBadRequest)
+	}
+	return from.Format(DateFormat), to.Format(DateFormat), nil
+}
+
+// parsePage parses the limit and offset parameters.
+func parsePage(query url.Values, defaultLimit int) (Page, error) {
+	page := Page{Limit: defaultLimit}
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > MaxPageSize {
+			return Page{}, fmt.Errorf("%w: limit must be between 1 and %d", errBadRequest, MaxPageSize)
+		}
+		page.Limit = limit
+	}
+	if value := query.Get("offset"); value != "" {
+		offset, err := strconv.Atoi(value)
+		if err != nil || offset < 0 {
+			return Page{}, fmt.Errorf("%w: offset must not be negative", errBadRequest)
+		}
+		page.Offset = offset
+	}
+	return page, nil
+}
+
+// next asks for one more item than the page holds, to tell whether there is
+// a next page.
+func (p Page) next() Page {
+	return Page{Limit: p.Limit + 1, Offset: p.Offset}
+}
+
+func paginate[T any](items []T, page Page) listResponse {
+	response := listResponse{Pagination: pagination{Limit: page.Limit, Offset: page.Offset}}
+	if len(items) > page.Limit {
+		items = items[:page.Limit]
+		next := page.Offset + page.Limit
+		response.Pagination.NextOffset = &next
+	}
+	if items == nil {
+		items = []T{}
+	}
+	response.Data = items
+	return response
+}
+
+// maxCacheEntries bounds the memory held by the response cache.
+const maxCacheEntries = 1024
+
+// responseCache holds response bodies for a TTL.
+type responseCache struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+	now     func() time.Time
+}
+
+type cacheEntry struct {
+	body    []byte
+	expires time.Time
+}
+
+func newResponseCache(ttl time.Duration) *responseCache {
+	return &responseCache{ttl: ttl, entries: make(map[string]cacheEntry), now: time.Now}
+}
+
+func (c *responseCache) get(key string) ([]byte, bool) {
+	if c.ttl <= 0 {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || c.now().After(entry.expires) {
+		return nil, false
+	}
+	return entry.body, true
+}
+
+func (c *responseCache) put(key string, body []byte) {
+	if c.ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	if len(c.entries) >= maxCacheEntries {
+		// Drop expired entries, or the ones closest to expiring if all are
+		// current.
+		for k, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= maxCacheEntries {
+			keys := make([]string, 0, len(c.entries))
+			for k := range c.entries {
+				keys = append(keys, k)
+			}
+			sort.Slice(keys, func(i, j int) bool {
+				return c.entries[keys[i]].expires.Before(c.entries[keys[j]].expires)
+			})
+			for _, k := range keys[:len(keys)-maxCacheEntries+1] {
+				delete(c.entries, k)
+			}
+		}
+	}
+	c.entries[key] = cacheEntry{body: body, expires: now.Add(c.ttl)}
+}
+
+// clickHouseStore queries the marketplace_analytics table and its rollups.
+type clickHouseStore struct {
+	conn driver.Conn
+}
+
+// NewClickHouseStore constructs an analytics store over a ClickHouse
+// connection.
+func NewClickHouseStore(conn driver.Conn) AnalyticsStore {
+	return &clickHouseStore{conn: conn}
+}
+
+func (s *clickHouseStore) DailyVolumes(ctx context.Context, projectID, from, to string, page Page) ([]DailyVolume, error) {
+	var rows []struct {
+		Date         string  `ch:"date"`
+		ProjectID    string  `ch:"project_id"`
+		Transactions uint64  `ch:"transactions"`
+		VolumeUSD    float64 `ch:"volume_usd"`
+	}
+	query := `
+		SELECT
+			toString(date) AS date,
+			project_id,
+			sumMerge(transactions) AS transactions,
+			sumMerge(volume_usd) AS volume_usd
+		FROM marketplace_analytics_daily_agg
+		WHERE date BETWEEN toDate(?) AND toDate(?) AND (? = '' OR project_id = ?)
+		GROUP BY date, project_id
+		ORDER BY date, project_id
+		LIMIT ? OFFSET ?
+	`
+	if err := s.conn.Select(ctx, &rows, query, from, to, projectID, projectID, page.Limit, page.Offset); err != nil {
+		return nil, fmt.Errorf("failed to query daily volumes: %w", err)
+	}
+
+	volumes := make([]DailyVolume, 0, len(rows))
+	for _, row := range rows {
+		volumes = append(volumes, DailyVolume{Date: row.Date, ProjectID: row.ProjectID, Transactions: int(row.Transactions), VolumeUSD: row.VolumeUSD})
+	}
+	return volumes, nil
+}
+
+func (s *clickHouseStore) TopProjects(ctx context.Context, from, to string, page Page) ([]ProjectVolume, error) {
+	var rows []struct {
+		ProjectID    string  `ch:"project_id"`
+		Transactions uint64  `ch:"transactions"`
+		VolumeUSD    float64 `ch:"volume_usd"`
+	}
+	query := `
+		SELECT
+			project_id,
+			sumMerge(transactions) AS transactions,
+			sumMerge(volume_usd) AS volume_usd
+		FROM marketplace_analytics_daily_agg
+		WHERE date BETWEEN toDate(?) AND toDate(?)
+		GROUP BY project_id
+		ORDER BY volume_usd DESC, project_id
+		LIMIT ? OFFSET ?
+	`
+	if err := s.conn.Select(ctx, &rows, query, from, to, page.Limit, page.Offset); err != nil {
+		return nil, fmt.Errorf("failed to query top projects: %w", err)
+	}
+
+	projects := make([]ProjectVolume, 0, len(rows))
+	for _, row := range rows {
+		projects = append(projects, ProjectVolume{ProjectID: row.ProjectID, Transactions: int(row.Transactions), VolumeUSD: row.VolumeUSD})
+	}
+	return projects, nil
+}
+
+func (s *clickHouseStore) CurrencyVolumes(ctx context.Context, projectID, from, to string, page Page) ([]CurrencyVolume, error) {
+	var rows []struct {
+		ProjectID string  `ch:"project_id"`
+		Currency  string  `ch:"currency"`
+		Volume    float64 `ch:"volume"`
+	}
+	// USD is stored in total_volume_usd, the other currencies in volumes.
+	query := `
+		SELECT project_id, currency, sum(volume) AS volume
+		FROM (
+			SELECT project_id, 'usd' AS currency, ifNull(total_volume_usd, 0) AS volume
+			FROM marketplace_analytics
+			WHERE date BETWEEN toDate(?) AND toDate(?) AND (? = '' OR project_id = ?)
+			UNION ALL
+			SELECT project_id, toString(currency) AS currency, volume
+			FROM marketplace_analytics
+			ARRAY JOIN mapKeys(volumes) AS currency, mapValues(volumes) AS volume
+			WHERE date BETWEEN toDate(?) AND toDate(?) AND (? = '' OR project_id = ?)
+		)
+		GROUP BY project_id, currency
+		ORDER BY project_id, currency
+		LIMIT ? OFFSET ?
+	`
+	args := []any{from, to, projectID, projectID, from, to, projectID, projectID, page.Limit, page.Offset}
+	if err := s.conn.Select(ctx, &rows, query, args...); err != nil {
+		return nil, fmt.Errorf("failed to query currency volumes: %w", err)
+	}
+
+	volumes := make([]CurrencyVolume, 0, len(rows))
+	for _, row := range rows {
+		volumes = append(volumes, CurrencyVolume{ProjectID: row.ProjectID, Currency: row.Currency, Volume: row.Volume})
+	}
+	return volumes, nil
+}
+
+func (s *clickHouseStore) Status(ctx context.Context) (PipelineStatus, error) {
+	var rows []struct {
+		EarliestDate    string `ch:"earliest_date"`
+		LatestDate      string `ch:"latest_date"`
+		Rows            uint64 `ch:"rows"`
+		Projects        uint64 `ch:"projects"`
+		RateMissingRows uint64 `ch:"rate_missing_rows"`
+	}
+	query := `
+		SELECT
+			if(count() = 0, '', toString(min(date))) AS earliest_date,
+			if(count() = 0, '', toString(max(date))) AS latest_date,
+			count() AS rows,
+			uniqExact(project_id) AS projects,
+			countIf(rate_missing = 1) AS rate_missing_rows
+		FROM marketplace_analytics
+	`
+	if err := s.conn.Select(ctx, &rows, query); err != nil {
+		return PipelineStatus{}, fmt.Errorf("failed to query status: %w", err)
+	}
+	versions, err := NewClickHouseMigrationStore(s.conn).AppliedVersions(ctx)
+	if err != nil {
+		return PipelineStatus{}, fmt.Errorf("failed to query schema version: %w", err)
+	}
+
+	status := PipelineStatus{}
+	if len(rows) > 0 {
+		status = PipelineStatus{
+			EarliestDate:    rows[0].EarliestDate,
+			LatestDate:      rows[0].LatestDate,
+			Rows:            int(rows[0].Rows),
+			Projects:        int(rows[0].Projects),
+			RateMissingRows: int(rows[0].RateMissingRows),
+		}
+	}
+	if len(versions) > 0 {
+		status.SchemaVersion = versions[len(versions)-1]
+	}
+	return status, nil
+}
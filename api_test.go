@@ -0,0 +1,207 @@
+package chaindataagg_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	chaindataagg "github.com/atkachyshyn/chain-data-agg"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeStore serves fixed rows and counts the queries it answers.
+type fakeStore struct {
+	volumes []chaindataagg.DailyVolume
+	queries int
+	err     error
+}
+
+func (s *fakeStore) DailyVolumes(ctx context.Context, projectID, from, to string, page chaindataagg.Page) ([]chaindataagg.DailyVolume, error) {
+	s.queries++
+	if s.err != nil {
+		return nil, s.err
+	}
+	var volumes []chaindataagg.DailyVolume
+	for _, volume := range s.volumes {
+		if (projectID == "" || volume.ProjectID == projectID) && volume.Date >= from && volume.Date <= to {
+			volumes = append(volumes, volume)
+		}
+	}
+	return window(volumes, page), nil
+}
+
+func (s *fakeStore) TopProjects(ctx context.Context, from, to string, page chaindataagg.Page) ([]chaindataagg.ProjectVolume, error) {
+	s.queries++
+	return window([]chaindataagg.ProjectVolume{
+		{ProjectID: "4974", Transactions: 3, VolumeUSD: 30},
+		{ProjectID: "1660", Transactions: 2, VolumeUSD: 20},
+	}, page), nil
+}
+
+func (s *fakeStore) CurrencyVolumes(ctx context.Context, projectID, from, to string, page chaindataagg.Page) ([]chaindataagg.CurrencyVolume, error) {
+	s.queries++
+	return window([]chaindataagg.CurrencyVolume{
+		{ProjectID: "4974", Currency: "eur", Volume: 27},
+		{ProjectID: "4974", Currency: "usd", Volume: 30},
+	}, page), nil
+}
+
+func (s *fakeStore) Status(ctx context.Context) (chaindataagg.PipelineStatus, error) {
+	s.queries++
+	return chaindataagg.PipelineStatus{LatestDate: "2024-04-16", Rows: 3, Projects: 2, SchemaVersion: 5}, nil
+}
+
+func window[T any](items []T, page chaindataagg.Page) []T {
+	if page.Offset >= len(items) {
+		return nil
+	}
+	return items[page.Offset:min(page.Offset+page.Limit, len(items))]
+}
+
+type listBody[T any] struct {
+	Data       []T `json:"data"`
+	Pagination struct {
+		Limit      int  `json:"limit"`
+		Offset     int  `json:"offset"`
+		NextOffset *int `json:"next_offset"`
+	} `json:"pagination"`
+	Error string `json:"error"`
+}
+
+func get[T any](t *testing.T, handler http.Handler, target string) (*httptest.ResponseRecorder, T) {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, target, nil))
+	var body T
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &body))
+	return recorder, body
+}
+
+func TestAPIVolumes(t *testing.T) {
+	store := &fakeStore{volumes: []chaindataagg.DailyVolume{
+		{Date: "2024-04-15", ProjectID: "1660", Transactions: 2, VolumeUSD: 20},
+		{Date: "2024-04-15", ProjectID: "4974", Transactions: 1, VolumeUSD: 10},
+		{Date: "2024-04-16", ProjectID: "4974", Transactions: 2, VolumeUSD: 20},
+	}}
+	api := chaindataagg.NewAPI(store, nil, 0)
+
+	t.Run("paginated", func(t *testing.T) {
+		recorder, body := get[listBody[chaindataagg.DailyVolume]](t, api, "/v1/volumes?from=2024-04-15&to=2024-04-16&limit=2")
+		require.Equal(t, http.StatusOK, recorder.Code)
+		require.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+		require.Equal(t, store.volumes[:2], body.Data)
+		require.NotNil(t, body.Pagination.NextOffset)
+		require.Equal(t, 2, *body.Pagination.NextOffset)
+
+		_, body = get[listBody[chaindataagg.DailyVolume]](t, api, "/v1/volumes?from=2024-04-15&to=2024-04-16&limit=2&offset=2")
+		require.Equal(t, store.volumes[2:], body.Data)
+		require.Nil(t, body.Pagination.NextOffset)
+	})
+
+	t.Run("by project", func(t *testing.T) {
+		_, body := get[listBody[chaindataagg.DailyVolume]](t, api, "/v1/volumes?project_id=4974&from=2024-04-16&to=2024-04-16")
+		require.Equal(t, store.volumes[2:], body.Data)
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		_, body := get[listBody[chaindataagg.DailyVolume]](t, api, "/v1/volumes?from=2023-01-01&to=2023-01-31")
+		require.NotNil(t, body.Data)
+		require.Empty(t, body.Data)
+	})
+
+	t.Run("bad requests", func(t *testing.T) {
+		for _, target := range []string{
+			"/v1/volumes?from=15-04-2024",
+			"/v1/volumes?from=2024-04-16&to=2024-04-15",
+			"/v1/volumes?limit=0",
+			"/v1/volumes?limit=5000",
+			"/v1/volumes?offset=-1",
+		} {
+			recorder, body := get[listBody[chaindataagg.DailyVolume]](t, api, target)
+			require.Equal(t, http.StatusBadRequest, recorder.Code, target)
+			require.NotEmpty(t, body.Error, target)
+		}
+	})
+
+	t.Run("store error", func(t *testing.T) {
+		api := chaindataagg.NewAPI(&fakeStore{err: errors.New("connection refused")}, nil, 0)
+		recorder, body := get[listBody[chaindataagg.DailyVolume]](t, api, "/v1/volumes")
+		require.Equal(t, http.StatusInternalServerError, recorder.Code)
+		require.Equal(t, "internal error", body.Error)
+	})
+}
+
+func TestAPITopProjectsAndCurrencies(t *testing.T) {
+	api := chaindataagg.NewAPI(&fakeStore{}, nil, 0)
+
+	_, top := get[listBody[chaindataagg.ProjectVolume]](t, api, "/v1/projects/top?from=2024-04-01&to=2024-04-30&limit=1")
+	require.Equal(t, []chaindataagg.ProjectVolume{{ProjectID: "4974", Transactions: 3, VolumeUSD: 30}}, top.Data)
+	require.Equal(t, 1, *top.Pagination.NextOffset)
+
+	_, currencies := get[listBody[chaindataagg.CurrencyVolume]](t, api, "/v1/currencies?project_id=4974")
+	require.Len(t, currencies.Data, 2)
+	require.Equal(t, chaindataagg.DefaultPageSize, currencies.Pagination.Limit)
+
+	recorder, status := get[chaindataagg.PipelineStatus](t, api, "/v1/status")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.Equal(t, 5, status.SchemaVersion)
+	require.Equal(t, "2024-04-16", status.LatestDate)
+}
+
+func TestAPIRuns(t *testing.T) {
+	ctx := context.Background()
+	runs := chaindataagg.NewJSONRunStore(filepath.Join(t.TempDir(), "runs"))
+	for _, id := range []string{"20240415T000000Z-00000000", "20240416T000000Z-00000001"} {
+		run := chaindataagg.NewRun("aggregator load")
+		run.ID = id
+		run.Finish(errors.New("connection refused"))
+		require.NoError(t, runs.Save(ctx, run))
+	}
+	api := chaindataagg.NewAPI(&fakeStore{}, runs, 0)
+
+	recorder, body := get[listBody[*chaindataagg.Run]](t, api, "/v1/runs?limit=1")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.Len(t, body.Data, 1)
+	require.Equal(t, "20240416T000000Z-00000001", body.Data[0].ID)
+	require.NotNil(t, body.Pagination.NextOffset)
+
+	_, body = get[listBody[*chaindataagg.Run]](t, api, "/v1/runs?offset=1")
+	require.Len(t, body.Data, 1)
+	require.Equal(t, "20240415T000000Z-00000000", body.Data[0].ID)
+	require.Nil(t, body.Pagination.NextOffset)
+
+	recorder, run := get[*chaindataagg.Run](t, api, "/v1/runs/20240415T000000Z-00000000")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.Equal(t, chaindataagg.RunFailed, run.Status)
+	require.Equal(t, "connection refused", run.Error)
+
+	recorder, _ = get[map[string]string](t, api, "/v1/runs/missing")
+	require.Equal(t, http.StatusNotFound, recorder.Code)
+
+	// Without a run store, runs are not served.
+	recorder = httptest.NewRecorder()
+	chaindataagg.NewAPI(&fakeStore{}, nil, 0).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/v1/runs", nil))
+	require.Equal(t, http.StatusNotFound, recorder.Code)
+}
+
+func TestAPICache(t *testing.T) {
+	store := &fakeStore{}
+	api := chaindataagg.NewAPI(store, nil, time.Minute)
+
+	recorder, _ := get[chaindataagg.PipelineStatus](t, api, "/v1/status")
+	require.Equal(t, "MISS", recorder.Header().Get("X-Cache"))
+	recorder, _ = get[chaindataagg.PipelineStatus](t, api, "/v1/status")
+	require.Equal(t, "HIT", recorder.Header().Get("X-Cache"))
+	require.Equal(t, 1, store.queries)
+
+	// Requests with other parameters are answered by the store.
+	get[listBody[chaindataagg.ProjectVolume]](t, api, "/v1/projects/top?limit=1")
+	get[listBody[chaindataagg.ProjectVolume]](t, api, "/v1/projects/top?limit=2")
+	get[listBody[chaindataagg.ProjectVolume]](t, api, "/v1/projects/top?limit=1")
+	require.Equal(t, 3, store.queries)
+}
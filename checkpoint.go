@@ -0,0 +1,101 @@
+package chaindataagg
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"time"
+)
+
+// Checkpoint records how far a load got, so an interrupted or failed load
+// resumes after the rows it already wrote.
+type Checkpoint struct {
+	Input string `json:"input"`
+	// SHA256 is the checksum of the input content, so a checkpoint does not
+	// resume a load of an input rewritten since.
+	SHA256      string    `json:"sha256"`
+	Destination string    `json:"destination"`
+	Target      string    `json:"target,omitempty"`
+	Rows        int       `json:"rows"`
+	RowsLoaded  int       `json:"rows_loaded"`
+	Interrupted bool      `json:"interrupted"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// ReadCheckpoint reads a checkpoint from a local file or a gs://bucket/object
+// URI. It returns nil if there is no checkpoint yet.
+func ReadCheckpoint(ctx context.Context, path string) (*Checkpoint, error) {
+	data, err := ReadInput(ctx, path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checkpoint: %w", err)
+	}
+
+	var checkpoint Checkpoint
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		return nil, fmt.Errorf("failed to parse checkpoint: %w", err)
+	}
+	return &checkpoint, nil
+}
+
+// Save writes the checkpoint to a local file or a gs://bucket/object URI.
+func (c *Checkpoint) Save(ctx context.Context, path string) error {
+	c.UpdatedAt = time.Now().UTC()
+	content, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := WriteOutput(ctx, path, content); err != nil {
+		return fmt.Errorf("failed to save checkpoint: %w", err)
+	}
+	return nil
+}
+
+// Complete reports whether all rows were loaded.
+func (c *Checkpoint) Complete() bool {
+	return c.RowsLoaded >= c.Rows
+}
+
+// ResumeCheckpoint returns the checkpoint to continue a load of rows from
+// the input content into the destination. A checkpoint of another load, or
+// of another content of the input, starts over.
+func ResumeCheckpoint(previous *Checkpoint, input string, content []byte, destination, target string, rows int) *Checkpoint {
+	sum := sha256.Sum256(content)
+	checksum := hex.EncodeToString(sum[:])
+	if previous != nil && previous.Input == input && previous.SHA256 == checksum && previous.Destination == destination &&
+		previous.Target == target && previous.Rows == rows {
+		resumed := *previous
+		resumed.Interrupted = false
+		return &resumed
+	}
+	return &Checkpoint{Input: input, SHA256: checksum, Destination: destination, Target: target, Rows: rows}
+}
+
+// WriteResumable writes the rows the checkpoint does not record as loaded in
+// chunks of chunkSize rows, all at once if chunkSize is not positive, and
+// advances the checkpoint after each chunk. The checkpoint is marked
+// interrupted if ctx is canceled.
+func WriteResumable(ctx context.Context, sink Sink, data []AggregatedData, chunkSize int, checkpoint *Checkpoint) error {
+	if chunkSize <= 0 {
+		chunkSize = max(len(data), 1)
+	}
+	for checkpoint.RowsLoaded < len(data) {
+		if err := ctx.Err(); err != nil {
+			checkpoint.Interrupted = true
+			return err
+		}
+		chunk := data[checkpoint.RowsLoaded:min(checkpoint.RowsLoaded+chunkSize, len(data))]
+		if err := sink.Write(ctx, chunk); err != nil {
+			checkpoint.Interrupted = ctx.Err() != nil
+			return err
+		}
+		checkpoint.RowsLoaded += len(chunk)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package chaindataagg_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	chaindataagg "github.com/atkachyshyn/chain-data-agg"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingSink records written rows and cancels the load after a number of
+// writes.
+type recordingSink struct {
+	rows        []chaindataagg.AggregatedData
+	writes      int
+	cancelAfter int
+	cancel      context.CancelFunc
+}
+
+func (s *recordingSink) Write(ctx context.Context, data []chaindataagg.AggregatedData) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.rows = append(s.rows, data...)
+	s.writes++
+	if s.writes == s.cancelAfter {
+		s.cancel()
+	}
+	return nil
+}
+
+func (s *recordingSink) Close() error { return nil }
+
+func TestWriteResumable(t *testing.T) {
+	data := make([]chaindataagg.AggregatedData, 5)
+	for i := range data {
+		data[i] = chaindataagg.AggregatedData{Date: "2024-04-15", ProjectID: string(rune('a' + i))}
+	}
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	content := []byte(`[{"date": "2024-04-15"}]`)
+
+	// The first load is interrupted after two chunks.
+	ctx, cancel := context.WithCancel(context.Background())
+	sink := &recordingSink{cancelAfter: 2, cancel: cancel}
+	checkpoint := chaindataagg.ResumeCheckpoint(nil, "in.json", content, "sqlite", "", len(data))
+	err := chaindataagg.WriteResumable(ctx, sink, data, 2, checkpoint)
+	require.ErrorIs(t, err, context.Canceled)
+	require.True(t, checkpoint.Interrupted)
+	require.Equal(t, 4, checkpoint.RowsLoaded)
+	require.NoError(t, checkpoint.Save(context.Background(), path))
+
+	// The second load resumes after the loaded rows.
+	previous, err := chaindataagg.ReadCheckpoint(context.Background(), path)
+	require.NoError(t, err)
+	checkpoint = chaindataagg.ResumeCheckpoint(previous, "in.json", content, "sqlite", "", len(data))
+	require.False(t, checkpoint.Interrupted)
+	sink = &recordingSink{}
+	require.NoError(t, chaindataagg.WriteResumable(context.Background(), sink, data, 2, checkpoint))
+	require.Equal(t, data[4:], sink.rows)
+	require.True(t, checkpoint.Complete())
+
+	// A checkpoint of another load starts over.
+	checkpoint = chaindataagg.ResumeCheckpoint(previous, "other.json", content, "sqlite", "", len(data))
+	require.Zero(t, checkpoint.RowsLoaded)
+
+	// So does a checkpoint of the same input rewritten with as many rows.
+	checkpoint = chaindataagg.ResumeCheckpoint(previous, "in.json", []byte(`[{"date": "2024-04-16"}]`), "sqlite", "", len(data))
+	require.Zero(t, checkpoint.RowsLoaded)
+}
+
+func TestReadCheckpointMissing(t *testing.T) {
+	checkpoint, err := chaindataagg.ReadCheckpoint(context.Background(), filepath.Join(t.TempDir(), "missing.json"))
+	require.NoError(t, err)
+	require.Nil(t, checkpoint)
+}
@@ -1,19 +1,55 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"log/slog"
+	"net/http"
 	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
 
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
 	chaindataagg "github.com/atkachyshyn/chain-data-agg"
 	"github.com/urfave/cli/v2"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 )
 
 func main() {
 	app := &cli.App{
 		Name:  "aggregator",
 		Usage: "Blockchain Data Aggregator",
+		Flags: []cli.Flag{
+			configFlag(),
+			&cli.StringFlag{
+				Name:  "log-level",
+				Usage: "Log level: debug, info, warn or error (default: info)",
+			},
+			&cli.StringFlag{
+				Name:  "log-format",
+				Usage: "Log format: text or json (default: text)",
+			},
+			&cli.StringFlag{
+				Name:  "metrics-addr",
+				Usage: "Address to serve Prometheus metrics on at /metrics (e.g. :9090)",
+			},
+			&cli.StringFlag{
+				Name:  "metrics-push-url",
+				Usage: "Pushgateway URL to push metrics to when the command finishes",
+			},
+			&cli.StringFlag{
+				Name:  "trace-exporter",
+				Usage: "Trace exporter: none, stdout or otlp (default: none)",
+			},
+		},
+		After: func(c *cli.Context) error {
+			return errors.Join(stopTracing(), stopMetrics())
+		},
 		Commands: []*cli.Command{
 			{
 				Name:    "extract",
@@ -33,6 +69,23 @@ func main() {
 						Usage:    "Path to save extracted data",
 						Required: true,
 					},
+					&cli.StringFlag{
+						Name:  "expectations",
+						Usage: "Path to data-quality expectations (YAML), default for the built-in ones or empty to disable (default: default)",
+					},
+					&cli.StringFlag{
+						Name:  "token-decimals",
+						Usage: "Path to currency decimals (JSON) raw values are checked with, in addition to the built-in ones",
+					},
+					&cli.StringFlag{
+						Name:  "expected-date",
+						Usage: "Day all transactions must fall on (YYYY-MM-DD)",
+					},
+					&cli.StringFlag{
+						Name:  "quality-report",
+						Usage: "Path to write the quality report to (local path or gs://bucket/object)",
+					},
+					dryRunFlag(),
 				},
 			},
 			{
@@ -59,6 +112,72 @@ func main() {
 						Usage:    "Path to currency rates",
 						Required: true,
 					},
+					&cli.StringFlag{
+						Name:  "missing-rate-policy",
+						Usage: "How to handle currencies without a rate: fail, skip, last-known or flag (default: fail)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "rates-history",
+						Usage: "Paths to previous currency rates, oldest first (used by the last-known policy and as the deviation baseline)",
+					},
+					&cli.DurationFlag{
+						Name:  "max-rate-age",
+						Usage: "Maximum age of currency rates (0 disables the check)",
+					},
+					&cli.Float64Flag{
+						Name:  "max-rate-deviation",
+						Usage: "Maximum day-over-day rate change, e.g. 0.5 for 1.5x (0 disables the check)",
+					},
+					&cli.StringFlag{
+						Name:  "price-mapping",
+						Usage: "Path to price mapping rules (JSON) for pegged and wrapped tokens",
+					},
+					&cli.StringSliceFlag{
+						Name:  "currencies",
+						Usage: "Comma-separated list of additional reporting currencies (e.g. eur,gbp)",
+					},
+					&cli.StringFlag{
+						Name:  "source-timezone",
+						Usage: "Time zone of input timestamps without a zone (default: UTC)",
+					},
+					&cli.StringFlag{
+						Name:  "day-timezone",
+						Usage: "Time zone defining the day boundaries for aggregation (default: UTC)",
+					},
+					&cli.StringFlag{
+						Name:  "rate-check-mode",
+						Usage: "What to do when rate checks fail: fail or warn (default: fail)",
+					},
+					&cli.StringFlag{
+						Name:  "anomaly-method",
+						Usage: "How to score daily project volumes against their history: none, zscore or mad (default: none)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "anomaly-history",
+						Usage: "Transformed data files, or warehouse, to compare daily volumes against",
+					},
+					&cli.Float64Flag{
+						Name:        "anomaly-threshold",
+						Usage:       "Score above which a daily volume is an anomaly",
+						DefaultText: "5",
+					},
+					&cli.StringFlag{
+						Name:  "anomaly-mode",
+						Usage: "What to do when anomalies are found: warn or fail (default: warn)",
+					},
+					&cli.StringFlag{
+						Name:  "anomaly-report",
+						Usage: "Path to write the anomaly report to (local path or gs://bucket/object)",
+					},
+					&cli.BoolFlag{
+						Name:  "wash-trades",
+						Usage: "Tag suspicious trades and report the volumes with and without them",
+					},
+					&cli.StringFlag{
+						Name:  "wash-trade-report",
+						Usage: "Path to write the wash-trade report to (local path or gs://bucket/object)",
+					},
+					dryRunFlag(),
 				},
 			},
 			{
@@ -76,26 +195,416 @@ func main() {
 					&cli.StringFlag{
 						Name:    "destination",
 						Aliases: []string{"d"},
-						Usage:   "Target destination (e.g., ClickHouse, BigQuery)",
-						Value:   "ClickHouse",
+						Usage:   "Target destination: clickhouse, postgres, sqlite, csv or parquet",
+						Value:   chaindataagg.DestinationClickHouse,
+					},
+					&cli.StringFlag{
+						Name:    "target",
+						Aliases: []string{"t"},
+						Usage:   "Destination target: database DSN, SQLite file or output file (local path or gs://bucket/object)",
+					},
+					&cli.BoolFlag{
+						Name:  "verify",
+						Usage: "Reconcile the destination against the transformed data after loading",
+					},
+					&cli.Float64Flag{
+						Name:  "tolerance",
+						Usage: "Relative tolerance for volume sums when reconciling",
+						Value: 1e-6,
+					},
+					&cli.StringFlag{
+						Name:  "report",
+						Usage: "Where to write the reconciliation report (local path or gs://bucket/object; stdout by default)",
+					},
+					&cli.StringFlag{
+						Name:  "checkpoint",
+						Usage: "Checkpoint file to resume an interrupted load from (local path or gs://bucket/object)",
+					},
+					dryRunFlag(),
+				},
+			},
+			{
+				Name:   "verify",
+				Usage:  "Reconcile the destination against the transformed data",
+				Action: verifyAction(chaindataagg.NewLogger("verify")),
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "input",
+						Aliases:  []string{"i"},
+						Usage:    "Path to transformed data",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:    "destination",
+						Aliases: []string{"d"},
+						Usage:   "Destination to verify: clickhouse, postgres or sqlite",
+						Value:   chaindataagg.DestinationClickHouse,
+					},
+					&cli.StringFlag{
+						Name:    "target",
+						Aliases: []string{"t"},
+						Usage:   "Destination target: database DSN or SQLite file",
+					},
+					&cli.Float64Flag{
+						Name:  "tolerance",
+						Usage: "Relative tolerance for volume sums when reconciling",
+						Value: 1e-6,
+					},
+					&cli.StringFlag{
+						Name:  "report",
+						Usage: "Where to write the reconciliation report (local path or gs://bucket/object; stdout by default)",
+					},
+					dryRunFlag(),
+				},
+			},
+			{
+				Name:  "migrate",
+				Usage: "Manage the ClickHouse schema",
+				Subcommands: []*cli.Command{
+					{
+						Name:   "up",
+						Usage:  "Apply pending migrations",
+						Action: migrateUpAction(chaindataagg.NewLogger("migrate")),
+						Flags: []cli.Flag{
+							&cli.IntFlag{
+								Name:  "steps",
+								Usage: "Number of migrations to apply (0 applies all)",
+							},
+							dryRunFlag(),
+						},
+					},
+					{
+						Name:   "down",
+						Usage:  "Revert applied migrations",
+						Action: migrateDownAction(chaindataagg.NewLogger("migrate")),
+						Flags: []cli.Flag{
+							&cli.IntFlag{
+								Name:  "steps",
+								Usage: "Number of migrations to revert (0 reverts all)",
+								Value: 1,
+							},
+							dryRunFlag(),
+						},
+					},
+					{
+						Name:   "status",
+						Usage:  "Show applied and pending migrations",
+						Action: migrateStatusAction(chaindataagg.NewLogger("migrate")),
+					},
+				},
+			},
+			{
+				Name:   "serve",
+				Usage:  "Serve the aggregated analytics over a read-only REST API",
+				Action: serveAction(chaindataagg.NewLogger("serve")),
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "listen",
+						Usage: "Address to listen on (default: :8080)",
+					},
+					&cli.DurationFlag{
+						Name:        "cache-ttl",
+						Usage:       "How long responses are cached, 0 disables the cache",
+						DefaultText: "1m",
+					},
+				},
+			},
+			{
+				Name:  "runs",
+				Usage: "Show the history of pipeline runs",
+				Subcommands: []*cli.Command{
+					{
+						Name:   "list",
+						Usage:  "List the latest runs",
+						Action: runsListAction(chaindataagg.NewLogger("runs")),
+						Flags: []cli.Flag{
+							&cli.IntFlag{
+								Name:  "limit",
+								Usage: "Number of runs to list",
+								Value: 20,
+							},
+						},
+					},
+					{
+						Name:      "show",
+						Usage:     "Show a run with its stages and artifacts",
+						ArgsUsage: "<run-id>",
+						Action:    runsShowAction(chaindataagg.NewLogger("runs")),
+					},
+				},
+			},
+			{
+				Name:   "lineage",
+				Usage:  "Trace a row loaded into ClickHouse back to its source file, price snapshot and transactions",
+				Action: lineageAction(chaindataagg.NewLogger("lineage")),
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "date",
+						Usage:    "Day of the row (YYYY-MM-DD)",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:     "project-id",
+						Usage:    "Project of the row",
+						Required: true,
 					},
 				},
 			},
 		},
 	}
 
-	if err := app.Run(os.Args); err != nil {
+	ctx := chaindataagg.SignalContext()
+	err := app.RunContext(ctx, os.Args)
+	if err != nil && ctx.Err() == nil && currentRun != nil && !failureNotified {
+		notify(ctx, chaindataagg.NewLogger("notify"), chaindataagg.NotifyStageFailed, currentRun.Command+" failed: "+err.Error(), nil)
+	}
+	if recordErr := finishRun(err); recordErr != nil {
+		log.Printf("Failed to record run: %v", recordErr)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			log.Printf("Interrupted: %v", err)
+			os.Exit(chaindataagg.ExitInterrupted)
+		}
 		log.Fatal(err)
 	}
 }
 
+// configFlag selects the config file.
+func configFlag() cli.Flag {
+	return &cli.StringFlag{
+		Name:    "config",
+		Aliases: []string{"c"},
+		Usage:   "Path to the YAML config file",
+		EnvVars: []string{"CONFIG_FILE"},
+	}
+}
+
+// loadConfig loads the configuration, layered as defaults < config file <
+// environment < command line flags, and checks the settings the command
+// requires.
+func loadConfig(c *cli.Context, requires ...func(*chaindataagg.Config) error) (*chaindataagg.Config, error) {
+	cfg, err := chaindataagg.LoadConfigFile(c.String("config"))
+	if err != nil {
+		return nil, err
+	}
+
+	if c.IsSet("missing-rate-policy") {
+		cfg.MissingRatePolicy = c.String("missing-rate-policy")
+	}
+	if c.IsSet("rate-check-mode") {
+		cfg.RateCheckMode = c.String("rate-check-mode")
+	}
+	if c.IsSet("anomaly-method") {
+		cfg.AnomalyMethod = c.String("anomaly-method")
+	}
+	if c.IsSet("anomaly-history") {
+		cfg.AnomalyHistory = c.StringSlice("anomaly-history")
+	}
+	if c.IsSet("anomaly-threshold") {
+		cfg.AnomalyThreshold = c.Float64("anomaly-threshold")
+	}
+	if c.IsSet("anomaly-mode") {
+		cfg.AnomalyMode = c.String("anomaly-mode")
+	}
+	if c.IsSet("expectations") {
+		cfg.Expectations = c.String("expectations")
+	}
+	if c.IsSet("token-decimals") {
+		cfg.TokenDecimalsPath = c.String("token-decimals")
+	}
+	if c.IsSet("wash-trades") {
+		cfg.WashTradeDetection = c.Bool("wash-trades")
+	}
+	if c.IsSet("max-rate-age") {
+		cfg.MaxRateAge = c.Duration("max-rate-age")
+	}
+	if c.IsSet("max-rate-deviation") {
+		cfg.MaxRateDeviation = c.Float64("max-rate-deviation")
+	}
+	if c.IsSet("price-mapping") {
+		cfg.PriceMappingPath = c.String("price-mapping")
+	}
+	if c.IsSet("currencies") {
+		cfg.Currencies = c.StringSlice("currencies")
+	}
+	if c.IsSet("source-timezone") {
+		cfg.SourceTimezone = c.String("source-timezone")
+	}
+	if c.IsSet("day-timezone") {
+		cfg.DayTimezone = c.String("day-timezone")
+	}
+	if c.IsSet("log-level") {
+		cfg.LogLevel = c.String("log-level")
+	}
+	if c.IsSet("log-format") {
+		cfg.LogFormat = c.String("log-format")
+	}
+
+	if c.IsSet("metrics-addr") {
+		cfg.MetricsAddr = c.String("metrics-addr")
+	}
+	if c.IsSet("metrics-push-url") {
+		cfg.MetricsPushURL = c.String("metrics-push-url")
+	}
+	if c.IsSet("trace-exporter") {
+		cfg.TraceExporter = c.String("trace-exporter")
+	}
+	// Every command records its run, in ClickHouse if so configured.
+	if cfg.RunStoreLocation() == chaindataagg.RunStoreClickHouse {
+		requires = append(requires, (*chaindataagg.Config).RequireClickHouse)
+	}
+	errs := []error{cfg.Validate()}
+	for _, require := range requires {
+		errs = append(errs, require(cfg))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	if err := chaindataagg.ConfigureLogging(cfg.LogLevel, cfg.LogFormat); err != nil {
+		return nil, err
+	}
+	stop, err := chaindataagg.StartMetrics(cfg, "aggregator", c.Command.FullName())
+	if err != nil {
+		return nil, err
+	}
+	stopMetrics = stop
+
+	// The steps of the command are traced under the root span of the run.
+	ctx, stop, err := chaindataagg.StartTracing(c.Context, cfg, "aggregator", c.Command.FullName())
+	if err != nil {
+		return nil, err
+	}
+	c.Context = ctx
+	stopTracing = stop
+	return cfg, nil
+}
+
+// requireDestination checks the settings needed by the destination of the
+// command.
+func requireDestination(c *cli.Context) func(*chaindataagg.Config) error {
+	return func(cfg *chaindataagg.Config) error {
+		if strings.EqualFold(c.String("destination"), chaindataagg.DestinationClickHouse) {
+			return cfg.RequireClickHouse()
+		}
+		return nil
+	}
+}
+
+// stopMetrics pushes and stops the metrics started by loadConfig.
+var stopMetrics = func() error { return nil }
+
+// stopTracing ends the run started by loadConfig and flushes its spans.
+var stopTracing = func() error { return nil }
+
+// currentRun is the record of the command run started by beginRun, nil for
+// commands that are not recorded.
+var currentRun *chaindataagg.Run
+
+// runStore keeps currentRun, nil if the run store could not be opened.
+var runStore chaindataagg.RunStore
+
+// beginRun starts the record of the command run. Failing to record a run does
+// not fail the command.
+func beginRun(c *cli.Context, cfg *chaindataagg.Config, logger *slog.Logger) {
+	currentRun = chaindataagg.NewRun("aggregator " + c.Command.FullName())
+	notifiers = chaindataagg.NewNotifiers(cfg)
+	// Dry runs write nothing, not even their run record.
+	if c.Bool("dry-run") {
+		logger.Info("Run started, not recorded in a dry run", slog.String("run_id", currentRun.ID))
+		return
+	}
+	logger.Info("Run started", slog.String("run_id", currentRun.ID), slog.String("store", cfg.RunStoreLocation()))
+
+	store, closeStore, err := chaindataagg.OpenRunStore(c.Context, cfg)
+	if err != nil {
+		logger.Warn("Failed to open run store, the run is not recorded", slog.String("error", err.Error()))
+		return
+	}
+	if err := store.Save(c.Context, currentRun); err != nil {
+		closeStore()
+		logger.Warn("Failed to record run", slog.String("error", err.Error()))
+		return
+	}
+	runStore, closeRunStore = store, closeStore
+}
+
+// closeRunStore closes runStore.
+var closeRunStore = func() error { return nil }
+
+// finishRun records the result of the command run, if any.
+func finishRun(err error) error {
+	if runStore == nil {
+		return nil
+	}
+	defer closeRunStore()
+	currentRun.Finish(err)
+
+	// The run is recorded even if the command was interrupted.
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return runStore.Save(ctx, currentRun)
+}
+
+// notifiers deliver the notifications of the current run.
+var notifiers chaindataagg.Notifiers
+
+// failureNotified is set when the error of the command was already notified
+// in detail, so no stage failure is notified.
+var failureNotified bool
+
+// notify sends a notification about the current run. Failing to deliver it
+// does not fail the command.
+func notify(ctx context.Context, logger *slog.Logger, kind, summary string, details map[string]any) {
+	if len(notifiers) == 0 {
+		return
+	}
+	// The notification is delivered even if the command was interrupted.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+	defer cancel()
+	if err := notifiers.Notify(ctx, chaindataagg.NewNotification(currentRun, kind, summary, details)); err != nil {
+		logger.Warn("Failed to send notification", slog.String("kind", kind), slog.String("error", err.Error()))
+	}
+}
+
+// notifyErrorRate notifies when the rejected rows of a stage exceed the
+// configured error rate.
+func notifyErrorRate(ctx context.Context, cfg *chaindataagg.Config, logger *slog.Logger, stage string, rejected, total int) {
+	if !cfg.ErrorRateExceeded(rejected, total) {
+		return
+	}
+	notify(ctx, logger, chaindataagg.NotifyErrorRate, fmt.Sprintf("%s rejected %d of %d rows", stage, rejected, total), map[string]any{
+		"stage":      stage,
+		"rejected":   rejected,
+		"rows":       total,
+		"error_rate": float64(rejected) / float64(total),
+		"threshold":  cfg.NotifyErrorRate,
+	})
+}
+
+// bucketURI returns the gs:// URI of an object.
+func bucketURI(bucketName, objectName string) string {
+	return "gs://" + bucketName + "/" + objectName
+}
+
+// dryRunFlag makes a command perform all reads and computation but skip
+// uploads and inserts. Read-only commands do not take it.
+func dryRunFlag() cli.Flag {
+	return &cli.BoolFlag{
+		Name:  "dry-run",
+		Usage: "Perform all reads and computation, skip uploads and inserts and print a summary",
+	}
+}
+
 func extractAction(logger *slog.Logger) cli.ActionFunc {
 	return func(c *cli.Context) error {
 		// Load configuration.
-		cfg, err := chaindataagg.LoadConfig()
+		cfg, err := loadConfig(c, (*chaindataagg.Config).RequireBucket)
 		if err != nil {
 			return err
 		}
+		beginRun(c, cfg, logger)
 
 		// Input and output parameters.
 		input := c.String("input")
@@ -108,19 +617,40 @@ func extractAction(logger *slog.Logger) cli.ActionFunc {
 
 		// Step 1: Download file from GCP bucket.
 		logger.Info("Downloading input file from GCP", slog.String("bucket", bucketName), slog.String("input", input))
-		data, err := chaindataagg.DownloadFromBucket(bucketName, input)
+		source, err := chaindataagg.DownloadObject(c.Context, bucketName, input, 0)
 		if err != nil {
 			logger.Error("Failed to download input file from GCP", slog.String("error", err.Error()))
 			return err
 		}
+		data := source.Data
+		currentRun.AddArtifact("input", bucketURI(bucketName, input), data)
 
 		// Step 2: Extract transactions from the downloaded data.
 		logger.Info("Extracting data")
-		transactions, err := chaindataagg.Extract(data, cfg.WorkersNum)
+		transactions, summary, err := chaindataagg.ExtractWithSummary(c.Context, data, cfg.WorkersNum)
 		if err != nil {
 			logger.Error("Failed to extract data", slog.String("error", err.Error()))
 			return err
 		}
+		currentRun.AddStage(chaindataagg.StageResult{Name: "extract", RowsIn: summary.Rows, RowsOut: len(transactions), Rejected: summary.Rejected})
+		notifyErrorRate(c.Context, cfg, logger, "extract", summary.Rejected, summary.Rows)
+		for _, rowErr := range summary.Errors {
+			logger.Warn("Rejected row", slog.String("error", rowErr.Error()))
+		}
+		var extractErr error
+		if summary.Rejected > 0 {
+			extractErr = fmt.Errorf("errors occurred during extraction: %v", summary.Errors)
+			if !c.Bool("dry-run") {
+				logger.Error("Failed to extract data", slog.String("error", extractErr.Error()))
+				return extractErr
+			}
+		}
+		if err := checkQuality(c, cfg, logger, transactions); err != nil {
+			if !c.Bool("dry-run") {
+				return err
+			}
+			extractErr = errors.Join(extractErr, err)
+		}
 
 		// Step 3: Serialize and upload the results to GCP.
 		logger.Info("Serializing extracted data")
@@ -130,11 +660,26 @@ func extractAction(logger *slog.Logger) cli.ActionFunc {
 			return err
 		}
 
+		if c.Bool("dry-run") {
+			if err := (chaindataagg.DryRunSummary{
+				Command:      "extract",
+				RowsParsed:   len(transactions),
+				RowsRejected: summary.Rejected,
+				Uploads:      map[string]int{output: len(serializedData)},
+			}).Print(os.Stdout); err != nil {
+				return err
+			}
+			return extractErr
+		}
+
 		logger.Info("Uploading extracted data to GCP", slog.String("bucket", bucketName), slog.String("output", output))
-		if err := chaindataagg.UploadToBucket(bucketName, output, serializedData); err != nil {
+		// The extracted data names its source for the lineage of the transformed rows.
+		metadata := chaindataagg.SourceMetadata(bucketURI(bucketName, input), source.Generation)
+		if err := chaindataagg.UploadObject(c.Context, bucketName, output, serializedData, metadata); err != nil {
 			logger.Error("Failed to upload extracted data", slog.String("error", err.Error()))
 			return err
 		}
+		currentRun.AddArtifact("output", bucketURI(bucketName, output), serializedData)
 
 		logger.Info("Data extraction completed successfully",
 			slog.String("output", output),
@@ -146,27 +691,55 @@ func extractAction(logger *slog.Logger) cli.ActionFunc {
 func transformAction(logger *slog.Logger) cli.ActionFunc {
 	return func(c *cli.Context) error {
 		// Load configuration.
-		cfg, err := chaindataagg.LoadConfig()
+		cfg, err := loadConfig(c, (*chaindataagg.Config).RequireBucket)
 		if err != nil {
 			return err
 		}
+		beginRun(c, cfg, logger)
 		bucketName := cfg.GCPBucketName
 		input := c.String("input")
 		output := c.String("output")
 		ratesPath := c.String("rates")
+		policy, err := chaindataagg.ParseMissingRatePolicy(cfg.MissingRatePolicy)
+		if err != nil {
+			return err
+		}
+		checkMode, err := chaindataagg.ParseRateCheckMode(cfg.RateCheckMode)
+		if err != nil {
+			return err
+		}
+		var mapping *chaindataagg.PriceMapping
+		if path := cfg.PriceMappingPath; path != "" {
+			mapping, err = chaindataagg.ReadPriceMapping(path)
+			if err != nil {
+				logger.Error("Failed to load price mapping", slog.String("error", err.Error()))
+				return err
+			}
+		}
+		sourceLocation, err := time.LoadLocation(cfg.SourceTimezone)
+		if err != nil {
+			return fmt.Errorf("invalid source timezone: %w", err)
+		}
+		dayLocation, err := time.LoadLocation(cfg.DayTimezone)
+		if err != nil {
+			return fmt.Errorf("invalid day timezone: %w", err)
+		}
 		logger.Info("Starting data transformation", slog.String("input", input), slog.String("output", output), slog.String("ratesPath", ratesPath))
 
 		// Download extracted data from GCP.
-		data, err := chaindataagg.DownloadFromBucket(bucketName, input)
+		extracted, err := chaindataagg.DownloadObject(c.Context, bucketName, input, 0)
 		if err != nil {
 			logger.Error("Failed to download extracted data", slog.String("error", err.Error()))
 			return err
 		}
-		rates, err := chaindataagg.DownloadFromBucket(bucketName, ratesPath)
+		ratesObject, err := chaindataagg.DownloadObject(c.Context, bucketName, ratesPath, 0)
 		if err != nil {
 			logger.Error("Failed to download rates", slog.String("error", err.Error()))
 			return err
 		}
+		data, rates := extracted.Data, ratesObject.Data
+		currentRun.AddArtifact("input", bucketURI(bucketName, input), data)
+		currentRun.AddArtifact("rates", bucketURI(bucketName, ratesPath), rates)
 
 		var transactions []chaindataagg.Transaction
 		if err := json.Unmarshal(data, &transactions); err != nil {
@@ -174,20 +747,158 @@ func transformAction(logger *slog.Logger) cli.ActionFunc {
 			return err
 		}
 
-		var currencyRates map[string]float64
-		err = json.Unmarshal(rates, &currencyRates)
+		snapshot, err := chaindataagg.ParseRateSnapshot(rates)
+		if err != nil {
+			logger.Error("Failed to deserialize rates", slog.String("error", err.Error()))
+			return err
+		}
+		currencyRates := snapshot.Rates
+		logger.Info("Currency rates",
+			slog.Any("ratesPath", currencyRates),
+			slog.String("provider", snapshot.Provider),
+			slog.Time("fetchedAt", snapshot.FetchedAt),
+		)
+
+		// Collect the last known rates from the price history, newer files override older ones.
+		lastKnownRates := make(map[string]float64)
+		var previous *chaindataagg.RateSnapshot
+		for _, historyPath := range c.StringSlice("rates-history") {
+			historyData, err := chaindataagg.DownloadFromBucket(c.Context, bucketName, historyPath)
+			if err != nil {
+				logger.Error("Failed to download rates history", slog.String("path", historyPath), slog.String("error", err.Error()))
+				return err
+			}
+			currentRun.AddArtifact("rates_history", bucketURI(bucketName, historyPath), historyData)
+
+			previous, err = chaindataagg.ParseRateSnapshot(historyData)
+			if err != nil {
+				logger.Error("Failed to deserialize rates history", slog.String("path", historyPath), slog.String("error", err.Error()))
+				return err
+			}
+			for symbol, rate := range previous.Rates {
+				lastKnownRates[symbol] = rate
+			}
+		}
+
+		// Check rates freshness and sanity against the most recent history file.
+		issues, err := chaindataagg.CheckRates(snapshot, previous, time.Now(), chaindataagg.RateCheckOptions{
+			MaxAge:       cfg.MaxRateAge,
+			MaxDeviation: cfg.MaxRateDeviation,
+			Mode:         checkMode,
+		})
+		for _, issue := range issues {
+			logger.Warn("Currency rate check failed",
+				slog.String("symbol", issue.Symbol),
+				slog.String("check", issue.Check),
+				slog.String("message", issue.Message),
+			)
+		}
+		if err != nil {
+			logger.Error("Currency rates rejected", slog.String("error", err.Error()))
+			return err
+		}
+
+		// Every row records the run, its source and its price snapshot.
+		sourceURI, sourceGeneration := chaindataagg.SourceFromMetadata(extracted.Metadata)
+		if sourceURI == "" {
+			logger.Warn("Extracted data does not name its source", slog.String("input", input))
+		}
+		lineage := &chaindataagg.Lineage{
+			RunID:                   currentRun.ID,
+			SourceURI:               sourceURI,
+			SourceGeneration:        sourceGeneration,
+			PriceSnapshotURI:        bucketURI(bucketName, ratesPath),
+			PriceSnapshotGeneration: ratesObject.Generation,
+		}
+
+		// Rates must be taken for one of the days of the aggregation, before
+		// any work is done with them.
+		dates, err := chaindataagg.TransactionDates(transactions, sourceLocation, dayLocation)
 		if err != nil {
+			logger.Error("Failed to transform data", slog.String("error", err.Error()))
 			return err
 		}
-		logger.Info("Currency rates", slog.Any("ratesPath", currencyRates))
+		if err := chaindataagg.CheckRateDay(snapshot, dayLocation, dates); err != nil {
+			if checkMode == chaindataagg.RateCheckFail {
+				logger.Error("Currency rates rejected", slog.String("error", err.Error()))
+				return err
+			}
+			logger.Warn("Currency rate check failed", slog.String("check", "day"), slog.String("message", err.Error()))
+		}
+
+		// Tag suspicious trades, so their volume is reported separately.
+		var (
+			suspicious []chaindataagg.SuspiciousTrade
+			flagged    []bool
+		)
+		if cfg.WashTradeDetection {
+			suspicious, flagged, err = chaindataagg.DetectWashTrades(transactions, chaindataagg.WashTradeOptions{
+				Window:         cfg.WashTradeWindow,
+				MinTrades:      cfg.WashTradeMinTrades,
+				MaxUsers:       cfg.WashTradeMaxUsers,
+				SourceLocation: sourceLocation,
+			})
+			if err != nil {
+				logger.Error("Failed to detect wash trades", slog.String("error", err.Error()))
+				return err
+			}
+			currentRun.AddStage(chaindataagg.StageResult{Name: "wash_trades", RowsIn: len(transactions), RowsOut: len(transactions), Rejected: len(suspicious)})
+		}
 
 		// Transform data.
-		aggregatedData, err := chaindataagg.Transform(transactions, currencyRates)
+		aggregatedData, summary, err := chaindataagg.TransformWithOptions(c.Context, transactions, currencyRates, chaindataagg.TransformOptions{
+			MissingRatePolicy: policy,
+			LastKnownRates:    lastKnownRates,
+			PriceMapping:      mapping,
+			Currencies:        cfg.Currencies,
+			Quotes:            snapshot.Quotes,
+			FX:                snapshot.FX,
+			SourceLocation:    sourceLocation,
+			DayLocation:       dayLocation,
+			Lineage:           lineage,
+			Suspicious:        flagged,
+		})
 		if err != nil {
 			logger.Error("Failed to transform data", slog.String("error", err.Error()))
 			return err
 		}
 
+		for _, missing := range summary.MissingRates {
+			logger.Warn("Missing exchange rate",
+				slog.String("symbol", missing.Symbol),
+				slog.Int("transactions", missing.Transactions),
+				slog.Float64("volume", missing.Volume),
+				slog.Float64("fallbackRate", missing.FallbackRate),
+				slog.String("policy", string(policy)),
+			)
+		}
+		currentRun.AddStage(chaindataagg.StageResult{Name: "transform", RowsIn: summary.Transactions, RowsOut: summary.Groups, Rejected: summary.Skipped})
+		notifyErrorRate(c.Context, cfg, logger, "transform", summary.Skipped, summary.Transactions)
+		if len(summary.MissingRates) > 0 {
+			symbols := make([]string, 0, len(summary.MissingRates))
+			for _, missing := range summary.MissingRates {
+				symbols = append(symbols, missing.Symbol)
+			}
+			notify(c.Context, logger, chaindataagg.NotifyMissingRates, fmt.Sprintf("%d currencies have no exchange rate", len(symbols)), map[string]any{
+				"symbols": symbols,
+				"policy":  string(policy),
+			})
+		}
+		if err := checkAnomalies(c, cfg, logger, aggregatedData); err != nil {
+			return err
+		}
+		if cfg.WashTradeDetection {
+			if err := reportWashTrades(c, logger, suspicious, aggregatedData); err != nil {
+				return err
+			}
+		}
+		logger.Info("Transformation summary",
+			slog.Int("transactions", summary.Transactions),
+			slog.Int("skipped", summary.Skipped),
+			slog.Int("groups", summary.Groups),
+			slog.Int("missingRates", len(summary.MissingRates)),
+		)
+
 		// Serialize and upload transformed data to GCP.
 		data, err = json.Marshal(aggregatedData)
 		if err != nil {
@@ -195,51 +906,775 @@ func transformAction(logger *slog.Logger) cli.ActionFunc {
 			return err
 		}
 
-		if err := chaindataagg.UploadToBucket(bucketName, output, data); err != nil {
+		if c.Bool("dry-run") {
+			return chaindataagg.DryRunSummary{
+				Command:       "transform",
+				RowsParsed:    len(transactions),
+				RowsRejected:  summary.Skipped,
+				Groups:        summary.Groups,
+				SymbolsPriced: len(summary.PricedSymbols),
+				Uploads:       map[string]int{output: len(data)},
+			}.Print(os.Stdout)
+		}
+
+		if err := chaindataagg.UploadToBucket(c.Context, bucketName, output, data); err != nil {
 			logger.Error("Failed to upload transformed data", slog.String("error", err.Error()))
 			return err
 		}
+		currentRun.AddArtifact("output", bucketURI(bucketName, output), data)
 
 		logger.Info("Data transformation completed", slog.String("output", output))
 		return nil
 	}
 }
 
-func loadAction(logger *slog.Logger) cli.ActionFunc {
-	return func(c *cli.Context) error {
-		// Load configuration.
-		cfg, err := chaindataagg.LoadConfig()
-		if err != nil {
-			return err
-		}
-		bucketName := cfg.GCPBucketName
-		input := c.String("input")
-		destination := c.String("destination")
-		logger.Info("Starting data load", slog.String("input", input), slog.String("destination", destination))
-
-		// Download transformed data from GCP.
-		data, err := chaindataagg.DownloadFromBucket(bucketName, input)
-		if err != nil {
-			logger.Error("Failed to download transformed data", slog.String("error", err.Error()))
-			return err
-		}
-
-		var aggregatedData []chaindataagg.AggregatedData
-		if err := json.Unmarshal(data, &aggregatedData); err != nil {
-			logger.Error("Failed to deserialize transformed data", slog.String("error", err.Error()))
-			return err
+// reportWashTrades logs the volumes of suspicious trades and writes the
+// wash-trade report.
+func reportWashTrades(c *cli.Context, logger *slog.Logger, suspicious []chaindataagg.SuspiciousTrade, data []chaindataagg.AggregatedData) error {
+	report := chaindataagg.WashTradeReport{Trades: suspicious, Aggregates: chaindataagg.WashTradeAggregates(data)}
+	for _, aggregate := range report.Aggregates {
+		if aggregate.SuspiciousTransactions == 0 {
+			continue
 		}
+		logger.Warn("Suspicious trades",
+			slog.String("date", aggregate.Date),
+			slog.String("project_id", aggregate.ProjectID),
+			slog.Int("transactions", aggregate.SuspiciousTransactions),
+			slog.Float64("volume_usd", aggregate.SuspiciousVolumeUSD),
+			slog.Float64("clean_volume_usd", aggregate.CleanVolumeUSD),
+		)
+	}
 
-		// Insert data into ClickHouse.
-		if destination == "ClickHouse" {
-			err = chaindataagg.Load(aggregatedData, cfg.ClickHouseHost, cfg.ClickHousePassword)
+	path := c.String("wash-trade-report")
+	if path == "" || c.Bool("dry-run") {
+		return nil
+	}
+	content, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := chaindataagg.WriteOutput(c.Context, path, content); err != nil {
+		logger.Error("Failed to write wash-trade report", slog.String("error", err.Error()))
+		return err
+	}
+	currentRun.AddArtifact("wash_trades", path, content)
+	return nil
+}
+
+// checkQuality checks the extracted transactions against the expectations
+// and reports the failures. Failed error expectations fail the extraction.
+func checkQuality(c *cli.Context, cfg *chaindataagg.Config, logger *slog.Logger, transactions []chaindataagg.Transaction) error {
+	if cfg.Expectations == "" {
+		return nil
+	}
+	expectations, err := chaindataagg.ReadExpectations(cfg.Expectations)
+	if err != nil {
+		logger.Error("Failed to load expectations", slog.String("error", err.Error()))
+		return err
+	}
+	sourceLocation, err := time.LoadLocation(cfg.SourceTimezone)
+	if err != nil {
+		return fmt.Errorf("invalid source timezone: %w", err)
+	}
+	dayLocation, err := time.LoadLocation(cfg.DayTimezone)
+	if err != nil {
+		return fmt.Errorf("invalid day timezone: %w", err)
+	}
+	decimals := chaindataagg.DefaultTokenDecimals()
+	if path := cfg.TokenDecimalsPath; path != "" {
+		if decimals, err = chaindataagg.ReadTokenDecimals(path); err != nil {
+			logger.Error("Failed to load token decimals", slog.String("error", err.Error()))
+			return err
+		}
+	}
+
+	report, err := chaindataagg.CheckQuality(transactions, expectations, chaindataagg.QualityOptions{
+		ExpectedDate:   c.String("expected-date"),
+		SourceLocation: sourceLocation,
+		DayLocation:    dayLocation,
+		Decimals:       decimals,
+	})
+	if err != nil {
+		return err
+	}
+	currentRun.AddStage(chaindataagg.StageResult{Name: "quality", RowsIn: report.Rows, RowsOut: report.Rows - report.FailedRows, Rejected: report.FailedRows})
+	for _, currency := range report.Decimals {
+		if currency.Source == chaindataagg.DecimalsInferred {
+			logger.Info("Inferred currency decimals",
+				slog.String("symbol", currency.Symbol),
+				slog.String("address", currency.Address),
+				slog.Int("decimals", currency.Decimals),
+			)
+		}
+	}
+	for _, result := range report.Results {
+		if result.Failed == 0 {
+			continue
+		}
+		logger.Warn("Quality expectation failed",
+			slog.String("expectation", result.Name),
+			slog.String("severity", string(result.Severity)),
+			slog.Int("rows", result.Failed),
+		)
+	}
+
+	if path := c.String("quality-report"); path != "" && !c.Bool("dry-run") {
+		content, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := chaindataagg.WriteOutput(c.Context, path, content); err != nil {
+			logger.Error("Failed to write quality report", slog.String("error", err.Error()))
+			return err
+		}
+		currentRun.AddArtifact("quality", path, content)
+	}
+
+	if err := report.Err(); err != nil {
+		logger.Error("Quality expectations failed", slog.String("error", err.Error()))
+		return err
+	}
+	return nil
+}
+
+// checkAnomalies compares the daily project volumes with their history and
+// reports the anomalies. Anomalies fail the transformation in fail mode.
+func checkAnomalies(c *cli.Context, cfg *chaindataagg.Config, logger *slog.Logger, data []chaindataagg.AggregatedData) error {
+	method, err := chaindataagg.ParseAnomalyMethod(cfg.AnomalyMethod)
+	if err != nil {
+		return err
+	}
+	mode, err := chaindataagg.ParseAnomalyMode(cfg.AnomalyMode)
+	if err != nil {
+		return err
+	}
+	if method == chaindataagg.AnomalyNone {
+		return nil
+	}
+
+	var (
+		history []chaindataagg.DailyVolume
+		conn    driver.Conn
+	)
+	for _, source := range cfg.AnomalyHistory {
+		var volumes []chaindataagg.DailyVolume
+		if source == chaindataagg.AnomalyHistoryWarehouse {
+			var options *clickhouse.Options
+			if options, err = cfg.ClickHouseOptions(); err != nil {
+				return err
+			}
+			if conn, err = chaindataagg.Connect(c.Context, options); err != nil {
+				logger.Error("Failed to connect to ClickHouse", slog.String("error", err.Error()))
+				return err
+			}
+			defer conn.Close()
+			from, to := chaindataagg.HistoryRange(data, cfg.AnomalyWindow)
+			volumes, err = chaindataagg.ReadWarehouseHistory(c.Context, chaindataagg.NewClickHouseStore(conn), from, to)
+		} else {
+			volumes, err = chaindataagg.ReadVolumeHistory(c.Context, source)
+		}
+		if err != nil {
+			logger.Error("Failed to read volume history", slog.String("source", source), slog.String("error", err.Error()))
+			return err
+		}
+		history = append(history, volumes...)
+	}
+
+	anomalies, err := chaindataagg.DetectAnomalies(data, history, chaindataagg.AnomalyOptions{
+		Method:     method,
+		Threshold:  cfg.AnomalyThreshold,
+		Window:     cfg.AnomalyWindow,
+		MinHistory: cfg.AnomalyMinHistory,
+	})
+	if err != nil {
+		return err
+	}
+	currentRun.AddStage(chaindataagg.StageResult{Name: "anomalies", RowsIn: len(data), RowsOut: len(data), Rejected: len(anomalies)})
+	for _, anomaly := range anomalies {
+		logger.Warn("Volume anomaly",
+			slog.String("date", anomaly.Date),
+			slog.String("project_id", anomaly.ProjectID),
+			slog.Float64("volume_usd", anomaly.VolumeUSD),
+			slog.Float64("baseline", anomaly.Baseline),
+			slog.Float64("score", anomaly.Score),
+		)
+	}
+
+	if !c.Bool("dry-run") {
+		if path := c.String("anomaly-report"); path != "" {
+			content, err := json.MarshalIndent(anomalies, "", "  ")
 			if err != nil {
-				logger.Error("Failed to insert data into ClickHouse", slog.String("error", err.Error()))
+				return err
+			}
+			if err := chaindataagg.WriteOutput(c.Context, path, content); err != nil {
+				logger.Error("Failed to write anomaly report", slog.String("error", err.Error()))
+				return err
+			}
+			currentRun.AddArtifact("anomalies", path, content)
+		}
+		if conn != nil {
+			if err := chaindataagg.WriteAnomalies(c.Context, conn, currentRun.ID, anomalies); err != nil {
+				logger.Error("Failed to record anomalies", slog.String("error", err.Error()))
 				return err
 			}
 		}
+	}
+	if len(anomalies) == 0 {
+		return nil
+	}
+
+	err = fmt.Errorf("%d daily project volumes are anomalies", len(anomalies))
+	notify(c.Context, logger, chaindataagg.NotifyAnomalies, err.Error(), map[string]any{
+		"method":    string(method),
+		"threshold": cfg.AnomalyThreshold,
+		"anomalies": anomalies,
+		"mode":      string(mode),
+	})
+	if mode == chaindataagg.AnomalyFail {
+		logger.Error("Anomalies rejected", slog.String("error", err.Error()))
+		failureNotified = true
+		return err
+	}
+	return nil
+}
+
+func loadAction(logger *slog.Logger) cli.ActionFunc {
+	return func(c *cli.Context) error {
+		// Load configuration.
+		cfg, err := loadConfig(c, (*chaindataagg.Config).RequireBucket, requireDestination(c))
+		if err != nil {
+			return err
+		}
+		beginRun(c, cfg, logger)
+		input := c.String("input")
+		destination := c.String("destination")
+		logger.Info("Starting data load", slog.String("input", input), slog.String("destination", destination))
+
+		aggregatedData, content, err := downloadAggregatedData(c.Context, logger, cfg.GCPBucketName, input)
+		if err != nil {
+			return err
+		}
+
+		if c.Bool("dry-run") {
+			inserts, err := chaindataagg.PlannedInserts(destination, c.String("target"), aggregatedData)
+			if err != nil {
+				logger.Error("Failed to plan load", slog.String("destination", destination), slog.String("error", err.Error()))
+				return err
+			}
+			return chaindataagg.DryRunSummary{
+				Command:    "load",
+				RowsParsed: len(aggregatedData),
+				Inserts:    inserts,
+			}.Print(os.Stdout)
+		}
+
+		// Write data to the destination.
+		checkpoint, err := loadCheckpoint(c, logger, content, len(aggregatedData))
+		if err != nil {
+			return err
+		}
+		if checkpoint.Complete() && c.IsSet("checkpoint") {
+			logger.Info("Data already loaded according to the checkpoint", slog.String("checkpoint", c.String("checkpoint")))
+			return nil
+		}
+
+		sink, err := chaindataagg.NewSink(c.Context, destination, c.String("target"), cfg)
+		if err != nil {
+			logger.Error("Failed to open destination", slog.String("destination", destination), slog.String("error", err.Error()))
+			return err
+		}
+		// Reject the verification before anything is written.
+		if _, ok := sink.(chaindataagg.Verifier); c.Bool("verify") && !ok {
+			chaindataagg.AbortSink(sink)
+			err := fmt.Errorf("destination %s does not support verification", destination)
+			logger.Error("Failed to load data", slog.String("error", err.Error()))
+			return err
+		}
+		err = chaindataagg.WriteResumable(c.Context, sink, aggregatedData, loadChunkSize(destination, cfg), checkpoint)
+		currentRun.AddStage(chaindataagg.StageResult{Name: "load", RowsIn: len(aggregatedData), RowsOut: checkpoint.RowsLoaded})
+		if saveErr := saveCheckpoint(c, logger, checkpoint); saveErr != nil && err == nil {
+			err = saveErr
+		}
+		if err != nil {
+			// File sinks must not write the rows of a failed load.
+			chaindataagg.AbortSink(sink)
+			logger.Error("Failed to load data",
+				slog.String("destination", destination),
+				slog.Int("rows_loaded", checkpoint.RowsLoaded),
+				slog.Bool("interrupted", checkpoint.Interrupted),
+				slog.String("error", err.Error()),
+			)
+			return err
+		}
+		if c.Bool("verify") {
+			if err := reconcile(c, logger, sink, aggregatedData); err != nil {
+				sink.Close()
+				return err
+			}
+		}
+		if err := sink.Close(); err != nil {
+			// File sinks write on Close, so the rows are not loaded after all.
+			checkpoint.RowsLoaded = 0
+			saveCheckpoint(c, logger, checkpoint)
+			logger.Error("Failed to finish load", slog.String("destination", destination), slog.String("error", err.Error()))
+			return err
+		}
 
 		logger.Info("Data load completed", slog.String("destination", destination))
 		return nil
 	}
 }
+
+func verifyAction(logger *slog.Logger) cli.ActionFunc {
+	return func(c *cli.Context) error {
+		cfg, err := loadConfig(c, (*chaindataagg.Config).RequireBucket, requireDestination(c))
+		if err != nil {
+			return err
+		}
+		beginRun(c, cfg, logger)
+		input := c.String("input")
+		destination := c.String("destination")
+		logger.Info("Starting reconciliation", slog.String("input", input), slog.String("destination", destination))
+
+		aggregatedData, _, err := downloadAggregatedData(c.Context, logger, cfg.GCPBucketName, input)
+		if err != nil {
+			return err
+		}
+
+		sink, err := chaindataagg.NewSink(c.Context, destination, c.String("target"), cfg)
+		if err != nil {
+			logger.Error("Failed to open destination", slog.String("destination", destination), slog.String("error", err.Error()))
+			return err
+		}
+		defer sink.Close()
+
+		return reconcile(c, logger, sink, aggregatedData)
+	}
+}
+
+// loadCheckpoint returns the checkpoint of a load of the input content,
+// resuming the one at --checkpoint if it belongs to the same load.
+func loadCheckpoint(c *cli.Context, logger *slog.Logger, content []byte, rows int) (*chaindataagg.Checkpoint, error) {
+	input, destination, target := c.String("input"), c.String("destination"), c.String("target")
+	path := c.String("checkpoint")
+	if path == "" {
+		return chaindataagg.ResumeCheckpoint(nil, input, content, destination, target, rows), nil
+	}
+
+	previous, err := chaindataagg.ReadCheckpoint(c.Context, path)
+	if err != nil {
+		logger.Error("Failed to read checkpoint", slog.String("checkpoint", path), slog.String("error", err.Error()))
+		return nil, err
+	}
+	checkpoint := chaindataagg.ResumeCheckpoint(previous, input, content, destination, target, rows)
+	if checkpoint.RowsLoaded > 0 {
+		logger.Info("Resuming load from checkpoint", slog.String("checkpoint", path), slog.Int("rows_loaded", checkpoint.RowsLoaded), slog.Int("rows", rows))
+	}
+	return checkpoint, nil
+}
+
+// saveCheckpoint writes the checkpoint to --checkpoint, if set. It is saved
+// even when the load was canceled.
+func saveCheckpoint(c *cli.Context, logger *slog.Logger, checkpoint *chaindataagg.Checkpoint) error {
+	path := c.String("checkpoint")
+	if path == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(c.Context), 30*time.Second)
+	defer cancel()
+	if err := checkpoint.Save(ctx, path); err != nil {
+		logger.Error("Failed to save checkpoint", slog.String("checkpoint", path), slog.String("error", err.Error()))
+		return err
+	}
+	return nil
+}
+
+// loadChunkSize is the number of rows loaded between checkpoints. Files are
+// written at once.
+func loadChunkSize(destination string, cfg *chaindataagg.Config) int {
+	switch strings.ToLower(destination) {
+	case chaindataagg.DestinationCSV, chaindataagg.DestinationParquet:
+		return 0
+	case chaindataagg.DestinationClickHouse:
+		if cfg.ClickHouseBatchSize > 0 {
+			return cfg.ClickHouseBatchSize
+		}
+	}
+	return chaindataagg.DefaultBatchSize
+}
+
+// downloadAggregatedData downloads and deserializes transformed data. It
+// also returns the downloaded content.
+func downloadAggregatedData(ctx context.Context, logger *slog.Logger, bucketName, input string) ([]chaindataagg.AggregatedData, []byte, error) {
+	data, err := chaindataagg.DownloadFromBucket(ctx, bucketName, input)
+	if err != nil {
+		logger.Error("Failed to download transformed data", slog.String("error", err.Error()))
+		return nil, nil, err
+	}
+	currentRun.AddArtifact("input", bucketURI(bucketName, input), data)
+
+	var aggregatedData []chaindataagg.AggregatedData
+	if err := json.Unmarshal(data, &aggregatedData); err != nil {
+		logger.Error("Failed to deserialize transformed data", slog.String("error", err.Error()))
+		return nil, nil, err
+	}
+	return aggregatedData, data, nil
+}
+
+// reconcile compares the destination with the transformed data and writes
+// the reconciliation report.
+func reconcile(c *cli.Context, logger *slog.Logger, sink chaindataagg.Sink, data []chaindataagg.AggregatedData) error {
+	verifier, ok := sink.(chaindataagg.Verifier)
+	if !ok {
+		err := fmt.Errorf("destination %s does not support verification", c.String("destination"))
+		logger.Error("Failed to verify load", slog.String("error", err.Error()))
+		return err
+	}
+
+	totals, err := verifier.Totals(c.Context, chaindataagg.AggregatedDates(data))
+	if err != nil {
+		logger.Error("Failed to read loaded totals", slog.String("error", err.Error()))
+		return err
+	}
+	report := chaindataagg.Reconcile(data, totals, c.Float64("tolerance"))
+	currentRun.AddStage(chaindataagg.StageResult{Name: "verify", RowsIn: report.ExpectedRows, RowsOut: report.ActualRows, Rejected: report.Mismatches})
+
+	content, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	if path := c.String("report"); path != "" && !c.Bool("dry-run") {
+		if err := chaindataagg.WriteOutput(c.Context, path, content); err != nil {
+			logger.Error("Failed to write reconciliation report", slog.String("error", err.Error()))
+			return err
+		}
+		currentRun.AddArtifact("report", path, content)
+	} else {
+		fmt.Println(string(content))
+	}
+
+	for _, project := range report.Projects {
+		if project.Status != chaindataagg.ReconcileOK {
+			logger.Warn("Reconciliation mismatch",
+				slog.String("date", project.Date),
+				slog.String("project_id", project.ProjectID),
+				slog.String("status", project.Status),
+			)
+		}
+	}
+	if err := report.Err(); err != nil {
+		logger.Error("Reconciliation failed", slog.Int("mismatches", report.Mismatches))
+		notify(c.Context, logger, chaindataagg.NotifyReconciliationMismatch, err.Error(), map[string]any{
+			"destination":   c.String("destination"),
+			"mismatches":    report.Mismatches,
+			"expected_rows": report.ExpectedRows,
+			"actual_rows":   report.ActualRows,
+		})
+		failureNotified = true
+		return err
+	}
+
+	logger.Info("Reconciliation passed", slog.Int("projects", len(report.Projects)), slog.Int("rows", report.ActualRows))
+	return nil
+}
+
+// newMigrator connects to ClickHouse and constructs a migrator over it.
+func newMigrator(c *cli.Context) (*chaindataagg.Migrator, func() error, error) {
+	cfg, err := loadConfig(c, (*chaindataagg.Config).RequireClickHouse)
+	if err != nil {
+		return nil, nil, err
+	}
+	beginRun(c, cfg, chaindataagg.NewLogger("migrate"))
+	options, err := cfg.ClickHouseOptions()
+	if err != nil {
+		return nil, nil, err
+	}
+	conn, err := chaindataagg.Connect(c.Context, options)
+	if err != nil {
+		return nil, nil, err
+	}
+	migrator, err := chaindataagg.NewMigrator(chaindataagg.NewClickHouseMigrationStore(conn))
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return migrator, conn.Close, nil
+}
+
+func migrateUpAction(logger *slog.Logger) cli.ActionFunc {
+	return func(c *cli.Context) error {
+		migrator, closeConn, err := newMigrator(c)
+		if err != nil {
+			logger.Error("Failed to connect to ClickHouse", slog.String("error", err.Error()))
+			return err
+		}
+		defer closeConn()
+
+		if c.Bool("dry-run") {
+			plan, err := migrator.PlanUp(c.Context, c.Int("steps"))
+			if err != nil {
+				logger.Error("Failed to plan migrations", slog.String("error", err.Error()))
+				return err
+			}
+			for _, migration := range plan {
+				logger.Info("Migration would be applied", slog.Int("version", migration.Version), slog.String("name", migration.Name))
+			}
+			return nil
+		}
+
+		applied, err := migrator.Up(c.Context, c.Int("steps"))
+		for _, migration := range applied {
+			logger.Info("Migration applied", slog.Int("version", migration.Version), slog.String("name", migration.Name))
+		}
+		if err != nil {
+			logger.Error("Failed to apply migrations", slog.String("error", err.Error()))
+			return err
+		}
+
+		logger.Info("Schema is up to date", slog.Int("applied", len(applied)))
+		return nil
+	}
+}
+
+func migrateDownAction(logger *slog.Logger) cli.ActionFunc {
+	return func(c *cli.Context) error {
+		migrator, closeConn, err := newMigrator(c)
+		if err != nil {
+			logger.Error("Failed to connect to ClickHouse", slog.String("error", err.Error()))
+			return err
+		}
+		defer closeConn()
+
+		if c.Bool("dry-run") {
+			plan, err := migrator.PlanDown(c.Context, c.Int("steps"))
+			if err != nil {
+				logger.Error("Failed to plan migrations", slog.String("error", err.Error()))
+				return err
+			}
+			for _, migration := range plan {
+				logger.Info("Migration would be reverted", slog.Int("version", migration.Version), slog.String("name", migration.Name))
+			}
+			return nil
+		}
+
+		reverted, err := migrator.Down(c.Context, c.Int("steps"))
+		for _, migration := range reverted {
+			logger.Info("Migration reverted", slog.Int("version", migration.Version), slog.String("name", migration.Name))
+		}
+		if err != nil {
+			logger.Error("Failed to revert migrations", slog.String("error", err.Error()))
+			return err
+		}
+
+		logger.Info("Migrations reverted", slog.Int("reverted", len(reverted)))
+		return nil
+	}
+}
+
+func migrateStatusAction(logger *slog.Logger) cli.ActionFunc {
+	return func(c *cli.Context) error {
+		migrator, closeConn, err := newMigrator(c)
+		if err != nil {
+			logger.Error("Failed to connect to ClickHouse", slog.String("error", err.Error()))
+			return err
+		}
+		defer closeConn()
+
+		statuses, err := migrator.Status(c.Context)
+		if err != nil {
+			logger.Error("Failed to read migration status", slog.String("error", err.Error()))
+			return err
+		}
+
+		for _, status := range statuses {
+			state := "pending"
+			if status.Applied {
+				state = "applied"
+			}
+			fmt.Printf("%04d_%s\t%s\n", status.Version, status.Name, state)
+		}
+		return nil
+	}
+}
+
+func serveAction(logger *slog.Logger) cli.ActionFunc {
+	return func(c *cli.Context) error {
+		cfg, err := loadConfig(c, (*chaindataagg.Config).RequireClickHouse)
+		if err != nil {
+			return err
+		}
+		if c.IsSet("listen") {
+			cfg.APIAddr = c.String("listen")
+		}
+		if c.IsSet("cache-ttl") {
+			cfg.APICacheTTL = c.Duration("cache-ttl")
+		}
+
+		options, err := cfg.ClickHouseOptions()
+		if err != nil {
+			return err
+		}
+		conn, err := chaindataagg.Connect(c.Context, options)
+		if err != nil {
+			logger.Error("Failed to connect to ClickHouse", slog.String("error", err.Error()))
+			return err
+		}
+		defer conn.Close()
+
+		// The API serves the analytics without runs if the run store cannot
+		// be opened.
+		runs, closeRuns, err := chaindataagg.OpenRunStore(c.Context, cfg)
+		if err != nil {
+			logger.Warn("Failed to open run store, runs are not served", slog.String("error", err.Error()))
+		} else {
+			defer closeRuns()
+		}
+
+		api := chaindataagg.NewAPI(chaindataagg.NewClickHouseStore(conn), runs, cfg.APICacheTTL)
+		server := &http.Server{
+			Addr:              cfg.APIAddr,
+			Handler:           otelhttp.NewHandler(api, "api"),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+
+		// Requests in flight are completed on SIGINT or SIGTERM.
+		shutdown := make(chan error, 1)
+		go func() {
+			<-c.Context.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			shutdown <- server.Shutdown(ctx)
+		}()
+
+		logger.Info("Serving analytics API", slog.String("addr", cfg.APIAddr), slog.Duration("cache_ttl", cfg.APICacheTTL))
+		if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("API server failed", slog.String("error", err.Error()))
+			return err
+		}
+		if err := <-shutdown; err != nil {
+			return err
+		}
+		logger.Info("API server stopped")
+		return nil
+	}
+}
+
+func runsListAction(logger *slog.Logger) cli.ActionFunc {
+	return func(c *cli.Context) error {
+		cfg, err := loadConfig(c)
+		if err != nil {
+			return err
+		}
+		store, closeStore, err := chaindataagg.OpenRunStore(c.Context, cfg)
+		if err != nil {
+			logger.Error("Failed to open run store", slog.String("error", err.Error()))
+			return err
+		}
+		defer closeStore()
+
+		runs, err := store.List(c.Context, c.Int("limit"))
+		if err != nil {
+			logger.Error("Failed to list runs", slog.String("error", err.Error()))
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tCOMMAND\tSTATUS\tSTARTED\tDURATION\tERROR")
+		for _, run := range runs {
+			duration := "-"
+			if run.EndedAt != nil {
+				duration = run.EndedAt.Sub(run.StartedAt).Round(time.Millisecond).String()
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", run.ID, run.Command, run.Status, run.StartedAt.Format(time.RFC3339), duration, run.Error)
+		}
+		return w.Flush()
+	}
+}
+
+func runsShowAction(logger *slog.Logger) cli.ActionFunc {
+	return func(c *cli.Context) error {
+		if c.NArg() != 1 {
+			return fmt.Errorf("expected a run ID")
+		}
+		cfg, err := loadConfig(c)
+		if err != nil {
+			return err
+		}
+		store, closeStore, err := chaindataagg.OpenRunStore(c.Context, cfg)
+		if err != nil {
+			logger.Error("Failed to open run store", slog.String("error", err.Error()))
+			return err
+		}
+		defer closeStore()
+
+		run, err := store.Get(c.Context, c.Args().First())
+		if err != nil {
+			logger.Error("Failed to read run", slog.String("error", err.Error()))
+			return err
+		}
+		content, err := json.MarshalIndent(run, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(content))
+		return nil
+	}
+}
+
+func lineageAction(logger *slog.Logger) cli.ActionFunc {
+	return func(c *cli.Context) error {
+		cfg, err := loadConfig(c, (*chaindataagg.Config).RequireClickHouse)
+		if err != nil {
+			return err
+		}
+		sourceLocation, err := time.LoadLocation(cfg.SourceTimezone)
+		if err != nil {
+			return fmt.Errorf("invalid source timezone: %w", err)
+		}
+		dayLocation, err := time.LoadLocation(cfg.DayTimezone)
+		if err != nil {
+			return fmt.Errorf("invalid day timezone: %w", err)
+		}
+
+		options, err := cfg.ClickHouseOptions()
+		if err != nil {
+			return err
+		}
+		conn, err := chaindataagg.Connect(c.Context, options)
+		if err != nil {
+			logger.Error("Failed to connect to ClickHouse", slog.String("error", err.Error()))
+			return err
+		}
+		defer conn.Close()
+
+		traces, err := chaindataagg.TraceLineage(c.Context, chaindataagg.NewClickHouseLineageStore(conn), c.String("date"), c.String("project-id"), chaindataagg.TraceOptions{
+			Workers:        cfg.WorkersNum,
+			SourceLocation: sourceLocation,
+			DayLocation:    dayLocation,
+		})
+		if err != nil {
+			logger.Error("Failed to trace lineage", slog.String("error", err.Error()))
+			return err
+		}
+		for _, trace := range traces {
+			transactions := 0
+			for _, row := range trace.Rows {
+				transactions += row.Transactions
+			}
+			if trace.Lineage.SourceURI != "" && len(trace.Transactions) != transactions {
+				logger.Warn("Source transactions do not match the loaded rows",
+					slog.String("run_id", trace.Lineage.RunID),
+					slog.Int("loaded", transactions),
+					slog.Int("source", len(trace.Transactions)),
+				)
+			}
+		}
+
+		content, err := json.MarshalIndent(traces, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(content))
+		return nil
+	}
+}
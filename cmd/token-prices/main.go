@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"log/slog"
@@ -19,6 +21,34 @@ func main() {
 	app := &cli.App{
 		Name:  "token-prices",
 		Usage: "Fetch and calculate daily average token prices",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "config",
+				Aliases: []string{"c"},
+				Usage:   "Path to the YAML config file",
+				EnvVars: []string{"CONFIG_FILE"},
+			},
+			&cli.StringFlag{
+				Name:  "log-level",
+				Usage: "Log level: debug, info, warn or error (default: info)",
+			},
+			&cli.StringFlag{
+				Name:  "log-format",
+				Usage: "Log format: text or json (default: text)",
+			},
+			&cli.StringFlag{
+				Name:  "metrics-addr",
+				Usage: "Address to serve Prometheus metrics on at /metrics (e.g. :9090)",
+			},
+			&cli.StringFlag{
+				Name:  "metrics-push-url",
+				Usage: "Pushgateway URL to push metrics to when the command finishes",
+			},
+			&cli.StringFlag{
+				Name:  "trace-exporter",
+				Usage: "Trace exporter: none, stdout or otlp (default: none)",
+			},
+		},
 		Commands: []*cli.Command{
 			{
 				Name:   "run",
@@ -30,25 +60,46 @@ func main() {
 						Usage: "Path to save token price data",
 					},
 					&cli.StringSliceFlag{
-						Name:     "tokens",
-						Usage:    "Comma-separated list of tokens to process",
-						Required: true,
+						Name:  "tokens",
+						Usage: "Comma-separated list of tokens to process (default: tokens from the config)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "currencies",
+						Usage: "Comma-separated list of quote currencies, USD is always included",
+					},
+					&cli.StringFlag{
+						Name:  "timezone",
+						Usage: "Time zone defining the day of the prices, must match the aggregation day time zone (default: UTC)",
+					},
+					&cli.StringFlag{
+						Name:  "price-mapping",
+						Usage: "Path to price mapping rules (JSON) for pegged and wrapped tokens",
+					},
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "Fetch and calculate prices, skip the upload and print a summary",
 					},
 				},
 			},
 		},
 	}
 
-	// Run the app.
-	if err := app.Run(os.Args); err != nil {
+	// Run the app, canceling it on SIGINT or SIGTERM.
+	ctx := chaindataagg.SignalContext()
+	if err := app.RunContext(ctx, os.Args); err != nil {
+		if ctx.Err() != nil {
+			log.Printf("Interrupted: %v", err)
+			os.Exit(chaindataagg.ExitInterrupted)
+		}
 		log.Fatal(err)
 	}
 }
 
 func runTokenPricesCommand(logger *slog.Logger) cli.ActionFunc {
-	return func(c *cli.Context) error {
+	return func(c *cli.Context) (err error) {
 		// Load configuration.
-		cfg, err := chaindataagg.LoadConfig()
+		// Layered as defaults < config file < environment < flags.
+		cfg, err := chaindataagg.LoadConfigFile(c.String("config"))
 		if err != nil {
 			logger.Error("Failed to load configuration", slog.String("error", err.Error()))
 			return err
@@ -56,19 +107,98 @@ func runTokenPricesCommand(logger *slog.Logger) cli.ActionFunc {
 
 		bucketName := cfg.GCPBucketName
 
+		if c.IsSet("tokens") {
+			cfg.Tokens = c.StringSlice("tokens")
+		}
+		if c.IsSet("currencies") {
+			cfg.Currencies = c.StringSlice("currencies")
+		}
+		if c.IsSet("timezone") {
+			cfg.DayTimezone = c.String("timezone")
+		}
+		if c.IsSet("price-mapping") {
+			cfg.PriceMappingPath = c.String("price-mapping")
+		}
+		if c.IsSet("log-level") {
+			cfg.LogLevel = c.String("log-level")
+		}
+		if c.IsSet("log-format") {
+			cfg.LogFormat = c.String("log-format")
+		}
+		if c.IsSet("metrics-addr") {
+			cfg.MetricsAddr = c.String("metrics-addr")
+		}
+		if c.IsSet("metrics-push-url") {
+			cfg.MetricsPushURL = c.String("metrics-push-url")
+		}
+		if c.IsSet("trace-exporter") {
+			cfg.TraceExporter = c.String("trace-exporter")
+		}
+		errs := []error{cfg.Validate(), cfg.RequireBucket(), cfg.RequirePriceProvider()}
+		if cfg.RunStoreLocation() == chaindataagg.RunStoreClickHouse {
+			errs = append(errs, cfg.RequireClickHouse())
+		}
+		if err := errors.Join(errs...); err != nil {
+			logger.Error("Invalid configuration", slog.String("error", err.Error()))
+			return err
+		}
+		if err := chaindataagg.ConfigureLogging(cfg.LogLevel, cfg.LogFormat); err != nil {
+			return err
+		}
+
+		// Metrics are pushed when the run finishes, whether it fails or not.
+		stopMetrics, err := chaindataagg.StartMetrics(cfg, "token-prices", c.Command.FullName())
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := stopMetrics(); err != nil {
+				logger.Error("Failed to stop metrics", slog.String("error", err.Error()))
+			}
+		}()
+
+		// The steps of the run are traced under a root span.
+		ctx, stopTracing, err := chaindataagg.StartTracing(c.Context, cfg, "token-prices", c.Command.FullName())
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := stopTracing(); err != nil {
+				logger.Error("Failed to flush traces", slog.String("error", err.Error()))
+			}
+		}()
+
+		// The run is recorded with its result, even if it is interrupted.
+		// Failing to record it does not fail the run.
+		run := recordRun(c, cfg, logger)
+		defer run.finish(&err)
+
 		//Ensure the token list is provided.
-		if !c.IsSet("tokens") {
+		if len(cfg.Tokens) == 0 {
 			logger.Error("Token list must be provided")
 			return fmt.Errorf("token list is required")
 		}
-		tokens := c.StringSlice("tokens")
+		tokens := cfg.Tokens
 		logger.Info("Using provided token list", slog.Any("tokens", tokens))
 
-		tokenList, err := chaindataagg.FetchTokenList(cfg.CoinGeckoBaseURL, tokens)
+		// Pegged tokens are not looked up and wrapped tokens are priced as their underlying tokens.
+		var mapping *chaindataagg.PriceMapping
+		if path := cfg.PriceMappingPath; path != "" {
+			mapping, err = chaindataagg.ReadPriceMapping(path)
+			if err != nil {
+				logger.Error("Failed to load price mapping", slog.String("error", err.Error()))
+				return err
+			}
+		}
+		providerTokens := mapping.ProviderSymbols(tokens)
+		logger.Info("Looking up tokens with the price provider", slog.Any("tokens", providerTokens))
+
+		tokenList, err := chaindataagg.FetchTokenList(ctx, cfg.CoinGeckoBaseURL, providerTokens)
 		if err != nil {
-			return fmt.Errorf("token list is required")
+			logger.Error("Failed to fetch token list", slog.String("error", err.Error()))
+			return fmt.Errorf("failed to fetch token list: %w", err)
 		}
-		fmt.Println(tokenList)
+		logger.Debug("Token list", slog.Any("tokens", tokenList))
 
 		// Ensure tokens are available.
 		if len(tokens) == 0 {
@@ -77,7 +207,11 @@ func runTokenPricesCommand(logger *slog.Logger) cli.ActionFunc {
 		}
 
 		// Calculate the date for the current run.
-		today := time.Now().Format(chaindataagg.DateFormat)
+		loc, err := time.LoadLocation(cfg.DayTimezone)
+		if err != nil {
+			return fmt.Errorf("invalid timezone: %w", err)
+		}
+		today := time.Now().In(loc).Format(chaindataagg.DateFormat)
 		output := c.String("output")
 		if output == "" {
 			output = "prices/daily-token-prices-" + today + ".json"
@@ -86,11 +220,15 @@ func runTokenPricesCommand(logger *slog.Logger) cli.ActionFunc {
 		logger.Info("Calculating prices for tokens", slog.Int("token_count", len(tokens)))
 
 		// Fetch daily token prices.
-		prices, err := chaindataagg.CalculateDailyPrices(cfg.CoinGeckoBaseURL, cfg.CoinGeckoAPIKey, tokenList)
+		prices, err := chaindataagg.CalculateDailyPrices(ctx, cfg.CoinGeckoBaseURL, cfg.CoinGeckoAPIKey, tokenList, cfg.Currencies)
 		if err != nil {
 			logger.Error("Failed to calculate token prices", slog.String("error", err.Error()))
 			return err
 		}
+		mapping.Apply(prices, tokens)
+		prices.Date = today
+		prices.Timezone = loc.String()
+		run.AddStage(chaindataagg.StageResult{Name: "prices", RowsIn: len(tokens), RowsOut: len(prices.Rates)})
 
 		// Serialize prices to JSON.
 		serializedData, err := json.Marshal(prices)
@@ -99,15 +237,25 @@ func runTokenPricesCommand(logger *slog.Logger) cli.ActionFunc {
 			return err
 		}
 
+		if c.Bool("dry-run") {
+			return chaindataagg.DryRunSummary{
+				Command:       "token-prices run",
+				RowsParsed:    len(tokens),
+				SymbolsPriced: len(prices.Rates),
+				Uploads:       map[string]int{output: len(serializedData)},
+			}.Print(os.Stdout)
+		}
+
 		// Upload the data to GCP.
 		logger.Info("Uploading extracted data to GCP",
 			slog.String("bucket", bucketName),
 			slog.String("output", output),
 		)
-		if err := chaindataagg.UploadToBucket(bucketName, output, serializedData); err != nil {
+		if err := chaindataagg.UploadToBucket(ctx, bucketName, output, serializedData); err != nil {
 			logger.Error("Failed to upload extracted data", slog.String("error", err.Error()))
 			return err
 		}
+		run.AddArtifact("output", "gs://"+bucketName+"/"+output, serializedData)
 
 		logger.Info("Token prices saved successfully",
 			slog.String("bucket", bucketName),
@@ -116,3 +264,64 @@ func runTokenPricesCommand(logger *slog.Logger) cli.ActionFunc {
 		return nil
 	}
 }
+
+// recordedRun is the record of a run, the store it is kept in and the
+// notifiers of its failure.
+type recordedRun struct {
+	*chaindataagg.Run
+	// store is nil if the run is not recorded.
+	store     chaindataagg.RunStore
+	close     func() error
+	notifiers chaindataagg.Notifiers
+	logger    *slog.Logger
+}
+
+// recordRun starts the record of the command run. Failing to record the run
+// does not fail it.
+func recordRun(c *cli.Context, cfg *chaindataagg.Config, logger *slog.Logger) *recordedRun {
+	run := &recordedRun{
+		Run:       chaindataagg.NewRun("token-prices " + c.Command.FullName()),
+		notifiers: chaindataagg.NewNotifiers(cfg),
+		logger:    logger,
+	}
+	// Dry runs write nothing, not even their run record.
+	if c.Bool("dry-run") {
+		logger.Info("Run started, not recorded in a dry run", slog.String("run_id", run.ID))
+		return run
+	}
+	logger.Info("Run started", slog.String("run_id", run.ID), slog.String("store", cfg.RunStoreLocation()))
+
+	store, closeStore, err := chaindataagg.OpenRunStore(c.Context, cfg)
+	if err != nil {
+		logger.Warn("Failed to open run store, the run is not recorded", slog.String("error", err.Error()))
+		return run
+	}
+	if err := store.Save(c.Context, run.Run); err != nil {
+		closeStore()
+		logger.Warn("Failed to record run", slog.String("error", err.Error()))
+		return run
+	}
+	run.store, run.close = store, closeStore
+	return run
+}
+
+// finish records the result of the run and notifies its failure.
+func (r *recordedRun) finish(errp *error) {
+	r.Finish(*errp)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := *errp; err != nil && !errors.Is(err, context.Canceled) && len(r.notifiers) > 0 {
+		notification := chaindataagg.NewNotification(r.Run, chaindataagg.NotifyStageFailed, r.Command+" failed: "+err.Error(), nil)
+		if err := r.notifiers.Notify(ctx, notification); err != nil {
+			r.logger.Warn("Failed to send notification", slog.String("error", err.Error()))
+		}
+	}
+	if r.store == nil {
+		return
+	}
+	defer r.close()
+	if err := r.store.Save(ctx, r.Run); err != nil {
+		r.logger.Warn("Failed to record run", slog.String("error", err.Error()))
+	}
+}
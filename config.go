@@ -1,53 +1,486 @@
 package chaindataagg
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
 	LogLevel           string
+	LogFormat          string
 	ClickHouseHost     string
 	ClickHousePort     string
 	ClickHouseUser     string
 	ClickHousePassword string
-	SampleDataPath     string
-	GCPBucketName      string
-	GoogleCredentials  string
-	CoinGeckoAPIKey    string
-	CoinGeckoBaseURL   string
-	WorkersNum         int
+	ClickHouseDatabase string
+	// ClickHouseTLS enables TLS, the server certificate is verified unless
+	// ClickHouseInsecureSkipVerify is set.
+	ClickHouseTLS                bool
+	ClickHouseInsecureSkipVerify bool
+	ClickHouseCAFile             string
+	ClickHouseCertFile           string
+	ClickHouseKeyFile            string
+	ClickHouseCompression        string
+	ClickHouseDialTimeout        time.Duration
+	ClickHouseReadTimeout        time.Duration
+	ClickHouseMaxRetries         int
+	ClickHouseRetryBackoff       time.Duration
+	ClickHouseRetryMaxBackoff    time.Duration
+	ClickHouseBatchSize          int
+	PostgresDSN                  string
+	SQLitePath                   string
+	SampleDataPath               string
+	GCPBucketName                string
+	GoogleCredentials            string
+	CoinGeckoAPIKey              string
+	CoinGeckoBaseURL             string
+	WorkersNum                   int
+	MissingRatePolicy            string
+	RateCheckMode                string
+	MaxRateAge                   time.Duration
+	MaxRateDeviation             float64
+	PriceMappingPath             string
+	Currencies                   []string
+	SourceTimezone               string
+	DayTimezone                  string
+	Tokens                       []string
+	MetricsAddr                  string
+	MetricsPushURL               string
+	TraceExporter                string
+	TraceEndpoint                string
+	APIAddr                      string
+	APICacheTTL                  time.Duration
+	RunsStore                    string
+	NotifyWebhookURL             string
+	NotifySlackWebhookURL        string
+	NotifySMTPAddr               string
+	NotifySMTPUsername           string
+	NotifySMTPPassword           string
+	NotifyEmailFrom              string
+	NotifyEmailTo                []string
+	// NotifyErrorRate is the share of rejected rows above which a stage
+	// notifies.
+	NotifyErrorRate float64
+	AnomalyMethod   string
+	// AnomalyHistory are the transformed data files, or "warehouse", the
+	// volumes are compared against.
+	AnomalyHistory    []string
+	AnomalyThreshold  float64
+	AnomalyWindow     int
+	AnomalyMinHistory int
+	AnomalyMode       string
+	// Expectations is the expectations file checked against extracted
+	// transactions, "default" for the built-in expectations; empty disables
+	// the checks.
+	Expectations string
+	// TokenDecimalsPath is the table of currency decimals raw values are
+	// checked with, in addition to the built-in one.
+	TokenDecimalsPath string
+	// WashTradeDetection tags suspicious trades in transform.
+	WashTradeDetection bool
+	WashTradeWindow    time.Duration
+	WashTradeMinTrades int
+	WashTradeMaxUsers  int
 }
 
+// DefaultConfig returns the configuration used when neither the config file
+// nor the environment set a value.
+func DefaultConfig() *Config {
+	return &Config{
+		LogLevel:                  "INFO",
+		LogFormat:                 LogFormatText,
+		ClickHousePort:            "9440",
+		ClickHouseDatabase:        "analytics",
+		ClickHouseTLS:             true,
+		ClickHouseCompression:     "lz4",
+		ClickHouseDialTimeout:     30 * time.Second,
+		ClickHouseReadTimeout:     5 * time.Minute,
+		ClickHouseMaxRetries:      4,
+		ClickHouseRetryBackoff:    time.Second,
+		ClickHouseRetryMaxBackoff: 30 * time.Second,
+		ClickHouseBatchSize:       DefaultBatchSize,
+		SQLitePath:                "analytics.db",
+		SampleDataPath:            "sample_data/sample_data.csv",
+		CoinGeckoBaseURL:          "https://api.coingecko.com/api/v3",
+		WorkersNum:                10,
+		MissingRatePolicy:         string(MissingRateFail),
+		RateCheckMode:             string(RateCheckFail),
+		SourceTimezone:            "UTC",
+		DayTimezone:               "UTC",
+		APIAddr:                   ":8080",
+		APICacheTTL:               time.Minute,
+		NotifyErrorRate:           0.01,
+		AnomalyMethod:             string(AnomalyNone),
+		AnomalyThreshold:          5,
+		AnomalyWindow:             28,
+		AnomalyMinHistory:         7,
+		AnomalyMode:               string(AnomalyWarn),
+		Expectations:              ExpectationsDefault,
+		WashTradeWindow:           time.Hour,
+		WashTradeMinTrades:        3,
+		WashTradeMaxUsers:         2,
+	}
+}
+
+// LoadConfig loads the configuration from the environment.
 func LoadConfig() (*Config, error) {
+	return LoadConfigFile("")
+}
+
+// LoadConfigFile loads the configuration, layered as defaults < config file
+// < environment. The config file is optional and skipped if path is empty.
+func LoadConfigFile(path string) (*Config, error) {
 	if os.Getenv("ENV") != "production" {
-		if err := godotenv.Load(); err != nil {
+		// The .env file is optional.
+		if err := godotenv.Load(); err != nil && !errors.Is(err, fs.ErrNotExist) {
 			return nil, fmt.Errorf("error loading .env file: %w", err)
 		}
 	}
 
-	workersNum, err := strconv.Atoi(getEnv("WORKERS_NUM", "10"))
+	cfg := DefaultConfig()
+	if path != "" {
+		if err := cfg.readFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	workersNum, err := strconv.Atoi(getEnv("WORKERS_NUM", strconv.Itoa(cfg.WorkersNum)))
 	if err != nil {
 		return nil, fmt.Errorf("error extracting workers number: %w", err)
 	}
 
-	// Map required environment variables to configuration struct.
-	return &Config{
-		ClickHouseHost:     os.Getenv("CLICKHOUSE_HOST"),
-		ClickHousePort:     os.Getenv("CLICKHOUSE_PORT"),
-		ClickHouseUser:     os.Getenv("CLICKHOUSE_USER"),
-		ClickHousePassword: os.Getenv("CLICKHOUSE_PASSWORD"),
-		LogLevel:           getEnv("LOG_LEVEL", "INFO"),
-		SampleDataPath:     getEnv("SAMPLE_DATA_PATH", "sample_data/sample_data.csv"),
-		GCPBucketName:      os.Getenv("GCP_BUCKET_NAME"),
-		GoogleCredentials:  os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"),
-		CoinGeckoAPIKey:    os.Getenv("COINGECKO_API_KEY"),
-		CoinGeckoBaseURL:   getEnv("COINGECKO_BASE_URL", "https://api.coingecko.com/api/v3"),
-		WorkersNum:         workersNum,
-	}, nil
+	clickHouseTLS, err := strconv.ParseBool(getEnv("CLICKHOUSE_TLS", strconv.FormatBool(cfg.ClickHouseTLS)))
+	if err != nil {
+		return nil, fmt.Errorf("error extracting ClickHouse TLS flag: %w", err)
+	}
+	clickHouseInsecureSkipVerify, err := strconv.ParseBool(getEnv("CLICKHOUSE_INSECURE_SKIP_VERIFY", strconv.FormatBool(cfg.ClickHouseInsecureSkipVerify)))
+	if err != nil {
+		return nil, fmt.Errorf("error extracting ClickHouse insecure skip verify flag: %w", err)
+	}
+	clickHouseDialTimeout, err := time.ParseDuration(getEnv("CLICKHOUSE_DIAL_TIMEOUT", cfg.ClickHouseDialTimeout.String()))
+	if err != nil {
+		return nil, fmt.Errorf("error extracting ClickHouse dial timeout: %w", err)
+	}
+	clickHouseReadTimeout, err := time.ParseDuration(getEnv("CLICKHOUSE_READ_TIMEOUT", cfg.ClickHouseReadTimeout.String()))
+	if err != nil {
+		return nil, fmt.Errorf("error extracting ClickHouse read timeout: %w", err)
+	}
+
+	clickHouseMaxRetries, err := strconv.Atoi(getEnv("CLICKHOUSE_MAX_RETRIES", strconv.Itoa(cfg.ClickHouseMaxRetries)))
+	if err != nil {
+		return nil, fmt.Errorf("error extracting ClickHouse max retries: %w", err)
+	}
+	clickHouseRetryBackoff, err := time.ParseDuration(getEnv("CLICKHOUSE_RETRY_BACKOFF", cfg.ClickHouseRetryBackoff.String()))
+	if err != nil {
+		return nil, fmt.Errorf("error extracting ClickHouse retry backoff: %w", err)
+	}
+	clickHouseRetryMaxBackoff, err := time.ParseDuration(getEnv("CLICKHOUSE_RETRY_MAX_BACKOFF", cfg.ClickHouseRetryMaxBackoff.String()))
+	if err != nil {
+		return nil, fmt.Errorf("error extracting ClickHouse retry max backoff: %w", err)
+	}
+	clickHouseBatchSize, err := strconv.Atoi(getEnv("CLICKHOUSE_BATCH_SIZE", strconv.Itoa(cfg.ClickHouseBatchSize)))
+	if err != nil {
+		return nil, fmt.Errorf("error extracting ClickHouse batch size: %w", err)
+	}
+
+	maxRateAge, err := time.ParseDuration(getEnv("MAX_RATE_AGE", cfg.MaxRateAge.String()))
+	if err != nil {
+		return nil, fmt.Errorf("error extracting max rate age: %w", err)
+	}
+	maxRateDeviation, err := strconv.ParseFloat(getEnv("MAX_RATE_DEVIATION", strconv.FormatFloat(cfg.MaxRateDeviation, 'f', -1, 64)), 64)
+	if err != nil {
+		return nil, fmt.Errorf("error extracting max rate deviation: %w", err)
+	}
+	apiCacheTTL, err := time.ParseDuration(getEnv("API_CACHE_TTL", cfg.APICacheTTL.String()))
+	if err != nil {
+		return nil, fmt.Errorf("error extracting API cache TTL: %w", err)
+	}
+	notifyErrorRate, err := strconv.ParseFloat(getEnv("NOTIFY_ERROR_RATE", strconv.FormatFloat(cfg.NotifyErrorRate, 'f', -1, 64)), 64)
+	if err != nil {
+		return nil, fmt.Errorf("error extracting notification error rate: %w", err)
+	}
+	anomalyThreshold, err := strconv.ParseFloat(getEnv("ANOMALY_THRESHOLD", strconv.FormatFloat(cfg.AnomalyThreshold, 'f', -1, 64)), 64)
+	if err != nil {
+		return nil, fmt.Errorf("error extracting anomaly threshold: %w", err)
+	}
+	anomalyWindow, err := strconv.Atoi(getEnv("ANOMALY_WINDOW", strconv.Itoa(cfg.AnomalyWindow)))
+	if err != nil {
+		return nil, fmt.Errorf("error extracting anomaly window: %w", err)
+	}
+	anomalyMinHistory, err := strconv.Atoi(getEnv("ANOMALY_MIN_HISTORY", strconv.Itoa(cfg.AnomalyMinHistory)))
+	if err != nil {
+		return nil, fmt.Errorf("error extracting anomaly min history: %w", err)
+	}
+	washTradeDetection, err := strconv.ParseBool(getEnv("WASH_TRADE_DETECTION", strconv.FormatBool(cfg.WashTradeDetection)))
+	if err != nil {
+		return nil, fmt.Errorf("error extracting wash-trade detection: %w", err)
+	}
+	washTradeWindow, err := time.ParseDuration(getEnv("WASH_TRADE_WINDOW", cfg.WashTradeWindow.String()))
+	if err != nil {
+		return nil, fmt.Errorf("error extracting wash-trade window: %w", err)
+	}
+	washTradeMinTrades, err := strconv.Atoi(getEnv("WASH_TRADE_MIN_TRADES", strconv.Itoa(cfg.WashTradeMinTrades)))
+	if err != nil {
+		return nil, fmt.Errorf("error extracting wash-trade min trades: %w", err)
+	}
+	washTradeMaxUsers, err := strconv.Atoi(getEnv("WASH_TRADE_MAX_USERS", strconv.Itoa(cfg.WashTradeMaxUsers)))
+	if err != nil {
+		return nil, fmt.Errorf("error extracting wash-trade max users: %w", err)
+	}
+
+	// Environment variables override the config file.
+	cfg.ClickHouseHost = getEnv("CLICKHOUSE_HOST", cfg.ClickHouseHost)
+	cfg.ClickHousePort = getEnv("CLICKHOUSE_PORT", cfg.ClickHousePort)
+	cfg.ClickHouseUser = getEnv("CLICKHOUSE_USER", cfg.ClickHouseUser)
+	cfg.ClickHousePassword = getEnv("CLICKHOUSE_PASSWORD", cfg.ClickHousePassword)
+	cfg.ClickHouseDatabase = getEnv("CLICKHOUSE_DATABASE", cfg.ClickHouseDatabase)
+	cfg.ClickHouseTLS = clickHouseTLS
+	cfg.ClickHouseInsecureSkipVerify = clickHouseInsecureSkipVerify
+	cfg.ClickHouseCAFile = getEnv("CLICKHOUSE_CA_FILE", cfg.ClickHouseCAFile)
+	cfg.ClickHouseCertFile = getEnv("CLICKHOUSE_CERT_FILE", cfg.ClickHouseCertFile)
+	cfg.ClickHouseKeyFile = getEnv("CLICKHOUSE_KEY_FILE", cfg.ClickHouseKeyFile)
+	cfg.ClickHouseCompression = getEnv("CLICKHOUSE_COMPRESSION", cfg.ClickHouseCompression)
+	cfg.ClickHouseDialTimeout = clickHouseDialTimeout
+	cfg.ClickHouseReadTimeout = clickHouseReadTimeout
+	cfg.ClickHouseMaxRetries = clickHouseMaxRetries
+	cfg.ClickHouseRetryBackoff = clickHouseRetryBackoff
+	cfg.ClickHouseRetryMaxBackoff = clickHouseRetryMaxBackoff
+	cfg.ClickHouseBatchSize = clickHouseBatchSize
+	cfg.PostgresDSN = getEnv("POSTGRES_DSN", cfg.PostgresDSN)
+	cfg.SQLitePath = getEnv("SQLITE_PATH", cfg.SQLitePath)
+	cfg.LogLevel = getEnv("LOG_LEVEL", cfg.LogLevel)
+	cfg.LogFormat = getEnv("LOG_FORMAT", cfg.LogFormat)
+	cfg.SampleDataPath = getEnv("SAMPLE_DATA_PATH", cfg.SampleDataPath)
+	cfg.GCPBucketName = getEnv("GCP_BUCKET_NAME", cfg.GCPBucketName)
+	cfg.GoogleCredentials = getEnv("GOOGLE_APPLICATION_CREDENTIALS", cfg.GoogleCredentials)
+	cfg.CoinGeckoAPIKey = getEnv("COINGECKO_API_KEY", cfg.CoinGeckoAPIKey)
+	cfg.CoinGeckoBaseURL = getEnv("COINGECKO_BASE_URL", cfg.CoinGeckoBaseURL)
+	cfg.WorkersNum = workersNum
+	cfg.MissingRatePolicy = getEnv("MISSING_RATE_POLICY", cfg.MissingRatePolicy)
+	cfg.RateCheckMode = getEnv("RATE_CHECK_MODE", cfg.RateCheckMode)
+	cfg.MaxRateAge = maxRateAge
+	cfg.MaxRateDeviation = maxRateDeviation
+	cfg.PriceMappingPath = getEnv("PRICE_MAPPING", cfg.PriceMappingPath)
+	cfg.Currencies = getEnvList("CURRENCIES", cfg.Currencies)
+	cfg.SourceTimezone = getEnv("SOURCE_TIMEZONE", cfg.SourceTimezone)
+	cfg.DayTimezone = getEnv("DAY_TIMEZONE", cfg.DayTimezone)
+	cfg.Tokens = getEnvList("TOKENS", cfg.Tokens)
+	cfg.MetricsAddr = getEnv("METRICS_ADDR", cfg.MetricsAddr)
+	cfg.MetricsPushURL = getEnv("METRICS_PUSH_URL", cfg.MetricsPushURL)
+	cfg.TraceExporter = getEnv("TRACE_EXPORTER", cfg.TraceExporter)
+	cfg.TraceEndpoint = getEnv("OTEL_EXPORTER_OTLP_ENDPOINT", cfg.TraceEndpoint)
+	cfg.APIAddr = getEnv("API_ADDR", cfg.APIAddr)
+	cfg.APICacheTTL = apiCacheTTL
+	cfg.RunsStore = getEnv("RUNS_STORE", cfg.RunsStore)
+	cfg.NotifyWebhookURL = getEnv("NOTIFY_WEBHOOK_URL", cfg.NotifyWebhookURL)
+	cfg.NotifySlackWebhookURL = getEnv("NOTIFY_SLACK_WEBHOOK_URL", cfg.NotifySlackWebhookURL)
+	cfg.NotifySMTPAddr = getEnv("NOTIFY_SMTP_ADDR", cfg.NotifySMTPAddr)
+	cfg.NotifySMTPUsername = getEnv("NOTIFY_SMTP_USERNAME", cfg.NotifySMTPUsername)
+	cfg.NotifySMTPPassword = getEnv("NOTIFY_SMTP_PASSWORD", cfg.NotifySMTPPassword)
+	cfg.NotifyEmailFrom = getEnv("NOTIFY_EMAIL_FROM", cfg.NotifyEmailFrom)
+	cfg.NotifyEmailTo = getEnvList("NOTIFY_EMAIL_TO", cfg.NotifyEmailTo)
+	cfg.NotifyErrorRate = notifyErrorRate
+	cfg.AnomalyMethod = getEnv("ANOMALY_METHOD", cfg.AnomalyMethod)
+	cfg.AnomalyHistory = getEnvList("ANOMALY_HISTORY", cfg.AnomalyHistory)
+	cfg.AnomalyThreshold = anomalyThreshold
+	cfg.AnomalyWindow = anomalyWindow
+	cfg.AnomalyMinHistory = anomalyMinHistory
+	cfg.AnomalyMode = getEnv("ANOMALY_MODE", cfg.AnomalyMode)
+	cfg.Expectations = getEnv("EXPECTATIONS", cfg.Expectations)
+	cfg.TokenDecimalsPath = getEnv("TOKEN_DECIMALS", cfg.TokenDecimalsPath)
+	cfg.WashTradeDetection = washTradeDetection
+	cfg.WashTradeWindow = washTradeWindow
+	cfg.WashTradeMinTrades = washTradeMinTrades
+	cfg.WashTradeMaxUsers = washTradeMaxUsers
+
+	return cfg, nil
+}
+
+// configFile is the layout of the config file. Its fields point into a
+// Config, so keys missing from the file keep their current values.
+type configFile struct {
+	LogLevel  *string `yaml:"log_level"`
+	LogFormat *string `yaml:"log_format"`
+	Storage   struct {
+		GCPBucketName     *string `yaml:"gcp_bucket_name"`
+		GoogleCredentials *string `yaml:"google_credentials"`
+		SampleDataPath    *string `yaml:"sample_data_path"`
+		PostgresDSN       *string `yaml:"postgres_dsn"`
+		SQLitePath        *string `yaml:"sqlite_path"`
+	} `yaml:"storage"`
+	ClickHouse struct {
+		Host               *string        `yaml:"host"`
+		Port               *string        `yaml:"port"`
+		User               *string        `yaml:"user"`
+		Password           *string        `yaml:"password"`
+		Database           *string        `yaml:"database"`
+		TLS                *bool          `yaml:"tls"`
+		InsecureSkipVerify *bool          `yaml:"insecure_skip_verify"`
+		CAFile             *string        `yaml:"ca_file"`
+		CertFile           *string        `yaml:"cert_file"`
+		KeyFile            *string        `yaml:"key_file"`
+		Compression        *string        `yaml:"compression"`
+		DialTimeout        *time.Duration `yaml:"dial_timeout"`
+		ReadTimeout        *time.Duration `yaml:"read_timeout"`
+		MaxRetries         *int           `yaml:"max_retries"`
+		RetryBackoff       *time.Duration `yaml:"retry_backoff"`
+		RetryMaxBackoff    *time.Duration `yaml:"retry_max_backoff"`
+		BatchSize          *int           `yaml:"batch_size"`
+	} `yaml:"clickhouse"`
+	PriceProvider struct {
+		APIKey  *string `yaml:"api_key"`
+		BaseURL *string `yaml:"base_url"`
+	} `yaml:"price_provider"`
+	Aggregation struct {
+		WorkersNum        *int           `yaml:"workers_num"`
+		MissingRatePolicy *string        `yaml:"missing_rate_policy"`
+		RateCheckMode     *string        `yaml:"rate_check_mode"`
+		MaxRateAge        *time.Duration `yaml:"max_rate_age"`
+		MaxRateDeviation  *float64       `yaml:"max_rate_deviation"`
+		PriceMapping      *string        `yaml:"price_mapping"`
+		Currencies        *[]string      `yaml:"currencies"`
+		SourceTimezone    *string        `yaml:"source_timezone"`
+		DayTimezone       *string        `yaml:"day_timezone"`
+	} `yaml:"aggregation"`
+	Tokens  *[]string `yaml:"tokens"`
+	Metrics struct {
+		ListenAddr *string `yaml:"listen_addr"`
+		PushURL    *string `yaml:"push_url"`
+	} `yaml:"metrics"`
+	Tracing struct {
+		Exporter *string `yaml:"exporter"`
+		Endpoint *string `yaml:"endpoint"`
+	} `yaml:"tracing"`
+	API struct {
+		ListenAddr *string        `yaml:"listen_addr"`
+		CacheTTL   *time.Duration `yaml:"cache_ttl"`
+	} `yaml:"api"`
+	Runs struct {
+		Store *string `yaml:"store"`
+	} `yaml:"runs"`
+	Notifications struct {
+		WebhookURL      *string  `yaml:"webhook_url"`
+		SlackWebhookURL *string  `yaml:"slack_webhook_url"`
+		ErrorRate       *float64 `yaml:"error_rate"`
+		Email           struct {
+			SMTPAddr *string   `yaml:"smtp_addr"`
+			Username *string   `yaml:"username"`
+			Password *string   `yaml:"password"`
+			From     *string   `yaml:"from"`
+			To       *[]string `yaml:"to"`
+		} `yaml:"email"`
+	} `yaml:"notifications"`
+	Anomalies struct {
+		Method     *string   `yaml:"method"`
+		History    *[]string `yaml:"history"`
+		Threshold  *float64  `yaml:"threshold"`
+		WindowDays *int      `yaml:"window_days"`
+		MinHistory *int      `yaml:"min_history"`
+		Mode       *string   `yaml:"mode"`
+	} `yaml:"anomalies"`
+	Quality struct {
+		Expectations  *string `yaml:"expectations"`
+		TokenDecimals *string `yaml:"token_decimals"`
+	} `yaml:"quality"`
+	WashTrades struct {
+		Enabled   *bool          `yaml:"enabled"`
+		Window    *time.Duration `yaml:"window"`
+		MinTrades *int           `yaml:"min_trades"`
+		MaxUsers  *int           `yaml:"max_users"`
+	} `yaml:"wash_trades"`
+}
+
+// readFile overrides the configuration with the YAML config file. Unknown
+// keys are rejected.
+func (c *Config) readFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading config file: %w", err)
+	}
+
+	var file configFile
+	file.LogLevel = &c.LogLevel
+	file.LogFormat = &c.LogFormat
+	file.Storage.GCPBucketName = &c.GCPBucketName
+	file.Storage.GoogleCredentials = &c.GoogleCredentials
+	file.Storage.SampleDataPath = &c.SampleDataPath
+	file.Storage.PostgresDSN = &c.PostgresDSN
+	file.Storage.SQLitePath = &c.SQLitePath
+	file.ClickHouse.Host = &c.ClickHouseHost
+	file.ClickHouse.Port = &c.ClickHousePort
+	file.ClickHouse.User = &c.ClickHouseUser
+	file.ClickHouse.Password = &c.ClickHousePassword
+	file.ClickHouse.Database = &c.ClickHouseDatabase
+	file.ClickHouse.TLS = &c.ClickHouseTLS
+	file.ClickHouse.InsecureSkipVerify = &c.ClickHouseInsecureSkipVerify
+	file.ClickHouse.CAFile = &c.ClickHouseCAFile
+	file.ClickHouse.CertFile = &c.ClickHouseCertFile
+	file.ClickHouse.KeyFile = &c.ClickHouseKeyFile
+	file.ClickHouse.Compression = &c.ClickHouseCompression
+	file.ClickHouse.DialTimeout = &c.ClickHouseDialTimeout
+	file.ClickHouse.ReadTimeout = &c.ClickHouseReadTimeout
+	file.ClickHouse.MaxRetries = &c.ClickHouseMaxRetries
+	file.ClickHouse.RetryBackoff = &c.ClickHouseRetryBackoff
+	file.ClickHouse.RetryMaxBackoff = &c.ClickHouseRetryMaxBackoff
+	file.ClickHouse.BatchSize = &c.ClickHouseBatchSize
+	file.PriceProvider.APIKey = &c.CoinGeckoAPIKey
+	file.PriceProvider.BaseURL = &c.CoinGeckoBaseURL
+	file.Aggregation.WorkersNum = &c.WorkersNum
+	file.Aggregation.MissingRatePolicy = &c.MissingRatePolicy
+	file.Aggregation.RateCheckMode = &c.RateCheckMode
+	file.Aggregation.MaxRateAge = &c.MaxRateAge
+	file.Aggregation.MaxRateDeviation = &c.MaxRateDeviation
+	file.Aggregation.PriceMapping = &c.PriceMappingPath
+	file.Aggregation.Currencies = &c.Currencies
+	file.Aggregation.SourceTimezone = &c.SourceTimezone
+	file.Aggregation.DayTimezone = &c.DayTimezone
+	file.Tokens = &c.Tokens
+	file.Metrics.ListenAddr = &c.MetricsAddr
+	file.Metrics.PushURL = &c.MetricsPushURL
+	file.Tracing.Exporter = &c.TraceExporter
+	file.Tracing.Endpoint = &c.TraceEndpoint
+	file.API.ListenAddr = &c.APIAddr
+	file.API.CacheTTL = &c.APICacheTTL
+	file.Runs.Store = &c.RunsStore
+	file.Notifications.WebhookURL = &c.NotifyWebhookURL
+	file.Notifications.SlackWebhookURL = &c.NotifySlackWebhookURL
+	file.Notifications.ErrorRate = &c.NotifyErrorRate
+	file.Notifications.Email.SMTPAddr = &c.NotifySMTPAddr
+	file.Notifications.Email.Username = &c.NotifySMTPUsername
+	file.Notifications.Email.Password = &c.NotifySMTPPassword
+	file.Notifications.Email.From = &c.NotifyEmailFrom
+	file.Notifications.Email.To = &c.NotifyEmailTo
+	file.Anomalies.Method = &c.AnomalyMethod
+	file.Anomalies.History = &c.AnomalyHistory
+	file.Anomalies.Threshold = &c.AnomalyThreshold
+	file.Anomalies.WindowDays = &c.AnomalyWindow
+	file.Anomalies.MinHistory = &c.AnomalyMinHistory
+	file.Anomalies.Mode = &c.AnomalyMode
+	file.Quality.Expectations = &c.Expectations
+	file.Quality.TokenDecimals = &c.TokenDecimalsPath
+	file.WashTrades.Enabled = &c.WashTradeDetection
+	file.WashTrades.Window = &c.WashTradeWindow
+	file.WashTrades.MinTrades = &c.WashTradeMinTrades
+	file.WashTrades.MaxUsers = &c.WashTradeMaxUsers
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&file); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("error parsing config file %s: %w", path, err)
+	}
+	return nil
 }
 
 // getEnv helper function to get an environment variable or use a fallback value.
@@ -58,43 +491,189 @@ func getEnv(key, fallback string) string {
 	return fallback
 }
 
+// getEnvList gets a comma-separated environment variable or uses a fallback value.
+func getEnvList(key string, fallback []string) []string {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return fallback
+	}
+
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// Validate checks the configured values. The settings a command needs are
+// checked by RequireClickHouse, RequireBucket and RequirePriceProvider.
 func (c *Config) Validate() error {
-	missing := []string{}
+	var errs []error
 
-	// Check required fields.
-	if c.ClickHouseHost == "" {
-		missing = append(missing, "CLICKHOUSE_HOST")
+	// Check values, section by section.
+	if _, err := ParseLevel(c.LogLevel); err != nil {
+		errs = append(errs, fmt.Errorf("invalid log level: %w", err))
 	}
-	if c.ClickHousePort == "" {
-		missing = append(missing, "CLICKHOUSE_PORT")
+	switch strings.ToLower(c.LogFormat) {
+	case "", LogFormatText, LogFormatJSON:
+	default:
+		errs = append(errs, fmt.Errorf("unknown log format: %s", c.LogFormat))
 	}
-	if c.ClickHouseUser == "" {
-		missing = append(missing, "CLICKHOUSE_USER")
+
+	switch strings.ToLower(c.ClickHouseCompression) {
+	case "", "none", "lz4", "zstd":
+	default:
+		errs = append(errs, fmt.Errorf("unknown ClickHouse compression: %s", c.ClickHouseCompression))
 	}
-	if c.ClickHousePassword == "" {
-		missing = append(missing, "CLICKHOUSE_PASSWORD")
+	if c.ClickHouseDialTimeout < 0 || c.ClickHouseReadTimeout < 0 {
+		errs = append(errs, errors.New("ClickHouse timeouts must not be negative"))
 	}
-	if c.SampleDataPath == "" {
-		missing = append(missing, "SAMPLE_DATA_PATH")
+	if c.ClickHouseMaxRetries < 0 {
+		errs = append(errs, errors.New("ClickHouse max retries must not be negative"))
 	}
-	if c.GCPBucketName == "" {
-		missing = append(missing, "GCP_BUCKET_NAME")
+	if c.ClickHouseRetryBackoff < 0 || c.ClickHouseRetryMaxBackoff < c.ClickHouseRetryBackoff {
+		errs = append(errs, errors.New("ClickHouse retry backoff must not be negative or exceed the max backoff"))
 	}
-	if c.GoogleCredentials == "" {
-		missing = append(missing, "GOOGLE_APPLICATION_CREDENTIALS")
+	if c.ClickHouseBatchSize <= 0 {
+		errs = append(errs, errors.New("ClickHouse batch size must be positive"))
 	}
-	if c.CoinGeckoAPIKey == "" {
-		missing = append(missing, "COINGECKO_API_KEY")
+
+	if c.CoinGeckoBaseURL != "" {
+		if _, err := url.ParseRequestURI(c.CoinGeckoBaseURL); err != nil {
+			errs = append(errs, fmt.Errorf("invalid price provider base URL: %w", err))
+		}
 	}
-	if c.CoinGeckoBaseURL == "" {
-		missing = append(missing, "COINGECKO_BASE_URL")
+
+	if c.WorkersNum <= 0 {
+		errs = append(errs, errors.New("workers number must be positive"))
+	}
+	if _, err := ParseMissingRatePolicy(c.MissingRatePolicy); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := ParseRateCheckMode(c.RateCheckMode); err != nil {
+		errs = append(errs, err)
+	}
+	if c.MaxRateAge < 0 || c.MaxRateDeviation < 0 {
+		errs = append(errs, errors.New("rate checks must not be negative"))
+	}
+	if c.PriceMappingPath != "" {
+		if _, err := ReadPriceMapping(c.PriceMappingPath); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if c.WashTradeWindow <= 0 || c.WashTradeMinTrades < 2 || c.WashTradeMaxUsers < 2 {
+		errs = append(errs, errors.New("wash-trade window must be positive and min trades and max users at least 2"))
+	}
+	if c.TokenDecimalsPath != "" {
+		if _, err := ReadTokenDecimals(c.TokenDecimalsPath); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, tz := range []string{c.SourceTimezone, c.DayTimezone} {
+		if _, err := time.LoadLocation(tz); err != nil {
+			errs = append(errs, fmt.Errorf("invalid timezone: %w", err))
+		}
 	}
 
-	if len(missing) > 0 {
-		return fmt.Errorf("missing required environment variables: %v", missing)
+	if c.MetricsPushURL != "" {
+		if _, err := url.ParseRequestURI(c.MetricsPushURL); err != nil {
+			errs = append(errs, fmt.Errorf("invalid metrics push URL: %w", err))
+		}
 	}
 
-	return nil
+	if c.APICacheTTL < 0 {
+		errs = append(errs, errors.New("API cache TTL must not be negative"))
+	}
+
+	switch strings.ToLower(c.TraceExporter) {
+	case "", TraceExporterNone, TraceExporterStdout, TraceExporterOTLP:
+	default:
+		errs = append(errs, fmt.Errorf("unknown trace exporter: %s", c.TraceExporter))
+	}
+	if c.TraceEndpoint != "" {
+		if _, err := parseOTLPEndpoint(c.TraceEndpoint); err != nil {
+			errs = append(errs, fmt.Errorf("invalid trace endpoint: %w", err))
+		}
+	}
+
+	for _, webhookURL := range []string{c.NotifyWebhookURL, c.NotifySlackWebhookURL} {
+		if webhookURL == "" {
+			continue
+		}
+		if _, err := url.ParseRequestURI(webhookURL); err != nil {
+			errs = append(errs, fmt.Errorf("invalid notification webhook URL: %w", err))
+		}
+	}
+	if c.NotifySMTPAddr != "" && (c.NotifyEmailFrom == "" || len(c.NotifyEmailTo) == 0) {
+		errs = append(errs, errors.New("notification emails need a sender and recipients"))
+	}
+	if c.NotifyErrorRate < 0 || c.NotifyErrorRate > 1 {
+		errs = append(errs, errors.New("notification error rate must be between 0 and 1"))
+	}
+
+	if _, err := ParseAnomalyMethod(c.AnomalyMethod); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := ParseAnomalyMode(c.AnomalyMode); err != nil {
+		errs = append(errs, err)
+	}
+	if c.AnomalyThreshold <= 0 || c.AnomalyWindow <= 0 || c.AnomalyMinHistory <= 0 {
+		errs = append(errs, errors.New("anomaly threshold, window and min history must be positive"))
+	}
+
+	for _, token := range c.Tokens {
+		if strings.TrimSpace(token) == "" {
+			errs = append(errs, errors.New("tokens must not be empty"))
+			break
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// RequireClickHouse checks the settings needed to connect to ClickHouse.
+func (c *Config) RequireClickHouse() error {
+	return requireSettings(map[string]string{
+		"CLICKHOUSE_HOST":     c.ClickHouseHost,
+		"CLICKHOUSE_PORT":     c.ClickHousePort,
+		"CLICKHOUSE_USER":     c.ClickHouseUser,
+		"CLICKHOUSE_PASSWORD": c.ClickHousePassword,
+		"CLICKHOUSE_DATABASE": c.ClickHouseDatabase,
+	})
+}
+
+// RequireBucket checks the settings needed to read and write the GCP bucket.
+func (c *Config) RequireBucket() error {
+	return requireSettings(map[string]string{
+		"GCP_BUCKET_NAME":                c.GCPBucketName,
+		"GOOGLE_APPLICATION_CREDENTIALS": c.GoogleCredentials,
+	})
+}
+
+// RequirePriceProvider checks the settings needed to fetch prices. The API
+// key is optional: the public API is used without it.
+func (c *Config) RequirePriceProvider() error {
+	return requireSettings(map[string]string{
+		"COINGECKO_BASE_URL": c.CoinGeckoBaseURL,
+	})
+}
+
+// requireSettings reports the settings, by environment variable, that are
+// empty.
+func requireSettings(settings map[string]string) error {
+	missing := []string{}
+	for name, value := range settings {
+		if value == "" {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	sort.Strings(missing)
+	return fmt.Errorf("missing required environment variables: %v", missing)
 }
 
 func (c *Config) PrintExportedVars() {
@@ -1,9 +1,15 @@
 package chaindataagg_test
 
 import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/ClickHouse/clickhouse-go/v2"
 	chaindataagg "github.com/atkachyshyn/chain-data-agg"
 	"github.com/stretchr/testify/require"
 )
@@ -20,12 +26,151 @@ func TestLoadConfig(t *testing.T) {
 }
 
 func TestValidateConfig(t *testing.T) {
+	config := chaindataagg.DefaultConfig()
+	require.NoError(t, config.Validate())
+	require.NoError(t, config.RequirePriceProvider())
+	require.Equal(t, "9440", config.ClickHousePort)
+
+	err := config.RequireClickHouse()
+	require.ErrorContains(t, err, "missing required environment variables")
+	require.ErrorContains(t, err, "CLICKHOUSE_HOST")
+	require.NotContains(t, err.Error(), "CLICKHOUSE_PORT")
+
+	err = config.RequireBucket()
+	require.ErrorContains(t, err, "GCP_BUCKET_NAME")
+
+	config.ClickHouseHost = "localhost"
+	config.ClickHouseUser = "loader"
+	config.ClickHousePassword = "secret"
+	require.NoError(t, config.RequireClickHouse())
+}
+
+func TestClickHouseOptions(t *testing.T) {
 	config := chaindataagg.Config{
-		ClickHouseHost: "",
-		ClickHousePort: "9440",
-		WorkersNum:     5,
+		ClickHouseHost:        "ch-1.example.com, ch-2.example.com:9441",
+		ClickHousePort:        "9440",
+		ClickHouseUser:        "loader",
+		ClickHousePassword:    "secret",
+		ClickHouseDatabase:    "analytics_test",
+		ClickHouseTLS:         true,
+		ClickHouseCompression: "zstd",
+		ClickHouseDialTimeout: 5 * time.Second,
 	}
+
+	t.Run("defaults verify TLS", func(t *testing.T) {
+		options, err := config.ClickHouseOptions()
+		require.NoError(t, err)
+		require.Equal(t, []string{"ch-1.example.com:9440", "ch-2.example.com:9441"}, options.Addr)
+		require.Equal(t, clickhouse.ConnOpenInOrder, options.ConnOpenStrategy)
+		require.Equal(t, "loader", options.Auth.Username)
+		require.Equal(t, "analytics_test", options.Auth.Database)
+		require.Equal(t, clickhouse.CompressionZSTD, options.Compression.Method)
+		require.Equal(t, 5*time.Second, options.DialTimeout)
+		require.NotNil(t, options.TLS)
+		require.False(t, options.TLS.InsecureSkipVerify)
+	})
+
+	t.Run("custom CA bundle", func(t *testing.T) {
+		server := httptest.NewTLSServer(http.NotFoundHandler())
+		defer server.Close()
+
+		caFile := filepath.Join(t.TempDir(), "ca.pem")
+		caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+		require.NoError(t, os.WriteFile(caFile, caPEM, 0600))
+
+		config := config
+		config.ClickHouseCAFile = caFile
+		options, err := config.ClickHouseOptions()
+		require.NoError(t, err)
+		require.NotNil(t, options.TLS.RootCAs)
+	})
+
+	t.Run("invalid CA bundle", func(t *testing.T) {
+		caFile := filepath.Join(t.TempDir(), "ca.pem")
+		require.NoError(t, os.WriteFile(caFile, []byte("not a certificate"), 0600))
+
+		config := config
+		config.ClickHouseCAFile = caFile
+		_, err := config.ClickHouseOptions()
+		require.ErrorContains(t, err, "no certificates found")
+	})
+
+	t.Run("TLS disabled", func(t *testing.T) {
+		config := config
+		config.ClickHouseTLS = false
+		options, err := config.ClickHouseOptions()
+		require.NoError(t, err)
+		require.Nil(t, options.TLS)
+	})
+
+	t.Run("unknown compression", func(t *testing.T) {
+		config := config
+		config.ClickHouseCompression = "gzip"
+		_, err := config.ClickHouseOptions()
+		require.ErrorContains(t, err, "unknown ClickHouse compression")
+	})
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	// Unset variables left behind by TestLoadConfig, restored after the test.
+	t.Setenv("CLICKHOUSE_HOST", "")
+	os.Unsetenv("CLICKHOUSE_HOST")
+	t.Setenv("WORKERS_NUM", "")
+	os.Unsetenv("WORKERS_NUM")
+
+	t.Run("example", func(t *testing.T) {
+		config, err := chaindataagg.LoadConfigFile("config.example.yaml")
+		require.NoError(t, err)
+		require.Equal(t, "your-clickhouse-host", config.ClickHouseHost)
+		require.Equal(t, 30*time.Second, config.ClickHouseDialTimeout)
+		require.Equal(t, []string{"eur"}, config.Currencies)
+		require.Equal(t, []string{"sfl", "matic"}, config.Tokens)
+		require.NoError(t, config.Validate())
+	})
+
+	t.Run("layers", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		require.NoError(t, os.WriteFile(path, []byte("clickhouse:\n  host: file-host\n  port: \"9000\"\naggregation:\n  workers_num: 3\n"), 0600))
+		t.Setenv("CLICKHOUSE_PORT", "9440")
+
+		config, err := chaindataagg.LoadConfigFile(path)
+		require.NoError(t, err)
+		require.Equal(t, "file-host", config.ClickHouseHost)
+		require.Equal(t, "9440", config.ClickHousePort, "environment overrides the file")
+		require.Equal(t, 3, config.WorkersNum)
+		require.Equal(t, "analytics", config.ClickHouseDatabase, "defaults apply to missing keys")
+	})
+
+	t.Run("unknown keys", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		require.NoError(t, os.WriteFile(path, []byte("clickhouse:\n  hots: typo\n"), 0600))
+
+		_, err := chaindataagg.LoadConfigFile(path)
+		require.ErrorContains(t, err, "field hots not found")
+	})
+
+	t.Run("empty file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		require.NoError(t, os.WriteFile(path, nil, 0600))
+
+		_, err := chaindataagg.LoadConfigFile(path)
+		require.NoError(t, err)
+	})
+}
+
+func TestValidateConfigSections(t *testing.T) {
+	config := chaindataagg.DefaultConfig()
+	config.ClickHouseCompression = "gzip"
+	config.ClickHouseBatchSize = 0
+	config.MissingRatePolicy = "ignore"
+	config.DayTimezone = "Mars/Olympus"
+	config.NotifySMTPAddr = "localhost:25"
+
 	err := config.Validate()
-	require.Error(t, err)
-	require.Contains(t, err.Error(), "missing required environment variables")
+	require.NotContains(t, err.Error(), "missing required environment variables")
+	require.ErrorContains(t, err, "unknown ClickHouse compression")
+	require.ErrorContains(t, err, "batch size")
+	require.ErrorContains(t, err, "ignore")
+	require.ErrorContains(t, err, "invalid timezone")
+	require.ErrorContains(t, err, "sender and recipients")
 }
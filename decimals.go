@@ -0,0 +1,204 @@
+package chaindataagg
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+)
+
+// TokenDecimal is the number of decimals of a currency, matched by symbol or
+// by contract address.
+type TokenDecimal struct {
+	Symbol   string `json:"symbol,omitempty"`
+	Address  string `json:"address,omitempty"`
+	Decimals int    `json:"decimals"`
+}
+
+// TokenDecimals is a table of currency decimals.
+type TokenDecimals struct {
+	Tokens []TokenDecimal `json:"tokens"`
+}
+
+// maxDecimals bounds the decimals of a currency; ERC-20 decimals are a uint8
+// and no token uses more than this.
+const maxDecimals = 36
+
+// DefaultTokenDecimals returns the decimals of the marketplace currencies.
+func DefaultTokenDecimals() *TokenDecimals {
+	return &TokenDecimals{Tokens: []TokenDecimal{
+		// Native MATIC on Polygon.
+		{Address: "0x0000000000000000000000000000000000000000", Decimals: 18},
+		{Address: "0x3c499c542cef5e3811e1192ce70d8cc03d5c3359", Decimals: 6},  // USDC (Polygon)
+		{Address: "0x2791bca1f2de4661ed88a30c99a7a9449aa84174", Decimals: 6},  // USDC.e (Polygon)
+		{Address: "0xb97ef9ef8734c71904d8002f8b6bc66dd9c48a6e", Decimals: 6},  // USDC (Avalanche)
+		{Address: "0xd1f9c58e33933a993a3891f8acfe05a68e1afc05", Decimals: 18}, // SFL (Polygon)
+		{Symbol: "matic", Decimals: 18},
+		{Symbol: "usdc", Decimals: 6},
+		{Symbol: "usdc.e", Decimals: 6},
+		{Symbol: "usdt", Decimals: 6},
+	}}
+}
+
+// ParseTokenDecimals parses and validates a decimals table from JSON.
+func ParseTokenDecimals(data []byte) (*TokenDecimals, error) {
+	var decimals TokenDecimals
+	if err := json.Unmarshal(data, &decimals); err != nil {
+		return nil, fmt.Errorf("failed to parse token decimals: %w", err)
+	}
+	if err := decimals.Validate(); err != nil {
+		return nil, err
+	}
+	return &decimals, nil
+}
+
+// ReadTokenDecimals reads a decimals table from a JSON file. Its entries take
+// precedence over DefaultTokenDecimals.
+func ReadTokenDecimals(path string) (*TokenDecimals, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read token decimals: %w", err)
+	}
+	decimals, err := ParseTokenDecimals(data)
+	if err != nil {
+		return nil, err
+	}
+	decimals.Tokens = append(decimals.Tokens, DefaultTokenDecimals().Tokens...)
+	return decimals, nil
+}
+
+// Validate checks the entries and normalizes symbols and addresses to lower
+// case.
+func (d *TokenDecimals) Validate() error {
+	for i := range d.Tokens {
+		token := &d.Tokens[i]
+		token.Symbol = strings.ToLower(token.Symbol)
+		token.Address = strings.ToLower(token.Address)
+
+		if token.Symbol == "" && token.Address == "" {
+			return fmt.Errorf("token decimals %d: symbol or address is required", i)
+		}
+		if token.Decimals < 0 || token.Decimals > maxDecimals {
+			return fmt.Errorf("token decimals %d: decimals must be between 0 and %d", i, maxDecimals)
+		}
+	}
+	return nil
+}
+
+// Lookup returns the decimals of a currency. Address entries take precedence
+// over symbol entries, and earlier entries over later ones.
+func (d *TokenDecimals) Lookup(symbol, address string) (int, bool) {
+	if d == nil {
+		return 0, false
+	}
+
+	symbol = strings.ToLower(symbol)
+	address = strings.ToLower(address)
+	if address != "" {
+		for _, token := range d.Tokens {
+			if token.Address == address {
+				return token.Decimals, true
+			}
+		}
+	}
+	for _, token := range d.Tokens {
+		if token.Address == "" && token.Symbol == symbol {
+			return token.Decimals, true
+		}
+	}
+	return 0, false
+}
+
+// Sources of currency decimals.
+const (
+	DecimalsTable    = "table"
+	DecimalsInferred = "inferred"
+)
+
+// CurrencyDecimals is the number of decimals a currency was checked with.
+type CurrencyDecimals struct {
+	Symbol   string `json:"symbol"`
+	Address  string `json:"address,omitempty"`
+	Decimals int    `json:"decimals"`
+	// Source is table or inferred.
+	Source string `json:"source"`
+}
+
+// currencyKey identifies a currency by address, or by symbol without one.
+func currencyKey(tx Transaction) string {
+	if tx.CurrencyAddress != "" {
+		return strings.ToLower(tx.CurrencyAddress)
+	}
+	return strings.ToLower(tx.CurrencySymbol)
+}
+
+// ResolveDecimals returns the decimals of every currency of the transactions:
+// looked up in the table, or else inferred as the most common power of ten
+// between the raw and decimal values of the currency. Currencies without
+// usable values are left out.
+func ResolveDecimals(transactions []Transaction, table *TokenDecimals) map[string]CurrencyDecimals {
+	resolved := make(map[string]CurrencyDecimals)
+	counts := make(map[string]map[int]int)
+	for _, tx := range transactions {
+		key := currencyKey(tx)
+		if _, ok := resolved[key]; ok {
+			continue
+		}
+		if decimals, ok := table.Lookup(tx.CurrencySymbol, tx.CurrencyAddress); ok {
+			resolved[key] = CurrencyDecimals{Symbol: tx.CurrencySymbol, Address: tx.CurrencyAddress, Decimals: decimals, Source: DecimalsTable}
+			continue
+		}
+		raw, err := tx.RawValue()
+		if err != nil || raw.Sign() <= 0 || tx.CurrencyValue <= 0 {
+			continue
+		}
+		ratio, _ := new(big.Float).Quo(new(big.Float).SetInt(raw), big.NewFloat(tx.CurrencyValue)).Float64()
+		if math.IsInf(ratio, 0) || ratio == 0 {
+			continue
+		}
+		if counts[key] == nil {
+			counts[key] = make(map[int]int)
+		}
+		counts[key][int(math.Round(math.Log10(ratio)))]++
+	}
+
+	for _, tx := range transactions {
+		key := currencyKey(tx)
+		if _, ok := resolved[key]; ok || counts[key] == nil {
+			continue
+		}
+		candidates := make([]int, 0, len(counts[key]))
+		for decimals := range counts[key] {
+			candidates = append(candidates, decimals)
+		}
+		// Most common first, ties broken by the most decimals.
+		sort.Slice(candidates, func(i, j int) bool {
+			ci, cj := counts[key][candidates[i]], counts[key][candidates[j]]
+			if ci != cj {
+				return ci > cj
+			}
+			return candidates[i] > candidates[j]
+		})
+		resolved[key] = CurrencyDecimals{Symbol: tx.CurrencySymbol, Address: tx.CurrencyAddress, Decimals: candidates[0], Source: DecimalsInferred}
+	}
+	return resolved
+}
+
+// valueMismatch returns the relative difference between the raw value scaled
+// by the decimals and the decimal value.
+func valueMismatch(raw *big.Int, decimal float64, decimals int) float64 {
+	scale := new(big.Float).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(decimals)), nil))
+	scaled := new(big.Float).Quo(new(big.Float).SetPrec(256).SetInt(raw), scale)
+	if decimal == 0 {
+		if scaled.Sign() == 0 {
+			return 0
+		}
+		return math.Inf(1)
+	}
+	diff := new(big.Float).Sub(scaled, big.NewFloat(decimal))
+	relative, _ := new(big.Float).Quo(diff.Abs(diff), big.NewFloat(math.Abs(decimal))).Float64()
+	return relative
+}
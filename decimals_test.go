@@ -0,0 +1,84 @@
+package chaindataagg_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	chaindataagg "github.com/atkachyshyn/chain-data-agg"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTokenDecimals(t *testing.T) {
+	t.Run("valid", func(t *testing.T) {
+		decimals, err := chaindataagg.ParseTokenDecimals([]byte(`{"tokens": [{"symbol": "WETH", "decimals": 18}, {"address": "0xABC", "decimals": 8}]}`))
+		require.NoError(t, err)
+		require.Equal(t, "weth", decimals.Tokens[0].Symbol)
+		require.Equal(t, "0xabc", decimals.Tokens[1].Address)
+	})
+
+	t.Run("no match key", func(t *testing.T) {
+		_, err := chaindataagg.ParseTokenDecimals([]byte(`{"tokens": [{"decimals": 6}]}`))
+		require.ErrorContains(t, err, "symbol or address is required")
+	})
+
+	t.Run("out of range", func(t *testing.T) {
+		_, err := chaindataagg.ParseTokenDecimals([]byte(`{"tokens": [{"symbol": "x", "decimals": 80}]}`))
+		require.ErrorContains(t, err, "decimals must be between")
+	})
+}
+
+func TestReadTokenDecimals(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "decimals.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"tokens": [{"symbol": "usdc", "decimals": 18}]}`), 0o644))
+
+	decimals, err := chaindataagg.ReadTokenDecimals(path)
+	require.NoError(t, err)
+	// The file takes precedence over the built-in decimals.
+	got, ok := decimals.Lookup("USDC", "")
+	require.True(t, ok)
+	require.Equal(t, 18, got)
+	// Address entries take precedence over symbol entries.
+	got, ok = decimals.Lookup("USDC", "0x3C499C542CEF5E3811E1192CE70D8CC03D5C3359")
+	require.True(t, ok)
+	require.Equal(t, 6, got)
+	_, ok = decimals.Lookup("sfl", "")
+	require.False(t, ok)
+
+	var empty *chaindataagg.TokenDecimals
+	_, ok = empty.Lookup("usdc", "")
+	require.False(t, ok)
+}
+
+func TestResolveDecimals(t *testing.T) {
+	transactions := []chaindataagg.Transaction{
+		{CurrencySymbol: "USDC", CurrencyValue: 1, CurrencyValueRaw: "1"},
+		{CurrencySymbol: "SFL", CurrencyAddress: "0xsfl", CurrencyValue: 0.6136203411678249, CurrencyValueRaw: "613620341167824900"},
+		{CurrencySymbol: "SFL", CurrencyAddress: "0xsfl", CurrencyValue: 2, CurrencyValueRaw: "2000000000000000000"},
+		// An unscaled decimal value is outvoted.
+		{CurrencySymbol: "SFL", CurrencyAddress: "0xsfl", CurrencyValue: 5e17, CurrencyValueRaw: "500000000000000000"},
+		{CurrencySymbol: "NEW", CurrencyValue: 0, CurrencyValueRaw: "0"},
+	}
+
+	decimals := chaindataagg.ResolveDecimals(transactions, chaindataagg.DefaultTokenDecimals())
+	require.Equal(t, map[string]chaindataagg.CurrencyDecimals{
+		"usdc":  {Symbol: "USDC", Decimals: 6, Source: chaindataagg.DecimalsTable},
+		"0xsfl": {Symbol: "SFL", Address: "0xsfl", Decimals: 18, Source: chaindataagg.DecimalsInferred},
+	}, decimals)
+
+	// The raw values disagree with the decimal values only at float precision.
+	report, err := chaindataagg.CheckQuality(transactions[1:3], []chaindataagg.Expectation{
+		{Check: chaindataagg.CheckRawConsistent, Tolerance: 1e-12},
+	}, chaindataagg.QualityOptions{})
+	require.NoError(t, err)
+	require.Zero(t, report.Results[0].Failed)
+
+	report, err = chaindataagg.CheckQuality(transactions, []chaindataagg.Expectation{
+		{Check: chaindataagg.CheckRawConsistent, Tolerance: 1e-9},
+	}, chaindataagg.QualityOptions{Decimals: chaindataagg.DefaultTokenDecimals()})
+	require.NoError(t, err)
+	require.Equal(t, 2, report.Results[0].Failed)
+	require.Contains(t, report.Results[0].Examples[0].Message, "raw value 1 with 6 decimals")
+	require.Contains(t, report.Results[0].Examples[1].Message, "raw value 500000000000000000 with 18 decimals")
+	require.Len(t, report.Decimals, 2)
+}
@@ -0,0 +1,65 @@
+package chaindataagg
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// DryRunSummary describes what a command would have done without its
+// uploads and inserts.
+type DryRunSummary struct {
+	Command       string `json:"command"`
+	RowsParsed    int    `json:"rows_parsed"`
+	RowsRejected  int    `json:"rows_rejected"`
+	Groups        int    `json:"groups,omitempty"`
+	SymbolsPriced int    `json:"symbols_priced,omitempty"`
+	// Inserts are the rows that would be inserted per table or file.
+	Inserts map[string]int `json:"inserts,omitempty"`
+	// Uploads are the bytes that would be written per output.
+	Uploads map[string]int `json:"uploads,omitempty"`
+}
+
+// Print writes the summary as JSON.
+func (s DryRunSummary) Print(w io.Writer) error {
+	content, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(content))
+	return err
+}
+
+// PlannedInserts returns the rows a load would insert per table, including
+// the ClickHouse rollups fed by materialized views. File destinations are
+// keyed by their target.
+func PlannedInserts(destination, target string, data []AggregatedData) (map[string]int, error) {
+	switch strings.ToLower(destination) {
+	case DestinationClickHouse:
+		days := make(map[string]bool)
+		months := make(map[string]bool)
+		for _, entry := range data {
+			month := entry.Date
+			if len(month) >= len("2006-01") {
+				month = month[:len("2006-01")]
+			}
+			days[entry.Date+"_"+entry.ProjectID] = true
+			months[month+"_"+entry.ProjectID] = true
+		}
+		return map[string]int{
+			"marketplace_analytics":             len(data),
+			"marketplace_analytics_daily_agg":   len(days),
+			"marketplace_analytics_monthly_agg": len(months),
+		}, nil
+	case DestinationPostgres, "postgresql", DestinationSQLite:
+		return map[string]int{"marketplace_analytics": len(data)}, nil
+	case DestinationCSV, DestinationParquet:
+		if target == "" {
+			return nil, fmt.Errorf("no output file configured")
+		}
+		return map[string]int{target: len(data)}, nil
+	default:
+		return nil, fmt.Errorf("unknown destination: %s", destination)
+	}
+}
@@ -0,0 +1,57 @@
+package chaindataagg_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	chaindataagg "github.com/atkachyshyn/chain-data-agg"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlannedInserts(t *testing.T) {
+	data := []chaindataagg.AggregatedData{
+		{Date: "2024-04-15", ProjectID: "1", Transactions: 2},
+		{Date: "2024-04-15", ProjectID: "1", Transactions: 1, RateMissing: true},
+		{Date: "2024-04-16", ProjectID: "1", Transactions: 1},
+		{Date: "2024-05-01", ProjectID: "2", Transactions: 1},
+	}
+
+	inserts, err := chaindataagg.PlannedInserts("ClickHouse", "", data)
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{
+		"marketplace_analytics":             4,
+		"marketplace_analytics_daily_agg":   3,
+		"marketplace_analytics_monthly_agg": 2,
+	}, inserts)
+
+	inserts, err = chaindataagg.PlannedInserts("sqlite", "", data)
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{"marketplace_analytics": 4}, inserts)
+
+	inserts, err = chaindataagg.PlannedInserts("parquet", "gs://bucket/out.parquet", data)
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{"gs://bucket/out.parquet": 4}, inserts)
+
+	_, err = chaindataagg.PlannedInserts("bigquery", "", data)
+	require.ErrorContains(t, err, "unknown destination")
+}
+
+func TestDryRunSummaryPrint(t *testing.T) {
+	var buf bytes.Buffer
+	summary := chaindataagg.DryRunSummary{
+		Command:    "extract",
+		RowsParsed: 10,
+		Uploads:    map[string]int{"extracted.json": 512},
+	}
+	require.NoError(t, summary.Print(&buf))
+
+	var printed map[string]any
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &printed))
+	require.Equal(t, map[string]any{
+		"command":       "extract",
+		"rows_parsed":   float64(10),
+		"rows_rejected": float64(0),
+		"uploads":       map[string]any{"extracted.json": float64(512)},
+	}, printed)
+}
@@ -2,34 +2,96 @@ package chaindataagg
 
 import (
 	"bytes"
+	"context"
 	"encoding/csv"
 	"fmt"
+	"math/big"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type Transaction struct {
-	Timestamp      string
-	Event          string
-	ProjectID      string
-	CurrencySymbol string
-	CurrencyValue  float64
+	Timestamp       string
+	Event           string
+	ProjectID       string
+	CurrencySymbol  string
+	CurrencyAddress string
+	CurrencyValue   float64
+	// CurrencyValueRaw is the value in the smallest unit of the currency, as
+	// an integer string.
+	CurrencyValueRaw string `json:",omitempty"`
+	// RawMismatch marks a raw value that disagrees with the decimal value,
+	// set by CheckQuality.
+	RawMismatch       bool   `json:",omitempty"`
+	TxnHash           string `json:",omitempty"`
+	UserID            string `json:",omitempty"`
+	SessionID         string `json:",omitempty"`
+	CollectionAddress string `json:",omitempty"`
+	TokenID           string `json:",omitempty"`
+}
+
+// Marketplace events.
+const (
+	EventBuyItems  = "BUY_ITEMS"
+	EventSellItems = "SELL_ITEMS"
+)
+
+// Time parses the transaction timestamp. Timestamps without a zone are
+// interpreted in the source location.
+func (t Transaction) Time(source *time.Location) (time.Time, error) {
+	return ParseTimestamp(t.Timestamp, source)
 }
 
-func Extract(inputData []byte, workerCount int) ([]Transaction, error) {
+// RawValue parses the raw value.
+func (t Transaction) RawValue() (*big.Int, error) {
+	raw, ok := new(big.Int).SetString(t.CurrencyValueRaw, 10)
+	if !ok || raw.Sign() < 0 {
+		return nil, fmt.Errorf("raw value %q is not an unsigned integer", t.CurrencyValueRaw)
+	}
+	return raw, nil
+}
+
+func Extract(ctx context.Context, inputData []byte, workerCount int) ([]Transaction, error) {
+	transactions, summary, err := ExtractWithSummary(ctx, inputData, workerCount)
+	if err != nil {
+		return nil, err
+	}
+	if summary.Rejected > 0 {
+		return nil, fmt.Errorf("errors occurred during extraction: %v", summary.Errors)
+	}
+	return transactions, nil
+}
+
+// ExtractSummary reports the outcome of an extraction.
+type ExtractSummary struct {
+	Rows     int
+	Rejected int
+	Errors   []error
+}
+
+// ExtractWithSummary extracts transactions, reporting rows that cannot be
+// parsed in the summary instead of failing.
+func ExtractWithSummary(ctx context.Context, inputData []byte, workerCount int) (_ []Transaction, _ ExtractSummary, err error) {
+	defer observeStage("extract", time.Now())
+	ctx, span := startSpan(ctx, "extract", attribute.Int("workers", workerCount))
+	defer func() { endSpan(span, err) }()
+
 	reader := csv.NewReader(bytes.NewReader(inputData))
 
 	// Read header row to skip it.
-	_, err := reader.Read()
+	_, err = reader.Read()
 	if err != nil {
-		return nil, fmt.Errorf("failed to read header: %w", err)
+		return nil, ExtractSummary{}, fmt.Errorf("failed to read header: %w", err)
 	}
 
 	// Read all records (small performance trade-off to distribute work).
 	records, err := reader.ReadAll()
 	if err != nil {
-		return nil, fmt.Errorf("failed to read records: %w", err)
+		return nil, ExtractSummary{}, fmt.Errorf("failed to read records: %w", err)
 	}
 
 	// Channel for records and results.
@@ -41,7 +103,7 @@ func Extract(inputData []byte, workerCount int) ([]Transaction, error) {
 	// Start worker goroutines.
 	for i := 0; i < workerCount; i++ {
 		wg.Add(1)
-		go processRecords(recordChan, resultChan, errorChan, wg)
+		go processRecords(ctx, i, recordChan, resultChan, errorChan, wg)
 	}
 
 	// Send records to workers.
@@ -70,24 +132,37 @@ func Extract(inputData []byte, workerCount int) ([]Transaction, error) {
 	for err := range errorChan {
 		errors = append(errors, err)
 	}
-	if len(errors) > 0 {
-		return nil, fmt.Errorf("errors occurred during extraction: %v", errors)
+	// Workers stop early when canceled, the result is incomplete.
+	if err := ctx.Err(); err != nil {
+		return nil, ExtractSummary{}, err
 	}
+	rowsIn.WithLabelValues("extract").Add(float64(len(records)))
+	rowsRejected.WithLabelValues("extract").Add(float64(len(errors)))
+	span.SetAttributes(attribute.Int("rows", len(records)), attribute.Int("rejected", len(errors)))
 
-	return transactions, nil
+	return transactions, ExtractSummary{Rows: len(records), Rejected: len(errors), Errors: errors}, nil
 }
 
-func processRecords(recordChan <-chan []string, resultChan chan<- Transaction, errorChan chan<- error, wg *sync.WaitGroup) {
+func processRecords(ctx context.Context, worker int, recordChan <-chan []string, resultChan chan<- Transaction, errorChan chan<- error, wg *sync.WaitGroup) {
 	defer wg.Done()
+	_, span := startSpan(ctx, "extract.worker", attribute.Int("worker", worker))
+	defer span.End()
 
+	rows, rejected := 0, 0
 	for record := range recordChan {
+		if ctx.Err() != nil {
+			return
+		}
+		rows++
 		transaction, err := processRecord(record)
 		if err != nil {
+			rejected++
 			errorChan <- err
 			continue
 		}
 		resultChan <- transaction
 	}
+	span.SetAttributes(attribute.Int("rows", rows), attribute.Int("rejected", rejected))
 }
 
 func processRecord(record []string) (Transaction, error) {
@@ -95,20 +170,35 @@ func processRecord(record []string) (Transaction, error) {
 	nums := record[15]
 
 	currencySymbol := extractJSONValue(props, `"currencySymbol"`)
+	currencyAddress := extractJSONValue(props, `"currencyAddress"`)
 
 	currencyValueDecimalStr := extractJSONValue(nums, `"currencyValueDecimal"`)
 	currencyValueDecimal, err := strconv.ParseFloat(currencyValueDecimalStr, 64)
 	if err != nil {
 		return Transaction{}, fmt.Errorf("failed to parse currency value: %w", err)
 	}
+	currencyValueRaw := extractJSONValue(nums, `"currencyValueRaw"`)
+	if currencyValueRaw != "" {
+		if _, err := (Transaction{CurrencyValueRaw: currencyValueRaw}).RawValue(); err != nil {
+			return Transaction{}, fmt.Errorf("failed to parse raw currency value: %w", err)
+		}
+	}
 
 	// Create the transaction.
 	return Transaction{
-		Timestamp:      record[1], // ts
-		Event:          record[2], // event
-		ProjectID:      record[3], // project_id
-		CurrencySymbol: currencySymbol,
-		CurrencyValue:  currencyValueDecimal,
+		Timestamp:       record[1], // ts
+		Event:           record[2], // event
+		ProjectID:       record[3], // project_id
+		CurrencySymbol:  currencySymbol,
+		CurrencyAddress: currencyAddress,
+		CurrencyValue:   currencyValueDecimal,
+		// Checked against the decimal value by the quality expectations.
+		CurrencyValueRaw:  currencyValueRaw,
+		TxnHash:           extractJSONValue(props, `"txnHash"`),
+		UserID:            record[6], // user_id
+		SessionID:         record[7], // session_id
+		CollectionAddress: extractJSONValue(props, `"collectionAddress"`),
+		TokenID:           extractJSONValue(props, `"tokenId"`),
 	}, nil
 }
 
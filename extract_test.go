@@ -1,6 +1,9 @@
 package chaindataagg_test
 
 import (
+	"context"
+	"errors"
+	"strings"
 	"testing"
 
 	chaindataagg "github.com/atkachyshyn/chain-data-agg"
@@ -15,7 +18,7 @@ func TestExtract(t *testing.T) {
 
 	t.Run("valid input", func(t *testing.T) {
 		// Call the Extract function
-		transactions, err := chaindataagg.Extract(inputBytes, 1)
+		transactions, err := chaindataagg.Extract(context.Background(), inputBytes, 1)
 		if err != nil {
 			t.Fatalf("expected no error, got %v", err)
 		}
@@ -37,4 +40,40 @@ func TestExtract(t *testing.T) {
 			t.Fatalf("expected currency symbol SFL, got %s", transaction.CurrencySymbol)
 		}
 	})
+
+	t.Run("rejected rows", func(t *testing.T) {
+		invalid := strings.Replace(sampleData, "0.6136203411678249", "n/a", 1)
+		data := []byte(sampleData + "\n" + strings.SplitN(invalid, "\n", 2)[1])
+
+		transactions, summary, err := chaindataagg.ExtractWithSummary(context.Background(), data, 2)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if len(transactions) != 1 || summary.Rows != 2 || summary.Rejected != 1 {
+			t.Fatalf("expected 1 of 2 rows extracted, got %d (summary %+v)", len(transactions), summary)
+		}
+
+		if _, err := chaindataagg.Extract(context.Background(), data, 2); err == nil {
+			t.Fatal("expected extraction to fail on rejected rows")
+		}
+	})
+
+	t.Run("malformed raw value", func(t *testing.T) {
+		data := []byte(strings.Replace(sampleData, "613620341167824900", "6.1e17", 1))
+		_, summary, err := chaindataagg.ExtractWithSummary(context.Background(), data, 1)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if summary.Rejected != 1 || !strings.Contains(summary.Errors[0].Error(), "raw currency value") {
+			t.Fatalf("expected the row to be rejected for its raw value, got %+v", summary)
+		}
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, _, err := chaindataagg.ExtractWithSummary(ctx, inputBytes, 1); !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected context.Canceled, got %v", err)
+		}
+	})
 }
@@ -2,14 +2,34 @@ package chaindataagg
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
+	"io/fs"
+	"os"
+	"strings"
 	"time"
 
 	"cloud.google.com/go/storage"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/api/iterator"
 )
 
-func UploadToBucket(bucketName, objectName string, data []byte) error {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*50)
+// bucketTimeout bounds each bucket call, ctx may cancel it sooner.
+const bucketTimeout = 50 * time.Second
+
+// UploadToBucket writes data to an object. Canceling ctx aborts the upload
+// without creating the object.
+func UploadToBucket(ctx context.Context, bucketName, objectName string, data []byte) error {
+	return UploadObject(ctx, bucketName, objectName, data, nil)
+}
+
+// UploadObject writes data to an object with custom metadata.
+func UploadObject(ctx context.Context, bucketName, objectName string, data []byte, metadata map[string]string) (err error) {
+	ctx, span := startSpan(ctx, "upload", attribute.String("bucket", bucketName), attribute.String("object", objectName), attribute.Int("bytes", len(data)))
+	defer func() { endSpan(span, err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, bucketTimeout)
 	defer cancel()
 
 	client, err := storage.NewClient(ctx)
@@ -20,6 +40,7 @@ func UploadToBucket(bucketName, objectName string, data []byte) error {
 
 	bucket := client.Bucket(bucketName)
 	writer := bucket.Object(objectName).NewWriter(ctx)
+	writer.Metadata = metadata
 	if _, err := writer.Write(data); err != nil {
 		return err
 	}
@@ -30,8 +51,30 @@ func UploadToBucket(bucketName, objectName string, data []byte) error {
 	return nil
 }
 
-func DownloadFromBucket(bucketName, objectName string) ([]byte, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*50)
+// DownloadFromBucket reads an object.
+func DownloadFromBucket(ctx context.Context, bucketName, objectName string) ([]byte, error) {
+	object, err := DownloadObject(ctx, bucketName, objectName, 0)
+	if err != nil {
+		return nil, err
+	}
+	return object.Data, nil
+}
+
+// BucketObject is the content of an object with its generation and custom
+// metadata.
+type BucketObject struct {
+	Data       []byte
+	Generation int64
+	Metadata   map[string]string
+}
+
+// DownloadObject reads a generation of an object, the live one if generation
+// is 0.
+func DownloadObject(ctx context.Context, bucketName, objectName string, generation int64) (_ *BucketObject, err error) {
+	ctx, span := startSpan(ctx, "download", attribute.String("bucket", bucketName), attribute.String("object", objectName))
+	defer func() { endSpan(span, err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, bucketTimeout)
 	defer cancel()
 
 	client, err := storage.NewClient(ctx)
@@ -40,8 +83,17 @@ func DownloadFromBucket(bucketName, objectName string) ([]byte, error) {
 	}
 	defer client.Close()
 
-	bucket := client.Bucket(bucketName)
-	reader, err := bucket.Object(objectName).NewReader(ctx)
+	handle := client.Bucket(bucketName).Object(objectName)
+	if generation != 0 {
+		handle = handle.Generation(generation)
+	}
+	// The attributes are read first, so metadata and content are of the
+	// same generation.
+	attrs, err := handle.Attrs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := handle.Generation(attrs.Generation).NewReader(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -52,5 +104,65 @@ func DownloadFromBucket(bucketName, objectName string) ([]byte, error) {
 		return nil, err
 	}
 
-	return data, nil
+	return &BucketObject{Data: data, Generation: attrs.Generation, Metadata: attrs.Metadata}, nil
+}
+
+// ParseBucketURI splits a gs://bucket/object URI into bucket and object names.
+func ParseBucketURI(uri string) (string, string, bool) {
+	path, ok := strings.CutPrefix(uri, "gs://")
+	if !ok {
+		return "", "", false
+	}
+	bucketName, objectName, ok := strings.Cut(path, "/")
+	if !ok || bucketName == "" || objectName == "" {
+		return "", "", false
+	}
+	return bucketName, objectName, true
+}
+
+// WriteOutput writes content to a local file or a gs://bucket/object URI.
+func WriteOutput(ctx context.Context, target string, content []byte) error {
+	if bucketName, objectName, ok := ParseBucketURI(target); ok {
+		return UploadToBucket(ctx, bucketName, objectName, content)
+	}
+	return os.WriteFile(target, content, 0o644)
+}
+
+// ReadInput reads a local file or a gs://bucket/object URI. A missing file or
+// object is reported as fs.ErrNotExist.
+func ReadInput(ctx context.Context, source string) ([]byte, error) {
+	if bucketName, objectName, ok := ParseBucketURI(source); ok {
+		data, err := DownloadFromBucket(ctx, bucketName, objectName)
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return nil, fmt.Errorf("%s: %w", source, fs.ErrNotExist)
+		}
+		return data, err
+	}
+	return os.ReadFile(source)
+}
+
+// ListBucket returns the names of the objects under a prefix.
+func ListBucket(ctx context.Context, bucketName, prefix string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, bucketTimeout)
+	defer cancel()
+
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	var names []string
+	objects := client.Bucket(bucketName).Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		object, err := objects.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, object.Name)
+	}
+	return names, nil
 }
@@ -0,0 +1,296 @@
+package chaindataagg
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+// Lineage identifies the inputs an aggregated row was computed from.
+type Lineage struct {
+	// RunID is the transform run that computed the row.
+	RunID     string
+	SourceURI string
+	// SourceGeneration is the GCS generation of the source object, 0 if
+	// unknown.
+	SourceGeneration        int64 `json:",omitempty"`
+	PriceSnapshotURI        string
+	PriceSnapshotGeneration int64 `json:",omitempty"`
+}
+
+// Lineage input roles.
+const (
+	LineageSource        = "source"
+	LineagePriceSnapshot = "price_snapshot"
+)
+
+// LineageInput is an input of a transform run.
+type LineageInput struct {
+	RunID      string `json:"run_id"`
+	Role       string `json:"role"`
+	URI        string `json:"uri"`
+	Generation int64  `json:"generation,omitempty"`
+}
+
+// Inputs returns the source and price snapshot of the lineage.
+func (l Lineage) Inputs() []LineageInput {
+	var inputs []LineageInput
+	if l.SourceURI != "" {
+		inputs = append(inputs, LineageInput{RunID: l.RunID, Role: LineageSource, URI: l.SourceURI, Generation: l.SourceGeneration})
+	}
+	if l.PriceSnapshotURI != "" {
+		inputs = append(inputs, LineageInput{RunID: l.RunID, Role: LineagePriceSnapshot, URI: l.PriceSnapshotURI, Generation: l.PriceSnapshotGeneration})
+	}
+	return inputs
+}
+
+// Custom metadata of extracted objects naming the object they were extracted
+// from.
+const (
+	metadataSourceURI        = "source-uri"
+	metadataSourceGeneration = "source-generation"
+)
+
+// SourceMetadata returns the object metadata recording the source of an
+// extracted object.
+func SourceMetadata(uri string, generation int64) map[string]string {
+	return map[string]string{
+		metadataSourceURI:        uri,
+		metadataSourceGeneration: strconv.FormatInt(generation, 10),
+	}
+}
+
+// SourceFromMetadata returns the source recorded by SourceMetadata, empty for
+// objects without one.
+func SourceFromMetadata(metadata map[string]string) (string, int64) {
+	generation, _ := strconv.ParseInt(metadata[metadataSourceGeneration], 10, 64)
+	return metadata[metadataSourceURI], generation
+}
+
+// lineageInputs returns the distinct inputs of the rows.
+func lineageInputs(data []AggregatedData) []LineageInput {
+	seen := make(map[Lineage]bool)
+	var inputs []LineageInput
+	for _, entry := range data {
+		if entry.Lineage == nil || entry.Lineage.RunID == "" || seen[*entry.Lineage] {
+			continue
+		}
+		seen[*entry.Lineage] = true
+		inputs = append(inputs, entry.Lineage.Inputs()...)
+	}
+	return inputs
+}
+
+// LineageStore reads the lineage of loaded rows.
+type LineageStore interface {
+	// Rows returns the loaded rows of a project and day with their lineage.
+	Rows(ctx context.Context, date, projectID string) ([]AggregatedData, error)
+	// Inputs returns the recorded inputs of a transform run.
+	Inputs(ctx context.Context, runID string) ([]LineageInput, error)
+}
+
+// LineageTrace relates loaded rows to the transactions they were computed
+// from.
+type LineageTrace struct {
+	Lineage Lineage          `json:"lineage"`
+	Inputs  []LineageInput   `json:"inputs"`
+	Rows    []AggregatedData `json:"rows"`
+	// Transactions are the transactions of the project and day in the source
+	// object, empty if the rows have no recorded source.
+	Transactions []Transaction `json:"transactions"`
+}
+
+// TraceOptions configures TraceLineage.
+type TraceOptions struct {
+	// Download reads a generation of a gs://bucket/object URI, the live one if
+	// generation is 0. It defaults to reading from GCS.
+	Download func(ctx context.Context, uri string, generation int64) ([]byte, error)
+	// Workers is the number of extract workers.
+	Workers int
+	// SourceLocation and DayLocation are the time zones of the transform
+	// (UTC by default).
+	SourceLocation *time.Location
+	DayLocation    *time.Location
+}
+
+// TraceLineage traces the loaded rows of a project and day back to the
+// transactions they were computed from. Rows are grouped by lineage; each
+// source object is extracted again at its recorded generation.
+func TraceLineage(ctx context.Context, store LineageStore, date, projectID string, opts TraceOptions) ([]LineageTrace, error) {
+	rows, err := store.Rows(ctx, date, projectID)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("no rows loaded for project %s on %s", projectID, date)
+	}
+	if opts.Download == nil {
+		opts.Download = downloadGeneration
+	}
+	dayLocation := opts.DayLocation
+	if dayLocation == nil {
+		dayLocation = time.UTC
+	}
+
+	var traces []LineageTrace
+	index := make(map[Lineage]int)
+	for _, row := range rows {
+		var lineage Lineage
+		if row.Lineage != nil {
+			lineage = *row.Lineage
+		}
+		i, ok := index[lineage]
+		if !ok {
+			i = len(traces)
+			index[lineage] = i
+			traces = append(traces, LineageTrace{Lineage: lineage, Inputs: []LineageInput{}, Transactions: []Transaction{}})
+		}
+		traces[i].Rows = append(traces[i].Rows, row)
+	}
+
+	for i := range traces {
+		trace := &traces[i]
+		if trace.Lineage.RunID != "" {
+			if trace.Inputs, err = store.Inputs(ctx, trace.Lineage.RunID); err != nil {
+				return nil, err
+			}
+		}
+		if trace.Lineage.SourceURI == "" {
+			continue
+		}
+
+		content, err := opts.Download(ctx, trace.Lineage.SourceURI, trace.Lineage.SourceGeneration)
+		if err != nil {
+			return nil, fmt.Errorf("failed to download source %s: %w", trace.Lineage.SourceURI, err)
+		}
+		transactions, _, err := ExtractWithSummary(ctx, content, max(opts.Workers, 1))
+		if err != nil {
+			return nil, fmt.Errorf("failed to extract source %s: %w", trace.Lineage.SourceURI, err)
+		}
+		for _, tx := range transactions {
+			if tx.ProjectID != projectID {
+				continue
+			}
+			ts, err := tx.Time(opts.SourceLocation)
+			if err != nil {
+				return nil, err
+			}
+			if ts.In(dayLocation).Format(DateFormat) == date {
+				trace.Transactions = append(trace.Transactions, tx)
+			}
+		}
+	}
+	return traces, nil
+}
+
+// downloadGeneration reads a generation of a gs://bucket/object URI.
+func downloadGeneration(ctx context.Context, uri string, generation int64) ([]byte, error) {
+	bucketName, objectName, ok := ParseBucketURI(uri)
+	if !ok {
+		return nil, fmt.Errorf("invalid source URI: %s", uri)
+	}
+	object, err := DownloadObject(ctx, bucketName, objectName, generation)
+	if err != nil {
+		return nil, err
+	}
+	return object.Data, nil
+}
+
+// clickHouseLineageStore reads lineage from marketplace_analytics and
+// pipeline_lineage.
+type clickHouseLineageStore struct {
+	conn driver.Conn
+}
+
+// NewClickHouseLineageStore constructs a lineage store over ClickHouse.
+func NewClickHouseLineageStore(conn driver.Conn) LineageStore {
+	return &clickHouseLineageStore{conn: conn}
+}
+
+func (s *clickHouseLineageStore) Rows(ctx context.Context, date, projectID string) ([]AggregatedData, error) {
+	var rows []struct {
+		Date                    string             `ch:"date"`
+		ProjectID               string             `ch:"project_id"`
+		Transactions            uint32             `ch:"transactions"`
+		TotalVolumeUSD          float64            `ch:"total_volume_usd"`
+		RateMissing             uint8              `ch:"rate_missing"`
+		Volumes                 map[string]float64 `ch:"volumes"`
+		RunID                   string             `ch:"run_id"`
+		SourceURI               string             `ch:"source_uri"`
+		SourceGeneration        int64              `ch:"source_generation"`
+		PriceSnapshotURI        string             `ch:"price_snapshot_uri"`
+		PriceSnapshotGeneration int64              `ch:"price_snapshot_generation"`
+	}
+	query := `
+		SELECT
+			toString(date) AS date,
+			project_id,
+			transactions,
+			ifNull(total_volume_usd, 0) AS total_volume_usd,
+			rate_missing,
+			volumes,
+			run_id,
+			source_uri,
+			source_generation,
+			price_snapshot_uri,
+			price_snapshot_generation
+		FROM marketplace_analytics
+		WHERE date = toDate(?) AND project_id = ?
+		ORDER BY run_id, rate_missing
+	`
+	if err := s.conn.Select(ctx, &rows, query, date, projectID); err != nil {
+		return nil, fmt.Errorf("failed to query rows: %w", err)
+	}
+
+	data := make([]AggregatedData, 0, len(rows))
+	for _, row := range rows {
+		entry := AggregatedData{
+			Date:           row.Date,
+			ProjectID:      row.ProjectID,
+			Transactions:   int(row.Transactions),
+			TotalVolumeUSD: row.TotalVolumeUSD,
+			RateMissing:    row.RateMissing != 0,
+		}
+		if len(row.Volumes) > 0 {
+			entry.Volumes = row.Volumes
+		}
+		if row.RunID != "" {
+			entry.Lineage = &Lineage{
+				RunID:                   row.RunID,
+				SourceURI:               row.SourceURI,
+				SourceGeneration:        row.SourceGeneration,
+				PriceSnapshotURI:        row.PriceSnapshotURI,
+				PriceSnapshotGeneration: row.PriceSnapshotGeneration,
+			}
+		}
+		data = append(data, entry)
+	}
+	return data, nil
+}
+
+func (s *clickHouseLineageStore) Inputs(ctx context.Context, runID string) ([]LineageInput, error) {
+	var rows []struct {
+		RunID      string `ch:"run_id"`
+		Role       string `ch:"role"`
+		URI        string `ch:"uri"`
+		Generation int64  `ch:"generation"`
+	}
+	query := `
+		SELECT run_id, role, uri, generation
+		FROM pipeline_lineage FINAL
+		WHERE run_id = ?
+		ORDER BY role, uri
+	`
+	if err := s.conn.Select(ctx, &rows, query, runID); err != nil {
+		return nil, fmt.Errorf("failed to query lineage: %w", err)
+	}
+
+	inputs := make([]LineageInput, 0, len(rows))
+	for _, row := range rows {
+		inputs = append(inputs, LineageInput{RunID: row.RunID, Role: row.Role, URI: row.URI, Generation: row.Generation})
+	}
+	return inputs, nil
+}
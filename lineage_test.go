@@ -0,0 +1,99 @@
+package chaindataagg_test
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	chaindataagg "github.com/atkachyshyn/chain-data-agg"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeLineageStore serves loaded rows and run inputs.
+type fakeLineageStore struct {
+	rows   []chaindataagg.AggregatedData
+	inputs map[string][]chaindataagg.LineageInput
+}
+
+func (s *fakeLineageStore) Rows(ctx context.Context, date, projectID string) ([]chaindataagg.AggregatedData, error) {
+	var rows []chaindataagg.AggregatedData
+	for _, row := range s.rows {
+		if row.Date == date && row.ProjectID == projectID {
+			rows = append(rows, row)
+		}
+	}
+	return rows, nil
+}
+
+func (s *fakeLineageStore) Inputs(ctx context.Context, runID string) ([]chaindataagg.LineageInput, error) {
+	return s.inputs[runID], nil
+}
+
+func TestTraceLineage(t *testing.T) {
+	ctx := context.Background()
+	source, err := os.ReadFile("sample_data/sample_data.csv")
+	require.NoError(t, err)
+	transactions, err := chaindataagg.Extract(ctx, source, 2)
+	require.NoError(t, err)
+
+	lineage := &chaindataagg.Lineage{
+		RunID:            "20240416T010000Z-00000001",
+		SourceURI:        "gs://bucket/sample_data.csv",
+		SourceGeneration: 42,
+		PriceSnapshotURI: "gs://bucket/prices/daily-token-prices-2024-04-15.json",
+	}
+	rows, _, err := chaindataagg.TransformWithOptions(ctx, transactions, nil, chaindataagg.TransformOptions{
+		MissingRatePolicy: chaindataagg.MissingRateFlag,
+		Lineage:           lineage,
+	})
+	require.NoError(t, err)
+	for _, row := range rows {
+		require.Equal(t, lineage, row.Lineage)
+	}
+
+	// A row loaded before lineage was recorded is traced to no source.
+	row := rows[0]
+	legacy := row
+	legacy.Lineage = nil
+	store := &fakeLineageStore{
+		rows:   []chaindataagg.AggregatedData{row, legacy},
+		inputs: map[string][]chaindataagg.LineageInput{lineage.RunID: lineage.Inputs()},
+	}
+
+	var downloads []int64
+	traces, err := chaindataagg.TraceLineage(ctx, store, row.Date, row.ProjectID, chaindataagg.TraceOptions{
+		Download: func(ctx context.Context, uri string, generation int64) ([]byte, error) {
+			require.Equal(t, lineage.SourceURI, uri)
+			downloads = append(downloads, generation)
+			return source, nil
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []int64{42}, downloads)
+	require.Len(t, traces, 2)
+
+	require.Equal(t, *lineage, traces[0].Lineage)
+	require.Equal(t, []chaindataagg.AggregatedData{row}, traces[0].Rows)
+	require.Len(t, traces[0].Inputs, 2)
+	require.Equal(t, chaindataagg.LineageSource, traces[0].Inputs[0].Role)
+	require.Len(t, traces[0].Transactions, row.Transactions)
+	for _, tx := range traces[0].Transactions {
+		require.Equal(t, row.ProjectID, tx.ProjectID)
+	}
+
+	require.Empty(t, traces[1].Lineage.RunID)
+	require.Empty(t, traces[1].Transactions)
+
+	_, err = chaindataagg.TraceLineage(ctx, store, "2023-01-01", row.ProjectID, chaindataagg.TraceOptions{})
+	require.ErrorContains(t, err, "no rows loaded")
+}
+
+func TestSourceMetadata(t *testing.T) {
+	uri, generation := chaindataagg.SourceFromMetadata(chaindataagg.SourceMetadata("gs://bucket/input.csv", 1713139200000000))
+	require.Equal(t, "gs://bucket/input.csv", uri)
+	require.Equal(t, int64(1713139200000000), generation)
+
+	uri, generation = chaindataagg.SourceFromMetadata(nil)
+	require.Empty(t, uri)
+	require.Zero(t, generation)
+}
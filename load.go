@@ -3,71 +3,150 @@ package chaindataagg
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
 
 	"github.com/ClickHouse/clickhouse-go/v2"
 	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
 )
 
-func Load(data []AggregatedData, host, password string) error {
-	db, err := connect(host, password)
+// Load inserts aggregated data into ClickHouse.
+func Load(ctx context.Context, data []AggregatedData, options *clickhouse.Options) error {
+	sink, err := NewClickHouseSink(ctx, options, DefaultRetryPolicy, DefaultBatchSize)
 	if err != nil {
 		return err
 	}
-	defer db.Close()
+	defer sink.Close()
 
-	query := `
-		INSERT INTO marketplace_analytics (date, project_id, transactions, total_volume_usd)
-		VALUES (?, ?, ?, ?)
-	`
+	return sink.Write(ctx, data)
+}
+
+// ClickHouseOptions builds the ClickHouse connection options from the
+// configuration. ClickHouseHost may list several comma-separated hosts, which
+// are tried in order for failover; hosts without a port use ClickHousePort.
+func (c *Config) ClickHouseOptions() (*clickhouse.Options, error) {
+	var addrs []string
+	for _, host := range strings.Split(c.ClickHouseHost, ",") {
+		host = strings.TrimSpace(host)
+		if host == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			host = net.JoinHostPort(host, c.ClickHousePort)
+		}
+		addrs = append(addrs, host)
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New("no ClickHouse hosts configured")
+	}
+
+	compression := &clickhouse.Compression{}
+	switch strings.ToLower(c.ClickHouseCompression) {
+	case "", "none":
+		compression.Method = clickhouse.CompressionNone
+	case "lz4":
+		compression.Method = clickhouse.CompressionLZ4
+	case "zstd":
+		compression.Method = clickhouse.CompressionZSTD
+	default:
+		return nil, fmt.Errorf("unknown ClickHouse compression: %s", c.ClickHouseCompression)
+	}
 
-	ctx := context.Background()
-	for _, entry := range data {
-		// _, err := db.Exec(query, entry.Date, entry.ProjectID, entry.Transactions, entry.TotalVolumeUSD)
-		_, err := db.Query(ctx, query, entry.Date, entry.ProjectID, entry.Transactions, entry.TotalVolumeUSD)
+	options := &clickhouse.Options{
+		Addr:             addrs,
+		ConnOpenStrategy: clickhouse.ConnOpenInOrder,
+		Auth: clickhouse.Auth{
+			Database: c.ClickHouseDatabase,
+			Username: c.ClickHouseUser,
+			Password: c.ClickHousePassword,
+		},
+		ClientInfo: clickhouse.ClientInfo{
+			Products: []struct {
+				Name    string
+				Version string
+			}{
+				{Name: "clickhouse-go-client", Version: "0.1"},
+			},
+		},
+		Compression: compression,
+		DialTimeout: c.ClickHouseDialTimeout,
+		ReadTimeout: c.ClickHouseReadTimeout,
+
+		Debugf: func(format string, v ...interface{}) {
+			slog.Debug(fmt.Sprintf(format, v...))
+		},
+	}
+
+	if c.ClickHouseTLS {
+		tlsConfig, err := c.clickHouseTLSConfig()
 		if err != nil {
-			return fmt.Errorf("failed to insert data: %w", err)
+			return nil, err
 		}
+		options.TLS = tlsConfig
 	}
 
-	return nil
+	return options, nil
 }
 
-func connect(host, password string) (driver.Conn, error) {
-	var (
-		ctx       = context.Background()
-		conn, err = clickhouse.Open(&clickhouse.Options{
-			Addr: []string{fmt.Sprintf("%s:9440", host)},
-			Auth: clickhouse.Auth{
-				Database: "analytics",
-				Username: "default",
-				Password: password,
-			},
-			ClientInfo: clickhouse.ClientInfo{
-				Products: []struct {
-					Name    string
-					Version string
-				}{
-					{Name: "clickhouse-go-client", Version: "0.1"},
-				},
-			},
+func (c *Config) clickHouseTLSConfig() (*tls.Config, error) {
+	// Skipping verification is opt-in, e.g. for self-signed test servers.
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: c.ClickHouseInsecureSkipVerify,
+	}
 
-			Debugf: func(format string, v ...interface{}) {
-				fmt.Printf(format, v)
-			},
-			TLS: &tls.Config{
-				InsecureSkipVerify: true,
-			},
-		})
-	)
+	if c.ClickHouseCAFile != "" {
+		caCert, err := os.ReadFile(c.ClickHouseCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ClickHouse CA bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no certificates found in ClickHouse CA bundle %s", c.ClickHouseCAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if c.ClickHouseCertFile != "" || c.ClickHouseKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.ClickHouseCertFile, c.ClickHouseKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load ClickHouse client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// ClickHouseRetryPolicy returns the retry policy for ClickHouse operations.
+func (c *Config) ClickHouseRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    c.ClickHouseMaxRetries + 1,
+		InitialBackoff: c.ClickHouseRetryBackoff,
+		MaxBackoff:     c.ClickHouseRetryMaxBackoff,
+	}
+}
 
+// Connect opens a ClickHouse connection and verifies it with a ping.
+func Connect(ctx context.Context, options *clickhouse.Options) (driver.Conn, error) {
+	conn, err := clickhouse.Open(options)
 	if err != nil {
 		return nil, err
 	}
 
 	if err := conn.Ping(ctx); err != nil {
+		conn.Close()
 		if exception, ok := err.(*clickhouse.Exception); ok {
-			fmt.Printf("Exception [%d] %s \n%s\n", exception.Code, exception.Message, exception.StackTrace)
+			slog.Debug("ClickHouse exception",
+				slog.Int("code", int(exception.Code)),
+				slog.String("message", exception.Message),
+				slog.String("stackTrace", exception.StackTrace),
+			)
 		}
 		return nil, err
 	}
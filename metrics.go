@@ -0,0 +1,122 @@
+package chaindataagg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// MetricsRegistry holds the pipeline metrics.
+var MetricsRegistry = prometheus.NewRegistry()
+
+var (
+	rowsIn = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "chaindataagg",
+		Name:      "rows_in_total",
+		Help:      "Rows read by a pipeline stage.",
+	}, []string{"stage"})
+	rowsRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "chaindataagg",
+		Name:      "rows_rejected_total",
+		Help:      "Rows rejected or skipped by a pipeline stage.",
+	}, []string{"stage"})
+	groupsOut = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "chaindataagg",
+		Name:      "groups_out_total",
+		Help:      "Aggregated rows produced by the transform stage.",
+	})
+	rowsLoaded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "chaindataagg",
+		Name:      "rows_loaded_total",
+		Help:      "Rows written to a load destination.",
+	}, []string{"destination"})
+	stageDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "chaindataagg",
+		Name:      "stage_duration_seconds",
+		Help:      "Duration of a pipeline stage.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 4, 10),
+	}, []string{"stage"})
+	priceRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "chaindataagg",
+		Name:      "price_requests_total",
+		Help:      "HTTP requests to the price provider by status code.",
+	}, []string{"status"})
+	priceRateLimitRetries = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "chaindataagg",
+		Name:      "price_rate_limit_retries_total",
+		Help:      "Price provider requests retried after a 429 response.",
+	})
+)
+
+func init() {
+	MetricsRegistry.MustRegister(
+		rowsIn,
+		rowsRejected,
+		groupsOut,
+		rowsLoaded,
+		stageDuration,
+		priceRequests,
+		priceRateLimitRetries,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// observeStage records the duration of a stage started at start.
+func observeStage(stage string, start time.Time) {
+	stageDuration.WithLabelValues(stage).Observe(time.Since(start).Seconds())
+}
+
+// recordPriceRequest counts a price provider response.
+func recordPriceRequest(status int) {
+	priceRequests.WithLabelValues(strconv.Itoa(status)).Inc()
+}
+
+// StartMetrics serves the metrics on cfg.MetricsAddr, if set. The returned
+// function pushes the metrics of the job and command to the Pushgateway at
+// cfg.MetricsPushURL, if set, and stops the listener; batch jobs call it when
+// they finish.
+func StartMetrics(cfg *Config, job, command string) (func() error, error) {
+	var server *http.Server
+	if cfg.MetricsAddr != "" {
+		listener, err := net.Listen("tcp", cfg.MetricsAddr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen for metrics: %w", err)
+		}
+
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.HandlerFor(MetricsRegistry, promhttp.HandlerOpts{}))
+		server = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+		go func() {
+			if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("Metrics listener failed", slog.String("error", err.Error()))
+			}
+		}()
+	}
+
+	return func() error {
+		var errs []error
+		if cfg.MetricsPushURL != "" {
+			pusher := push.New(cfg.MetricsPushURL, job).Gatherer(MetricsRegistry).Grouping("command", command)
+			if err := pusher.Push(); err != nil {
+				errs = append(errs, fmt.Errorf("failed to push metrics: %w", err))
+			}
+		}
+		if server != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			errs = append(errs, server.Shutdown(ctx))
+		}
+		return errors.Join(errs...)
+	}, nil
+}
@@ -0,0 +1,87 @@
+package chaindataagg_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	chaindataagg "github.com/atkachyshyn/chain-data-agg"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+const metricsSample = `"app","ts","event","project_id","source","ident","user_id","session_id","country","device_type","device_os","device_os_ver","device_browser","device_browser_ver","props","nums"
+"seq-market","2024-04-15 02:15:07.167","BUY_ITEMS","4974","","1","0896ae95dcaeee38e83fa5c43bef99780d7b2be23bcab36214","5d8afd8fec2fbf3e","DE","desktop","linux","x86_64","chrome","122.0.0.0","{""tokenId"":""215"",""txnHash"":""0xd919"",""chainId"":""137"",""collectionAddress"":""0x22d5"",""currencyAddress"":""0xd1f9"",""currencySymbol"":""SFL"",""marketplaceType"":""amm"",""requestId"":""""}","{""currencyValueDecimal"":""0.6136203411678249"",""currencyValueRaw"":""613620341167824900""}"
+"seq-market","2024-04-15 02:15:07.167","BUY_ITEMS","4974","","1","0896ae95dcaeee38e83fa5c43bef99780d7b2be23bcab36214","5d8afd8fec2fbf3e","DE","desktop","linux","x86_64","chrome","122.0.0.0","{""tokenId"":""215"",""txnHash"":""0xd919"",""chainId"":""137"",""collectionAddress"":""0x22d5"",""currencyAddress"":""0xd1f9"",""currencySymbol"":""SFL"",""marketplaceType"":""amm"",""requestId"":""""}","{""currencyValueDecimal"":""n/a"",""currencyValueRaw"":""613620341167824900""}"`
+
+func TestExtractMetrics(t *testing.T) {
+	_, summary, err := chaindataagg.ExtractWithSummary(context.Background(), []byte(metricsSample), 2)
+	require.NoError(t, err)
+	require.Equal(t, 1, summary.Rejected)
+
+	families, err := chaindataagg.MetricsRegistry.Gather()
+	require.NoError(t, err)
+	values := make(map[string]float64)
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "stage" && label.GetValue() == "extract" && metric.GetCounter() != nil {
+					values[family.GetName()] = metric.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	require.GreaterOrEqual(t, values["chaindataagg_rows_in_total"], 2.0)
+	require.GreaterOrEqual(t, values["chaindataagg_rows_rejected_total"], 1.0)
+
+	durations, err := testutil.GatherAndCount(chaindataagg.MetricsRegistry, "chaindataagg_stage_duration_seconds")
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, durations, 1)
+}
+
+func TestStartMetrics(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		pushed string
+		body   string
+	)
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		pushed, body = r.URL.Path, string(content)
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer gateway.Close()
+
+	// Reserve a free port for the metrics listener.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := listener.Addr().String()
+	require.NoError(t, listener.Close())
+
+	cfg := &chaindataagg.Config{MetricsAddr: addr, MetricsPushURL: gateway.URL}
+	stop, err := chaindataagg.StartMetrics(cfg, "aggregator", "transform")
+	require.NoError(t, err)
+
+	resp, err := http.Get("http://" + addr + "/metrics")
+	require.NoError(t, err)
+	content, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Contains(t, string(content), "go_goroutines")
+
+	require.NoError(t, stop())
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, "/metrics/job/aggregator/command/transform", pushed)
+	require.NotEmpty(t, body)
+
+	_, err = http.Get("http://" + addr + "/metrics")
+	require.Error(t, err)
+}
@@ -0,0 +1,342 @@
+package chaindataagg
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+var migrationFileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Migration is a numbered schema change with its up and down statements.
+type Migration struct {
+	Version int
+	Name    string
+	Up      []string
+	Down    []string
+}
+
+// MigrationStatus reports whether a migration has been applied.
+type MigrationStatus struct {
+	Version int
+	Name    string
+	Applied bool
+}
+
+// MigrationStore executes schema statements and records applied migrations.
+// AppliedVersions must not fail when Init has not run yet.
+type MigrationStore interface {
+	Init(ctx context.Context) error
+	Exec(ctx context.Context, statement string) error
+	AppliedVersions(ctx context.Context) ([]int, error)
+	SetApplied(ctx context.Context, migration Migration, applied bool) error
+}
+
+// Migrations returns the embedded migrations ordered by version.
+func Migrations() ([]Migration, error) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migrations: %w", err)
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		match := migrationFileName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("invalid migration file name: %s", entry.Name())
+		}
+		version, _ := strconv.Atoi(match[1])
+
+		data, err := migrationFiles.ReadFile(path.Join("migrations", entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migration %s: %w", entry.Name(), err)
+		}
+
+		migration, exists := byVersion[version]
+		if !exists {
+			migration = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = migration
+		} else if migration.Name != match[2] {
+			return nil, fmt.Errorf("conflicting names for migration %d: %s and %s", version, migration.Name, match[2])
+		}
+
+		if match[3] == "up" {
+			migration.Up = splitStatements(string(data))
+		} else {
+			migration.Down = splitStatements(string(data))
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if len(migration.Up) == 0 || len(migration.Down) == 0 {
+			return nil, fmt.Errorf("migration %d must have up and down statements", migration.Version)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+// splitStatements splits a SQL script into statements, dropping comment lines.
+func splitStatements(script string) []string {
+	var lines []string
+	for _, line := range strings.Split(script, "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), "--") {
+			lines = append(lines, line)
+		}
+	}
+
+	var statements []string
+	for _, statement := range strings.Split(strings.Join(lines, "\n"), ";") {
+		if statement = strings.TrimSpace(statement); statement != "" {
+			statements = append(statements, statement)
+		}
+	}
+	return statements
+}
+
+// Migrator applies and reverts the embedded migrations.
+type Migrator struct {
+	store      MigrationStore
+	migrations []Migration
+}
+
+// NewMigrator constructs new migrator.
+func NewMigrator(store MigrationStore) (*Migrator, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{store: store, migrations: migrations}, nil
+}
+
+// Status lists all migrations and whether they have been applied.
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	applied, err := m.appliedVersions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, 0, len(m.migrations))
+	for _, migration := range m.migrations {
+		statuses = append(statuses, MigrationStatus{
+			Version: migration.Version,
+			Name:    migration.Name,
+			Applied: applied[migration.Version],
+		})
+	}
+	return statuses, nil
+}
+
+// PlanUp returns the pending migrations Up would apply, at most steps of
+// them if steps is positive. Planning changes nothing.
+func (m *Migrator) PlanUp(ctx context.Context, steps int) ([]Migration, error) {
+	applied, err := m.appliedVersions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var plan []Migration
+	for _, migration := range m.migrations {
+		if applied[migration.Version] {
+			continue
+		}
+		if steps > 0 && len(plan) == steps {
+			break
+		}
+		plan = append(plan, migration)
+	}
+	return plan, nil
+}
+
+// Up applies pending migrations in order, at most steps of them if steps is
+// positive.
+func (m *Migrator) Up(ctx context.Context, steps int) ([]Migration, error) {
+	if err := m.init(ctx); err != nil {
+		return nil, err
+	}
+	plan, err := m.PlanUp(ctx, steps)
+	if err != nil {
+		return nil, err
+	}
+
+	var done []Migration
+	for _, migration := range plan {
+		for _, statement := range migration.Up {
+			if err := m.store.Exec(ctx, statement); err != nil {
+				return done, fmt.Errorf("migration %d_%s failed: %w", migration.Version, migration.Name, err)
+			}
+		}
+		if err := m.store.SetApplied(ctx, migration, true); err != nil {
+			return done, err
+		}
+		done = append(done, migration)
+	}
+	return done, nil
+}
+
+// PlanDown returns the applied migrations Down would revert in reverse
+// order, at most steps of them if steps is positive. Planning changes nothing.
+func (m *Migrator) PlanDown(ctx context.Context, steps int) ([]Migration, error) {
+	applied, err := m.appliedVersions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var plan []Migration
+	for i := len(m.migrations) - 1; i >= 0; i-- {
+		migration := m.migrations[i]
+		if !applied[migration.Version] {
+			continue
+		}
+		if steps > 0 && len(plan) == steps {
+			break
+		}
+		plan = append(plan, migration)
+	}
+	return plan, nil
+}
+
+// Down reverts applied migrations in reverse order, at most steps of them if
+// steps is positive.
+func (m *Migrator) Down(ctx context.Context, steps int) ([]Migration, error) {
+	if err := m.init(ctx); err != nil {
+		return nil, err
+	}
+	plan, err := m.PlanDown(ctx, steps)
+	if err != nil {
+		return nil, err
+	}
+
+	var done []Migration
+	for _, migration := range plan {
+		for _, statement := range migration.Down {
+			if err := m.store.Exec(ctx, statement); err != nil {
+				return done, fmt.Errorf("migration %d_%s rollback failed: %w", migration.Version, migration.Name, err)
+			}
+		}
+		if err := m.store.SetApplied(ctx, migration, false); err != nil {
+			return done, err
+		}
+		done = append(done, migration)
+	}
+	return done, nil
+}
+
+// CheckSchema returns an error when migrations are pending.
+func (m *Migrator) CheckSchema(ctx context.Context) error {
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		return err
+	}
+
+	var pending []string
+	for _, status := range statuses {
+		if !status.Applied {
+			pending = append(pending, fmt.Sprintf("%d_%s", status.Version, status.Name))
+		}
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("schema is behind, pending migrations: %v (run `aggregator migrate up`)", pending)
+	}
+	return nil
+}
+
+// init creates the migrations table. Only Up and Down run it, reading the
+// status changes nothing.
+func (m *Migrator) init(ctx context.Context) error {
+	if err := m.store.Init(ctx); err != nil {
+		return fmt.Errorf("failed to initialize migrations table: %w", err)
+	}
+	return nil
+}
+
+// appliedVersions returns the applied migrations by version without creating
+// the migrations table.
+func (m *Migrator) appliedVersions(ctx context.Context) (map[int]bool, error) {
+	versions, err := m.store.AppliedVersions(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read applied migrations: %w", err)
+	}
+
+	applied := make(map[int]bool, len(versions))
+	for _, version := range versions {
+		applied[version] = true
+	}
+	return applied, nil
+}
+
+// clickHouseMigrationStore tracks migrations in the schema_migrations table.
+// Rows are never updated: the latest row per version wins.
+type clickHouseMigrationStore struct {
+	conn driver.Conn
+}
+
+// NewClickHouseMigrationStore constructs new ClickHouse migration store.
+func NewClickHouseMigrationStore(conn driver.Conn) MigrationStore {
+	return &clickHouseMigrationStore{conn: conn}
+}
+
+func (s *clickHouseMigrationStore) Init(ctx context.Context) error {
+	return s.conn.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version UInt32,
+			name String,
+			applied UInt8,
+			updated_at DateTime64(3)
+		)
+		ENGINE = ReplacingMergeTree(updated_at)
+		ORDER BY version
+	`)
+}
+
+func (s *clickHouseMigrationStore) Exec(ctx context.Context, statement string) error {
+	return s.conn.Exec(ctx, statement)
+}
+
+// AppliedVersions returns no versions if the migrations table does not exist
+// yet.
+func (s *clickHouseMigrationStore) AppliedVersions(ctx context.Context) ([]int, error) {
+	var exists uint8
+	if err := s.conn.QueryRow(ctx, `EXISTS TABLE schema_migrations`).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if exists == 0 {
+		return nil, nil
+	}
+
+	var rows []struct {
+		Version uint32 `ch:"version"`
+	}
+	if err := s.conn.Select(ctx, &rows, `SELECT version FROM schema_migrations FINAL WHERE applied = 1 ORDER BY version`); err != nil {
+		return nil, err
+	}
+
+	versions := make([]int, 0, len(rows))
+	for _, row := range rows {
+		versions = append(versions, int(row.Version))
+	}
+	return versions, nil
+}
+
+func (s *clickHouseMigrationStore) SetApplied(ctx context.Context, migration Migration, applied bool) error {
+	return s.conn.Exec(ctx,
+		`INSERT INTO schema_migrations (version, name, applied, updated_at) VALUES (?, ?, ?, ?)`,
+		uint32(migration.Version), migration.Name, applied, time.Now(),
+	)
+}
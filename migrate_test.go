@@ -0,0 +1,152 @@
+package chaindataagg_test
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+
+	chaindataagg "github.com/atkachyshyn/chain-data-agg"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeMigrationStore struct {
+	applied    map[int]bool
+	statements []string
+	inits      int
+}
+
+func newFakeMigrationStore() *fakeMigrationStore {
+	return &fakeMigrationStore{applied: make(map[int]bool)}
+}
+
+func (s *fakeMigrationStore) Init(ctx context.Context) error {
+	s.inits++
+	return nil
+}
+
+func (s *fakeMigrationStore) Exec(ctx context.Context, statement string) error {
+	s.statements = append(s.statements, statement)
+	return nil
+}
+
+func (s *fakeMigrationStore) AppliedVersions(ctx context.Context) ([]int, error) {
+	var versions []int
+	for version, applied := range s.applied {
+		if applied {
+			versions = append(versions, version)
+		}
+	}
+	sort.Ints(versions)
+	return versions, nil
+}
+
+func (s *fakeMigrationStore) SetApplied(ctx context.Context, migration chaindataagg.Migration, applied bool) error {
+	s.applied[migration.Version] = applied
+	return nil
+}
+
+func TestMigrations(t *testing.T) {
+	migrations, err := chaindataagg.Migrations()
+	require.NoError(t, err)
+	require.NotEmpty(t, migrations)
+
+	for i, migration := range migrations {
+		require.Equal(t, i+1, migration.Version, "migrations must be numbered without gaps")
+		require.NotEmpty(t, migration.Up)
+		require.NotEmpty(t, migration.Down)
+	}
+	require.Equal(t, "create_marketplace_analytics", migrations[0].Name)
+}
+
+func TestMigrator(t *testing.T) {
+	ctx := context.Background()
+	migrations, err := chaindataagg.Migrations()
+	require.NoError(t, err)
+
+	store := newFakeMigrationStore()
+	migrator, err := chaindataagg.NewMigrator(store)
+	require.NoError(t, err)
+
+	require.ErrorContains(t, migrator.CheckSchema(ctx), "schema is behind")
+	_, err = migrator.Status(ctx)
+	require.NoError(t, err)
+	require.Zero(t, store.inits, "reading the status must not create the migrations table")
+
+	applied, err := migrator.Up(ctx, 1)
+	require.NoError(t, err)
+	require.Len(t, applied, 1)
+	require.Equal(t, migrations[0].Up, store.statements)
+
+	applied, err = migrator.Up(ctx, 0)
+	require.NoError(t, err)
+	require.Len(t, applied, len(migrations)-1)
+	require.NoError(t, migrator.CheckSchema(ctx))
+
+	statuses, err := migrator.Status(ctx)
+	require.NoError(t, err)
+	for _, status := range statuses {
+		require.True(t, status.Applied)
+	}
+
+	reverted, err := migrator.Down(ctx, 1)
+	require.NoError(t, err)
+	require.Len(t, reverted, 1)
+	require.Equal(t, migrations[len(migrations)-1].Version, reverted[0].Version)
+	require.Error(t, migrator.CheckSchema(ctx))
+}
+
+func TestRollupMigrationBackfills(t *testing.T) {
+	migrations, err := chaindataagg.Migrations()
+	require.NoError(t, err)
+
+	var rollups *chaindataagg.Migration
+	for i := range migrations {
+		if migrations[i].Name == "create_rollups" {
+			rollups = &migrations[i]
+		}
+	}
+	require.NotNil(t, rollups)
+
+	// Each rollup is backfilled after its materialized view exists, so rows
+	// are not lost between the backfill and the first insert through the view,
+	// and emptied right before, so a re-run does not count rows twice.
+	index := func(prefix string) int {
+		for i, statement := range rollups.Up {
+			if strings.HasPrefix(statement, prefix) {
+				return i
+			}
+		}
+		return -1
+	}
+	for _, rollup := range []string{"daily", "monthly"} {
+		view := index("CREATE MATERIALIZED VIEW IF NOT EXISTS marketplace_analytics_" + rollup + "_mv")
+		backfill := index("INSERT INTO marketplace_analytics_" + rollup + "_agg")
+		truncate := index("TRUNCATE TABLE IF EXISTS marketplace_analytics_" + rollup + "_agg")
+		require.GreaterOrEqual(t, view, 0, rollup)
+		require.Greater(t, truncate, view, rollup)
+		require.Greater(t, backfill, truncate, rollup)
+	}
+	require.Len(t, rollups.Down, 7)
+}
+
+func TestMigratorPlan(t *testing.T) {
+	ctx := context.Background()
+	store := newFakeMigrationStore()
+	migrator, err := chaindataagg.NewMigrator(store)
+	require.NoError(t, err)
+
+	plan, err := migrator.PlanUp(ctx, 2)
+	require.NoError(t, err)
+	require.Len(t, plan, 2)
+	require.Equal(t, 1, plan[0].Version)
+	require.Empty(t, store.statements, "planning must not execute statements")
+	require.Zero(t, store.inits, "planning must not create the migrations table")
+
+	_, err = migrator.Up(ctx, 2)
+	require.NoError(t, err)
+	plan, err = migrator.PlanDown(ctx, 0)
+	require.NoError(t, err)
+	require.Len(t, plan, 2)
+	require.Equal(t, 2, plan[0].Version)
+}
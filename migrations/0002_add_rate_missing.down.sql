@@ -0,0 +1,3 @@
+ALTER TABLE marketplace_analytics DROP COLUMN IF EXISTS rate_missing;
+ALTER TABLE marketplace_analytics UPDATE total_volume_usd = 0 WHERE total_volume_usd IS NULL SETTINGS mutations_sync = 1;
+ALTER TABLE marketplace_analytics MODIFY COLUMN total_volume_usd Float64;
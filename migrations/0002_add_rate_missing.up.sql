@@ -0,0 +1,2 @@
+ALTER TABLE marketplace_analytics MODIFY COLUMN total_volume_usd Nullable(Float64);
+ALTER TABLE marketplace_analytics ADD COLUMN IF NOT EXISTS rate_missing UInt8 DEFAULT 0;
@@ -0,0 +1 @@
+ALTER TABLE marketplace_analytics DROP COLUMN IF EXISTS volumes;
@@ -0,0 +1 @@
+ALTER TABLE marketplace_analytics ADD COLUMN IF NOT EXISTS volumes Map(LowCardinality(String), Float64);
@@ -0,0 +1 @@
+ALTER TABLE marketplace_analytics RESET SETTING non_replicated_deduplication_window;
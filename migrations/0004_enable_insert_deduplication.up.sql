@@ -0,0 +1,3 @@
+-- Deduplicate inserts carrying the same insert_deduplication_token, so a
+-- retried or repeated batch is not inserted twice.
+ALTER TABLE marketplace_analytics MODIFY SETTING non_replicated_deduplication_window = 1000;
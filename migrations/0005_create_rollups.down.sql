@@ -0,0 +1,7 @@
+DROP VIEW IF EXISTS marketplace_analytics_rolling;
+DROP VIEW IF EXISTS marketplace_analytics_top_projects;
+DROP VIEW IF EXISTS marketplace_analytics_monthly;
+DROP VIEW IF EXISTS marketplace_analytics_monthly_mv;
+DROP TABLE IF EXISTS marketplace_analytics_monthly_agg;
+DROP VIEW IF EXISTS marketplace_analytics_daily_mv;
+DROP TABLE IF EXISTS marketplace_analytics_daily_agg;
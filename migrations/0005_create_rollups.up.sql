@@ -0,0 +1,110 @@
+-- Daily and monthly rollups of marketplace_analytics, maintained by
+-- materialized views on every insert.
+CREATE TABLE IF NOT EXISTS marketplace_analytics_daily_agg (
+    date Date,
+    project_id String,
+    rows AggregateFunction(count),
+    transactions AggregateFunction(sum, UInt32),
+    volume_usd AggregateFunction(sum, Float64)
+)
+ENGINE = AggregatingMergeTree()
+PARTITION BY toYYYYMM(date)
+ORDER BY (date, project_id);
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS marketplace_analytics_daily_mv
+TO marketplace_analytics_daily_agg
+AS SELECT
+    date,
+    project_id,
+    countState() AS rows,
+    sumState(transactions) AS transactions,
+    sumState(ifNull(total_volume_usd, 0)) AS volume_usd
+FROM marketplace_analytics
+GROUP BY date, project_id;
+
+CREATE TABLE IF NOT EXISTS marketplace_analytics_monthly_agg (
+    month Date,
+    project_id String,
+    rows AggregateFunction(count),
+    transactions AggregateFunction(sum, UInt32),
+    volume_usd AggregateFunction(sum, Float64)
+)
+ENGINE = AggregatingMergeTree()
+ORDER BY (month, project_id);
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS marketplace_analytics_monthly_mv
+TO marketplace_analytics_monthly_agg
+AS SELECT
+    toStartOfMonth(date) AS month,
+    project_id,
+    countState() AS rows,
+    sumState(transactions) AS transactions,
+    sumState(ifNull(total_volume_usd, 0)) AS volume_usd
+FROM marketplace_analytics
+GROUP BY month, project_id;
+
+-- Backfill the rollups with the rows loaded before the views existed. The
+-- rollups are emptied first so a re-run after a partial failure does not
+-- count rows twice; loads refuse to run while this migration is pending, so
+-- the views insert nothing in between.
+TRUNCATE TABLE IF EXISTS marketplace_analytics_daily_agg;
+
+TRUNCATE TABLE IF EXISTS marketplace_analytics_monthly_agg;
+
+INSERT INTO marketplace_analytics_daily_agg
+SELECT
+    date,
+    project_id,
+    countState(),
+    sumState(transactions),
+    sumState(ifNull(total_volume_usd, 0))
+FROM marketplace_analytics
+GROUP BY date, project_id;
+
+INSERT INTO marketplace_analytics_monthly_agg
+SELECT
+    toStartOfMonth(date),
+    project_id,
+    countState(),
+    sumState(transactions),
+    sumState(ifNull(total_volume_usd, 0))
+FROM marketplace_analytics
+GROUP BY toStartOfMonth(date), project_id;
+
+-- Query-ready views over the rollups.
+CREATE VIEW IF NOT EXISTS marketplace_analytics_monthly AS
+SELECT
+    month,
+    project_id,
+    countMerge(rows) AS rows,
+    sumMerge(transactions) AS transactions,
+    sumMerge(volume_usd) AS volume_usd
+FROM marketplace_analytics_monthly_agg
+GROUP BY month, project_id;
+
+CREATE VIEW IF NOT EXISTS marketplace_analytics_top_projects AS
+SELECT
+    month,
+    project_id,
+    transactions,
+    volume_usd,
+    row_number() OVER (PARTITION BY month ORDER BY volume_usd DESC, project_id) AS rank
+FROM marketplace_analytics_monthly;
+
+CREATE VIEW IF NOT EXISTS marketplace_analytics_rolling AS
+SELECT
+    date,
+    project_id,
+    transactions,
+    volume_usd,
+    sum(volume_usd) OVER (PARTITION BY project_id ORDER BY toUInt32(date) RANGE BETWEEN 6 PRECEDING AND CURRENT ROW) AS volume_usd_7d,
+    sum(volume_usd) OVER (PARTITION BY project_id ORDER BY toUInt32(date) RANGE BETWEEN 29 PRECEDING AND CURRENT ROW) AS volume_usd_30d
+FROM (
+    SELECT
+        date,
+        project_id,
+        sumMerge(transactions) AS transactions,
+        sumMerge(volume_usd) AS volume_usd
+    FROM marketplace_analytics_daily_agg
+    GROUP BY date, project_id
+);
@@ -0,0 +1,15 @@
+-- Run records of the aggregator and token-prices commands. Rows are never
+-- updated: the latest row per run wins.
+CREATE TABLE IF NOT EXISTS pipeline_runs (
+    id String,
+    command LowCardinality(String),
+    status LowCardinality(String),
+    started_at DateTime64(3, 'UTC'),
+    ended_at Nullable(DateTime64(3, 'UTC')),
+    error String,
+    record String,
+    updated_at DateTime64(3, 'UTC')
+)
+ENGINE = ReplacingMergeTree(updated_at)
+PARTITION BY toYYYYMM(started_at)
+ORDER BY id;
@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS pipeline_lineage;
+ALTER TABLE marketplace_analytics DROP COLUMN IF EXISTS price_snapshot_generation;
+ALTER TABLE marketplace_analytics DROP COLUMN IF EXISTS price_snapshot_uri;
+ALTER TABLE marketplace_analytics DROP COLUMN IF EXISTS source_generation;
+ALTER TABLE marketplace_analytics DROP COLUMN IF EXISTS source_uri;
+ALTER TABLE marketplace_analytics DROP COLUMN IF EXISTS run_id;
@@ -0,0 +1,18 @@
+-- Lineage of the loaded rows: the transform run that computed them, its
+-- source object and its price snapshot, with their GCS generations.
+ALTER TABLE marketplace_analytics ADD COLUMN IF NOT EXISTS run_id String DEFAULT '';
+ALTER TABLE marketplace_analytics ADD COLUMN IF NOT EXISTS source_uri String DEFAULT '';
+ALTER TABLE marketplace_analytics ADD COLUMN IF NOT EXISTS source_generation Int64 DEFAULT 0;
+ALTER TABLE marketplace_analytics ADD COLUMN IF NOT EXISTS price_snapshot_uri String DEFAULT '';
+ALTER TABLE marketplace_analytics ADD COLUMN IF NOT EXISTS price_snapshot_generation Int64 DEFAULT 0;
+
+-- Inputs of the transform runs, recorded when their rows are loaded.
+CREATE TABLE IF NOT EXISTS pipeline_lineage (
+    run_id String,
+    role LowCardinality(String),
+    uri String,
+    generation Int64,
+    recorded_at DateTime64(3) DEFAULT now64(3)
+)
+ENGINE = ReplacingMergeTree(recorded_at)
+ORDER BY (run_id, role, uri, generation);
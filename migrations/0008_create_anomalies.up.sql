@@ -0,0 +1,17 @@
+-- Daily project volumes flagged by the anomaly check of transform runs. A day
+-- checked again keeps the latest result.
+CREATE TABLE IF NOT EXISTS marketplace_analytics_anomalies (
+    date Date,
+    project_id String,
+    volume_usd Float64,
+    baseline Float64,
+    spread Float64,
+    score Float64,
+    method LowCardinality(String),
+    history_days UInt32,
+    run_id String,
+    detected_at DateTime64(3) DEFAULT now64(3)
+)
+ENGINE = ReplacingMergeTree(detected_at)
+PARTITION BY toYYYYMM(date)
+ORDER BY (date, project_id);
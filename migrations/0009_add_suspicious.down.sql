@@ -0,0 +1,2 @@
+ALTER TABLE marketplace_analytics DROP COLUMN IF EXISTS suspicious_volume_usd;
+ALTER TABLE marketplace_analytics DROP COLUMN IF EXISTS suspicious_transactions;
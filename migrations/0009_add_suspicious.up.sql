@@ -0,0 +1,3 @@
+-- Part of the rows tagged as possible wash trades by transform runs.
+ALTER TABLE marketplace_analytics ADD COLUMN IF NOT EXISTS suspicious_transactions UInt32 DEFAULT 0;
+ALTER TABLE marketplace_analytics ADD COLUMN IF NOT EXISTS suspicious_volume_usd Float64 DEFAULT 0;
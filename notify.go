@@ -0,0 +1,225 @@
+package chaindataagg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Notification kinds.
+const (
+	NotifyStageFailed            = "stage_failed"
+	NotifyErrorRate              = "error_rate"
+	NotifyMissingRates           = "missing_rates"
+	NotifyReconciliationMismatch = "reconciliation_mismatch"
+	NotifyAnomalies              = "anomalies"
+)
+
+// Notification reports a failure or an anomaly of a run.
+type Notification struct {
+	Kind    string         `json:"kind"`
+	RunID   string         `json:"run_id,omitempty"`
+	Command string         `json:"command,omitempty"`
+	Summary string         `json:"summary"`
+	Stages  []StageResult  `json:"stages,omitempty"`
+	Details map[string]any `json:"details,omitempty"`
+	Time    time.Time      `json:"time"`
+}
+
+// NewNotification constructs a notification about a run, which may be nil.
+func NewNotification(run *Run, kind, summary string, details map[string]any) Notification {
+	notification := Notification{Kind: kind, Summary: summary, Details: details, Time: time.Now().UTC()}
+	if run != nil {
+		run.mu.Lock()
+		notification.RunID = run.ID
+		notification.Command = run.Command
+		notification.Stages = append([]StageResult(nil), run.Stages...)
+		run.mu.Unlock()
+	}
+	return notification
+}
+
+// Text renders the notification as plain text.
+func (n Notification) Text() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[%s] %s\n", n.Kind, n.Summary)
+	if n.Command != "" {
+		fmt.Fprintf(&b, "Command: %s\n", n.Command)
+	}
+	if n.RunID != "" {
+		fmt.Fprintf(&b, "Run: %s\n", n.RunID)
+	}
+	for _, stage := range n.Stages {
+		fmt.Fprintf(&b, "Stage %s: %d rows in, %d out, %d rejected\n", stage.Name, stage.RowsIn, stage.RowsOut, stage.Rejected)
+	}
+	keys := make([]string, 0, len(n.Details))
+	for key := range n.Details {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(&b, "%s: %v\n", key, n.Details[key])
+	}
+	return b.String()
+}
+
+// Notifier delivers notifications.
+type Notifier interface {
+	Notify(ctx context.Context, notification Notification) error
+}
+
+// Notifiers delivers notifications to all its notifiers.
+type Notifiers []Notifier
+
+// Notify delivers the notification to every notifier, even if some fail.
+func (n Notifiers) Notify(ctx context.Context, notification Notification) error {
+	var errs []error
+	for _, notifier := range n {
+		errs = append(errs, notifier.Notify(ctx, notification))
+	}
+	return errors.Join(errs...)
+}
+
+// NewNotifiers constructs the notifiers configured in cfg, none if no
+// notifier is configured.
+func NewNotifiers(cfg *Config) Notifiers {
+	var notifiers Notifiers
+	if cfg.NotifyWebhookURL != "" {
+		notifiers = append(notifiers, NewWebhookNotifier(cfg.NotifyWebhookURL))
+	}
+	if cfg.NotifySlackWebhookURL != "" {
+		notifiers = append(notifiers, NewSlackNotifier(cfg.NotifySlackWebhookURL))
+	}
+	if cfg.NotifySMTPAddr != "" {
+		notifiers = append(notifiers, NewEmailNotifier(EmailOptions{
+			Addr:     cfg.NotifySMTPAddr,
+			Username: cfg.NotifySMTPUsername,
+			Password: cfg.NotifySMTPPassword,
+			From:     cfg.NotifyEmailFrom,
+			To:       cfg.NotifyEmailTo,
+		}))
+	}
+	return notifiers
+}
+
+// notifyTimeout bounds the delivery of a notification.
+const notifyTimeout = 10 * time.Second
+
+// webhookNotifier posts notifications as JSON.
+type webhookNotifier struct {
+	url    string
+	client *http.Client
+	// payload encodes the request body.
+	payload func(Notification) any
+}
+
+// NewWebhookNotifier constructs a notifier posting the notification as JSON.
+func NewWebhookNotifier(url string) Notifier {
+	return &webhookNotifier{
+		url:     url,
+		client:  &http.Client{Timeout: notifyTimeout, Transport: tracingTransport(http.DefaultTransport)},
+		payload: func(n Notification) any { return n },
+	}
+}
+
+// NewSlackNotifier constructs a notifier posting to a Slack incoming webhook.
+func NewSlackNotifier(url string) Notifier {
+	return &webhookNotifier{
+		url:     url,
+		client:  &http.Client{Timeout: notifyTimeout, Transport: tracingTransport(http.DefaultTransport)},
+		payload: func(n Notification) any { return map[string]string{"text": n.Text()} },
+	}
+}
+
+func (w *webhookNotifier) Notify(ctx context.Context, notification Notification) error {
+	body, err := json.Marshal(w.payload(notification))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send notification: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("failed to send notification: %s", resp.Status)
+	}
+	return nil
+}
+
+// EmailOptions configures the email notifier.
+type EmailOptions struct {
+	// Addr is the host:port of the SMTP server.
+	Addr string
+	// Username and Password authenticate with PLAIN auth, if set.
+	Username string
+	Password string
+	From     string
+	To       []string
+}
+
+// emailNotifier sends notifications by email.
+type emailNotifier struct {
+	options EmailOptions
+}
+
+// NewEmailNotifier constructs a notifier sending emails through an SMTP
+// server.
+func NewEmailNotifier(options EmailOptions) Notifier {
+	return &emailNotifier{options: options}
+}
+
+func (e *emailNotifier) Notify(ctx context.Context, notification Notification) error {
+	var auth smtp.Auth
+	if e.options.Username != "" {
+		host, _, err := net.SplitHostPort(e.options.Addr)
+		if err != nil {
+			return fmt.Errorf("invalid SMTP address: %w", err)
+		}
+		auth = smtp.PlainAuth("", e.options.Username, e.options.Password, host)
+	}
+
+	subject := fmt.Sprintf("[chaindataagg] %s: %s", notification.Kind, notification.Summary)
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", e.options.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(e.options.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", strings.ReplaceAll(subject, "\n", " "))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(notification.Text(), "\n", "\r\n"))
+
+	// smtp.SendMail does not take a context, so it is abandoned, not
+	// canceled, when ctx is done.
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(e.options.Addr, auth, e.options.From, e.options.To, msg.Bytes())
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("failed to send notification email: %w", err)
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ErrorRateExceeded reports whether rejected of total rows exceed the
+// notification error rate.
+func (c *Config) ErrorRateExceeded(rejected, total int) bool {
+	return rejected > 0 && float64(rejected) > c.NotifyErrorRate*float64(total)
+}
@@ -0,0 +1,135 @@
+package chaindataagg_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	chaindataagg "github.com/atkachyshyn/chain-data-agg"
+	"github.com/stretchr/testify/require"
+)
+
+func failedRunNotification() chaindataagg.Notification {
+	run := chaindataagg.NewRun("aggregator transform")
+	run.AddStage(chaindataagg.StageResult{Name: "transform", RowsIn: 10, RowsOut: 2, Rejected: 3})
+	return chaindataagg.NewNotification(run, chaindataagg.NotifyMissingRates, "1 currencies have no exchange rate", map[string]any{"symbols": []string{"sfl"}})
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	var received []map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodPost, r.Method)
+		require.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		var body map[string]any
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		received = append(received, body)
+	}))
+	defer server.Close()
+	notification := failedRunNotification()
+
+	require.NoError(t, chaindataagg.NewWebhookNotifier(server.URL).Notify(context.Background(), notification))
+	require.Equal(t, "missing_rates", received[0]["kind"])
+	require.Equal(t, notification.RunID, received[0]["run_id"])
+	require.Equal(t, "aggregator transform", received[0]["command"])
+	require.Len(t, received[0]["stages"], 1)
+
+	// Slack webhooks take the text of the notification.
+	require.NoError(t, chaindataagg.NewSlackNotifier(server.URL).Notify(context.Background(), notification))
+	text, ok := received[1]["text"].(string)
+	require.True(t, ok)
+	require.Contains(t, text, "[missing_rates] 1 currencies have no exchange rate")
+	require.Contains(t, text, "Run: "+notification.RunID)
+	require.Contains(t, text, "Stage transform: 10 rows in, 2 out, 3 rejected")
+	require.Contains(t, text, "symbols: [sfl]")
+}
+
+func TestWebhookNotifierError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no_service", http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	notifiers := chaindataagg.NewNotifiers(&chaindataagg.Config{NotifyWebhookURL: server.URL, NotifySlackWebhookURL: server.URL})
+	require.Len(t, notifiers, 2)
+	err := notifiers.Notify(context.Background(), failedRunNotification())
+	require.ErrorContains(t, err, "404 Not Found")
+}
+
+// smtpServer accepts a single email and sends its data on the returned
+// channel.
+func smtpServer(t *testing.T) (string, <-chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	messages := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		fmt.Fprint(conn, "220 localhost ESMTP\r\n")
+		var data strings.Builder
+		inData := false
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch {
+			case inData && line == ".\r\n":
+				inData = false
+				messages <- data.String()
+				fmt.Fprint(conn, "250 OK\r\n")
+			case inData:
+				data.WriteString(line)
+			case strings.HasPrefix(line, "EHLO"), strings.HasPrefix(line, "HELO"):
+				fmt.Fprint(conn, "250 localhost\r\n")
+			case strings.HasPrefix(line, "DATA"):
+				inData = true
+				fmt.Fprint(conn, "354 Go ahead\r\n")
+			case strings.HasPrefix(line, "QUIT"):
+				fmt.Fprint(conn, "221 Bye\r\n")
+				return
+			default:
+				fmt.Fprint(conn, "250 OK\r\n")
+			}
+		}
+	}()
+	return listener.Addr().String(), messages
+}
+
+func TestEmailNotifier(t *testing.T) {
+	addr, messages := smtpServer(t)
+	notifier := chaindataagg.NewEmailNotifier(chaindataagg.EmailOptions{
+		Addr: addr,
+		From: "pipeline@example.com",
+		To:   []string{"data@example.com", "oncall@example.com"},
+	})
+	notification := failedRunNotification()
+
+	require.NoError(t, notifier.Notify(context.Background(), notification))
+	message := <-messages
+	require.Contains(t, message, "To: data@example.com, oncall@example.com\r\n")
+	require.Contains(t, message, "Subject: [chaindataagg] missing_rates: 1 currencies have no exchange rate\r\n")
+	require.Contains(t, message, "Run: "+notification.RunID+"\r\n")
+}
+
+func TestErrorRateExceeded(t *testing.T) {
+	cfg := chaindataagg.DefaultConfig()
+	require.False(t, cfg.ErrorRateExceeded(0, 100))
+	require.False(t, cfg.ErrorRateExceeded(1, 100))
+	require.True(t, cfg.ErrorRateExceeded(2, 100))
+	require.True(t, cfg.ErrorRateExceeded(1, 1))
+
+	cfg.NotifyErrorRate = 0
+	require.True(t, cfg.ErrorRateExceeded(1, 1000))
+}
@@ -0,0 +1,204 @@
+package chaindataagg
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	// RateSourcePeg marks rates fixed by a peg rule.
+	RateSourcePeg = "peg"
+	// RateSourceUnderlying marks rates copied from an underlying token.
+	RateSourceUnderlying = "underlying"
+)
+
+// PriceRule overrides the provider price of a currency, matched by symbol or
+// by contract address. A rule either pegs the currency to a fixed USD value or
+// prices it as an underlying token.
+type PriceRule struct {
+	Symbol     string  `json:"symbol,omitempty"`
+	Address    string  `json:"address,omitempty"`
+	Peg        float64 `json:"peg,omitempty"`
+	Underlying string  `json:"underlying,omitempty"`
+}
+
+// PriceMapping is a set of price rules applied before provider lookups.
+type PriceMapping struct {
+	Rules []PriceRule `json:"rules"`
+}
+
+// ParsePriceMapping parses and validates price mapping rules from JSON.
+func ParsePriceMapping(data []byte) (*PriceMapping, error) {
+	var mapping PriceMapping
+	if err := json.Unmarshal(data, &mapping); err != nil {
+		return nil, fmt.Errorf("failed to parse price mapping: %w", err)
+	}
+	if err := mapping.Validate(); err != nil {
+		return nil, err
+	}
+	return &mapping, nil
+}
+
+// ReadPriceMapping reads price mapping rules from a JSON file.
+func ReadPriceMapping(path string) (*PriceMapping, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read price mapping: %w", err)
+	}
+	return ParsePriceMapping(data)
+}
+
+// Validate checks the rules and normalizes symbols and addresses to lower case.
+func (m *PriceMapping) Validate() error {
+	for i := range m.Rules {
+		rule := &m.Rules[i]
+		rule.Symbol = strings.ToLower(rule.Symbol)
+		rule.Address = strings.ToLower(rule.Address)
+		rule.Underlying = strings.ToLower(rule.Underlying)
+
+		if rule.Symbol == "" && rule.Address == "" {
+			return fmt.Errorf("price rule %d: symbol or address is required", i)
+		}
+		if (rule.Peg > 0) == (rule.Underlying != "") {
+			return fmt.Errorf("price rule %d: exactly one of peg or underlying is required", i)
+		}
+		if rule.Peg < 0 {
+			return fmt.Errorf("price rule %d: peg must be positive", i)
+		}
+		if rule.Underlying != "" && rule.Underlying == rule.Symbol {
+			return fmt.Errorf("price rule %d: %s cannot be its own underlying", i, rule.Symbol)
+		}
+	}
+	return nil
+}
+
+// Match returns the rule for a currency. Address rules take precedence over
+// symbol rules.
+func (m *PriceMapping) Match(symbol, address string) (PriceRule, bool) {
+	if m == nil {
+		return PriceRule{}, false
+	}
+
+	symbol = strings.ToLower(symbol)
+	address = strings.ToLower(address)
+	if address != "" {
+		for _, rule := range m.Rules {
+			if rule.Address == address {
+				return rule, true
+			}
+		}
+	}
+	for _, rule := range m.Rules {
+		if rule.Address == "" && rule.Symbol == symbol {
+			return rule, true
+		}
+	}
+	return PriceRule{}, false
+}
+
+// ProviderSymbols returns the symbols to look up with the price provider:
+// pegged symbols are dropped and wrapped symbols are replaced by their
+// underlying tokens. The underlying tokens of address rules are always looked
+// up, as the symbols of their currencies are not known in advance.
+func (m *PriceMapping) ProviderSymbols(symbols []string) []string {
+	seen := make(map[string]bool)
+	var result []string
+	add := func(symbol string) {
+		if !seen[symbol] {
+			seen[symbol] = true
+			result = append(result, symbol)
+		}
+	}
+	for _, symbol := range symbols {
+		symbol = strings.ToLower(symbol)
+		if rule, ok := m.Match(symbol, ""); ok {
+			if rule.Underlying == "" {
+				continue
+			}
+			symbol = rule.Underlying
+		}
+		add(symbol)
+	}
+	if m != nil {
+		for _, rule := range m.Rules {
+			if rule.Address != "" && rule.Underlying != "" {
+				add(rule.Underlying)
+			}
+		}
+	}
+	return result
+}
+
+// Apply sets the rates of the mapped symbols in the snapshot and records the
+// mapping in the rate metadata. Address rules are recorded under their
+// address.
+func (m *PriceMapping) Apply(snapshot *RateSnapshot, symbols []string) {
+	if snapshot.Tokens == nil {
+		snapshot.Tokens = make(map[string]RateMetadata)
+	}
+
+	for _, symbol := range symbols {
+		symbol = strings.ToLower(symbol)
+		if rule, ok := m.Match(symbol, ""); ok {
+			snapshot.applyRule(symbol, rule)
+		}
+	}
+	if m != nil {
+		for _, rule := range m.Rules {
+			if rule.Address != "" {
+				snapshot.applyRule(rule.Address, rule)
+			}
+		}
+	}
+}
+
+// applyRule sets the rate of key by a price rule.
+func (s *RateSnapshot) applyRule(key string, rule PriceRule) {
+	if rule.Peg > 0 {
+		s.Rates[key] = rule.Peg
+		s.Tokens[key] = RateMetadata{
+			LastUpdatedAt: s.FetchedAt,
+			Source:        RateSourcePeg,
+		}
+		for currency, fx := range s.FX {
+			s.setQuote(currency, key, rule.Peg*fx)
+		}
+		return
+	}
+
+	rate, ok := s.Rates[rule.Underlying]
+	if !ok {
+		return
+	}
+	s.Rates[key] = rate
+	for currency, quotes := range s.Quotes {
+		if quote, ok := quotes[rule.Underlying]; ok {
+			s.setQuote(currency, key, quote)
+		}
+	}
+	s.Tokens[key] = RateMetadata{
+		ID:            s.Tokens[rule.Underlying].ID,
+		LastUpdatedAt: s.UpdatedAt(rule.Underlying),
+		Source:        RateSourceUnderlying,
+		Underlying:    rule.Underlying,
+	}
+}
+
+// rate returns the exchange rate for a transaction currency, applying the
+// matching rule, and the symbol the rate was looked up by.
+func (m *PriceMapping) rate(symbol, address string, rates map[string]float64) (float64, string, bool) {
+	symbol = strings.ToLower(symbol)
+	rule, ok := m.Match(symbol, address)
+	if !ok {
+		rate, ok := rates[symbol]
+		return rate, symbol, ok
+	}
+
+	if rule.Peg > 0 {
+		return rule.Peg, symbol, true
+	}
+	rate, ok := rates[rule.Underlying]
+	return rate, rule.Underlying, ok
+}
@@ -0,0 +1,118 @@
+package chaindataagg_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	chaindataagg "github.com/atkachyshyn/chain-data-agg"
+	"github.com/stretchr/testify/require"
+)
+
+const priceMappingJSON = `{
+	"rules": [
+		{"symbol": "USDC", "peg": 1.0},
+		{"symbol": "weth", "underlying": "eth"},
+		{"symbol": "wmatic", "underlying": "matic"},
+		{"address": "0xD1F9C58E33933A993A3891F8ACFE05A68E1AFC05", "underlying": "matic"}
+	]
+}`
+
+func TestParsePriceMapping(t *testing.T) {
+	t.Run("valid", func(t *testing.T) {
+		mapping, err := chaindataagg.ParsePriceMapping([]byte(priceMappingJSON))
+		require.NoError(t, err)
+		require.Len(t, mapping.Rules, 4)
+		require.Equal(t, "usdc", mapping.Rules[0].Symbol)
+	})
+
+	t.Run("peg and underlying", func(t *testing.T) {
+		_, err := chaindataagg.ParsePriceMapping([]byte(`{"rules": [{"symbol": "dai", "peg": 1, "underlying": "usdc"}]}`))
+		require.ErrorContains(t, err, "exactly one of peg or underlying")
+	})
+
+	t.Run("no match key", func(t *testing.T) {
+		_, err := chaindataagg.ParsePriceMapping([]byte(`{"rules": [{"peg": 1}]}`))
+		require.ErrorContains(t, err, "symbol or address is required")
+	})
+}
+
+func TestPriceMappingProviderSymbols(t *testing.T) {
+	mapping, err := chaindataagg.ParsePriceMapping([]byte(priceMappingJSON))
+	require.NoError(t, err)
+
+	symbols := mapping.ProviderSymbols([]string{"SFL", "usdc", "weth", "eth", "wmatic"})
+	require.Equal(t, []string{"sfl", "eth", "matic"}, symbols)
+
+	var empty *chaindataagg.PriceMapping
+	require.Equal(t, []string{"sfl"}, empty.ProviderSymbols([]string{"SFL"}))
+}
+
+func TestPriceMappingApply(t *testing.T) {
+	mapping, err := chaindataagg.ParsePriceMapping([]byte(priceMappingJSON))
+	require.NoError(t, err)
+
+	fetchedAt := time.Date(2024, 4, 15, 10, 0, 0, 0, time.UTC)
+	snapshot := &chaindataagg.RateSnapshot{
+		FetchedAt: fetchedAt,
+		Rates:     map[string]float64{"eth": 3000},
+		Tokens: map[string]chaindataagg.RateMetadata{
+			"eth": {ID: "ethereum", LastUpdatedAt: fetchedAt.Add(-time.Minute), Source: chaindataagg.ProviderCoinGecko},
+		},
+	}
+	mapping.Apply(snapshot, []string{"usdc", "weth", "wmatic"})
+
+	require.Equal(t, map[string]float64{"eth": 3000, "weth": 3000, "usdc": 1}, snapshot.Rates)
+	require.Equal(t, chaindataagg.RateSourcePeg, snapshot.Tokens["usdc"].Source)
+	require.Equal(t, chaindataagg.RateMetadata{
+		ID:            "ethereum",
+		LastUpdatedAt: fetchedAt.Add(-time.Minute),
+		Source:        chaindataagg.RateSourceUnderlying,
+		Underlying:    "eth",
+	}, snapshot.Tokens["weth"])
+}
+
+func TestPriceMappingAddressRule(t *testing.T) {
+	const sfl = "0xd1f9c58e33933a993a3891f8acfe05a68e1afc05"
+	mapping, err := chaindataagg.ParsePriceMapping([]byte(`{"rules": [{"address": "0xD1F9C58E33933A993A3891F8ACFE05A68E1AFC05", "underlying": "matic"}]}`))
+	require.NoError(t, err)
+
+	// The underlying token is looked up although no symbol names it.
+	require.Equal(t, []string{"usdc", "matic"}, mapping.ProviderSymbols([]string{"usdc"}))
+
+	fetchedAt := time.Date(2024, 4, 15, 10, 0, 0, 0, time.UTC)
+	snapshot := &chaindataagg.RateSnapshot{
+		FetchedAt: fetchedAt,
+		Rates:     map[string]float64{"usdc": 1, "matic": 0.7},
+		Tokens:    map[string]chaindataagg.RateMetadata{"matic": {ID: "matic-network", LastUpdatedAt: fetchedAt}},
+	}
+	mapping.Apply(snapshot, []string{"usdc"})
+	require.Equal(t, 0.7, snapshot.Rates[sfl])
+	require.Equal(t, chaindataagg.RateSourceUnderlying, snapshot.Tokens[sfl].Source)
+
+	// The transform prices the currency of the address with the snapshot.
+	aggregated, _, err := chaindataagg.TransformWithOptions(context.Background(), []chaindataagg.Transaction{
+		{Timestamp: "2024-04-15 02:17:07.167", ProjectID: "1", CurrencySymbol: "SFL", CurrencyAddress: sfl, CurrencyValue: 100},
+	}, snapshot.Rates, chaindataagg.TransformOptions{PriceMapping: mapping})
+	require.NoError(t, err)
+	require.InDelta(t, 70, aggregated[0].TotalVolumeUSD, 1e-9)
+}
+
+func TestTransformPriceMapping(t *testing.T) {
+	mapping, err := chaindataagg.ParsePriceMapping([]byte(priceMappingJSON))
+	require.NoError(t, err)
+
+	transactions := []chaindataagg.Transaction{
+		{Timestamp: "2024-04-15 02:15:07.167", ProjectID: "1", CurrencySymbol: "USDC", CurrencyValue: 10},
+		{Timestamp: "2024-04-15 02:16:07.167", ProjectID: "1", CurrencySymbol: "WETH", CurrencyValue: 2},
+		{Timestamp: "2024-04-15 02:17:07.167", ProjectID: "1", CurrencySymbol: "SFL", CurrencyAddress: "0xd1f9c58e33933a993a3891f8acfe05a68e1afc05", CurrencyValue: 100},
+	}
+	rates := map[string]float64{"eth": 3000, "matic": 0.5, "sfl": 0.05}
+
+	aggregated, _, err := chaindataagg.TransformWithOptions(context.Background(), transactions, rates, chaindataagg.TransformOptions{
+		PriceMapping: mapping,
+	})
+	require.NoError(t, err)
+	require.Len(t, aggregated, 1)
+	require.InDelta(t, 10+6000+50, aggregated[0].TotalVolumeUSD, 1e-9)
+}
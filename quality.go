@@ -0,0 +1,302 @@
+package chaindataagg
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Expectation checks.
+const (
+	// CheckPositiveValue expects currencyValueDecimal > 0.
+	CheckPositiveValue = "positive_value"
+	// CheckTimestamp expects ts to parse and, if an expected date is set, to
+	// fall on it.
+	CheckTimestamp = "timestamp"
+	// CheckEventAllowed expects event to be one of the values.
+	CheckEventAllowed = "event_allowed"
+	// CheckProjectIDNumeric expects project_id to be a number.
+	CheckProjectIDNumeric = "project_id_numeric"
+	// CheckTxnHash expects txnHash to be a 32-byte 0x-prefixed hex string.
+	CheckTxnHash = "txn_hash"
+	// CheckRawConsistent expects currencyValueRaw scaled by the decimals of
+	// the currency to be currencyValueDecimal, within the relative tolerance.
+	CheckRawConsistent = "raw_consistent"
+)
+
+// Severity defines what a failed expectation does.
+type Severity string
+
+const (
+	// SeverityWarn reports the failures.
+	SeverityWarn Severity = "warn"
+	// SeverityError reports the failures and fails the run.
+	SeverityError Severity = "error"
+)
+
+// ExpectationsDefault selects DefaultExpectations instead of a file.
+const ExpectationsDefault = "default"
+
+// Expectation is a declarative check of every extracted transaction.
+type Expectation struct {
+	// Name identifies the expectation in the report, the check by default.
+	Name     string   `yaml:"name" json:"name"`
+	Check    string   `yaml:"check" json:"check"`
+	Severity Severity `yaml:"severity" json:"severity"`
+	// Values are the allowed values of event_allowed.
+	Values []string `yaml:"values,omitempty" json:"values,omitempty"`
+	// Tolerance is the relative tolerance of raw_consistent.
+	Tolerance float64 `yaml:"tolerance,omitempty" json:"tolerance,omitempty"`
+}
+
+// DefaultExpectations returns the expectations used without an expectations
+// file.
+func DefaultExpectations() []Expectation {
+	return []Expectation{
+		{Check: CheckPositiveValue, Severity: SeverityError},
+		{Check: CheckTimestamp, Severity: SeverityError},
+		{Check: CheckEventAllowed, Severity: SeverityError, Values: []string{EventBuyItems, EventSellItems}},
+		{Check: CheckProjectIDNumeric, Severity: SeverityWarn},
+		{Check: CheckTxnHash, Severity: SeverityWarn},
+		{Check: CheckRawConsistent, Severity: SeverityWarn, Tolerance: 1e-9},
+	}
+}
+
+// ReadExpectations reads expectations from a YAML or JSON file, or returns
+// DefaultExpectations for "default".
+func ReadExpectations(path string) ([]Expectation, error) {
+	if path == ExpectationsDefault {
+		return DefaultExpectations(), nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read expectations: %w", err)
+	}
+	var file struct {
+		Expectations []Expectation `yaml:"expectations"`
+	}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse expectations %s: %w", path, err)
+	}
+	for _, expectation := range file.Expectations {
+		if _, err := expectation.compile(QualityOptions{}, nil); err != nil {
+			return nil, fmt.Errorf("invalid expectations %s: %w", path, err)
+		}
+	}
+	return file.Expectations, nil
+}
+
+// QualityOptions configures CheckQuality.
+type QualityOptions struct {
+	// ExpectedDate is the day all transactions must fall on, if set.
+	ExpectedDate string
+	// SourceLocation and DayLocation are the time zones of the transform
+	// (UTC by default).
+	SourceLocation *time.Location
+	DayLocation    *time.Location
+	// Decimals are the known currency decimals; the decimals of other
+	// currencies are inferred.
+	Decimals *TokenDecimals
+}
+
+// maxQualityExamples is the number of failures reported per expectation.
+const maxQualityExamples = 5
+
+// QualityReport is the outcome of the expectations.
+type QualityReport struct {
+	Rows    int                 `json:"rows"`
+	Results []ExpectationResult `json:"results"`
+	// FailedRows are the rows failing an error expectation.
+	FailedRows int `json:"failed_rows"`
+	// Decimals are the currency decimals raw values were checked with.
+	Decimals []CurrencyDecimals `json:"decimals,omitempty"`
+}
+
+// ExpectationResult is the outcome of an expectation.
+type ExpectationResult struct {
+	Name     string           `json:"name"`
+	Check    string           `json:"check"`
+	Severity Severity         `json:"severity"`
+	Failed   int              `json:"failed"`
+	Examples []QualityFailure `json:"examples,omitempty"`
+}
+
+// QualityFailure identifies a transaction failing an expectation.
+type QualityFailure struct {
+	Timestamp string `json:"ts"`
+	ProjectID string `json:"project_id"`
+	TxnHash   string `json:"txn_hash,omitempty"`
+	Message   string `json:"message"`
+}
+
+// Err returns an error if an error expectation failed.
+func (r QualityReport) Err() error {
+	var failed []string
+	for _, result := range r.Results {
+		if result.Severity == SeverityError && result.Failed > 0 {
+			failed = append(failed, fmt.Sprintf("%s (%d rows)", result.Name, result.Failed))
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return fmt.Errorf("quality expectations failed: %s", strings.Join(failed, ", "))
+}
+
+// CheckQuality checks every transaction against the expectations. It marks
+// the transactions failing a raw_consistent expectation with RawMismatch.
+func CheckQuality(transactions []Transaction, expectations []Expectation, opts QualityOptions) (QualityReport, error) {
+	checks := make([]func(Transaction) string, len(expectations))
+	report := QualityReport{Rows: len(transactions), Results: make([]ExpectationResult, len(expectations))}
+	var decimals map[string]CurrencyDecimals
+	if slices.ContainsFunc(expectations, func(e Expectation) bool { return e.Check == CheckRawConsistent }) {
+		decimals = ResolveDecimals(transactions, opts.Decimals)
+		for _, currency := range decimals {
+			report.Decimals = append(report.Decimals, currency)
+		}
+		sort.Slice(report.Decimals, func(i, j int) bool {
+			if report.Decimals[i].Symbol != report.Decimals[j].Symbol {
+				return report.Decimals[i].Symbol < report.Decimals[j].Symbol
+			}
+			return report.Decimals[i].Address < report.Decimals[j].Address
+		})
+	}
+	for i, expectation := range expectations {
+		check, err := expectation.compile(opts, decimals)
+		if err != nil {
+			return QualityReport{}, err
+		}
+		checks[i] = check
+		report.Results[i] = ExpectationResult{Name: expectation.name(), Check: expectation.Check, Severity: expectation.severity()}
+	}
+
+	for t, tx := range transactions {
+		failedError := false
+		for i, check := range checks {
+			message := check(tx)
+			if message == "" {
+				continue
+			}
+			if expectations[i].Check == CheckRawConsistent {
+				transactions[t].RawMismatch = true
+			}
+			result := &report.Results[i]
+			result.Failed++
+			if len(result.Examples) < maxQualityExamples {
+				result.Examples = append(result.Examples, QualityFailure{Timestamp: tx.Timestamp, ProjectID: tx.ProjectID, TxnHash: tx.TxnHash, Message: message})
+			}
+			failedError = failedError || result.Severity == SeverityError
+		}
+		if failedError {
+			report.FailedRows++
+		}
+	}
+	return report, nil
+}
+
+func (e Expectation) name() string {
+	if e.Name != "" {
+		return e.Name
+	}
+	return e.Check
+}
+
+func (e Expectation) severity() Severity {
+	if e.Severity == "" {
+		return SeverityError
+	}
+	return e.Severity
+}
+
+var (
+	numericPattern = regexp.MustCompile(`^[0-9]+$`)
+	txnHashPattern = regexp.MustCompile(`^0x[0-9a-fA-F]{64}$`)
+)
+
+// compile returns the check of an expectation, which returns a message for
+// failing transactions. Raw values are checked with the decimals by currency.
+func (e Expectation) compile(opts QualityOptions, decimals map[string]CurrencyDecimals) (func(Transaction) string, error) {
+	switch e.severity() {
+	case SeverityWarn, SeverityError:
+	default:
+		return nil, fmt.Errorf("unknown severity of %s: %s", e.name(), e.Severity)
+	}
+
+	switch e.Check {
+	case CheckPositiveValue:
+		return func(tx Transaction) string {
+			if tx.CurrencyValue > 0 {
+				return ""
+			}
+			return fmt.Sprintf("currency value %g is not positive", tx.CurrencyValue)
+		}, nil
+	case CheckTimestamp:
+		dayLocation := opts.DayLocation
+		if dayLocation == nil {
+			dayLocation = time.UTC
+		}
+		return func(tx Transaction) string {
+			ts, err := tx.Time(opts.SourceLocation)
+			if err != nil {
+				return err.Error()
+			}
+			if date := ts.In(dayLocation).Format(DateFormat); opts.ExpectedDate != "" && date != opts.ExpectedDate {
+				return fmt.Sprintf("timestamp falls on %s, not %s", date, opts.ExpectedDate)
+			}
+			return ""
+		}, nil
+	case CheckEventAllowed:
+		if len(e.Values) == 0 {
+			return nil, fmt.Errorf("%s has no allowed values", e.name())
+		}
+		return func(tx Transaction) string {
+			if slices.Contains(e.Values, tx.Event) {
+				return ""
+			}
+			return fmt.Sprintf("event %q is not allowed", tx.Event)
+		}, nil
+	case CheckProjectIDNumeric:
+		return func(tx Transaction) string {
+			if numericPattern.MatchString(tx.ProjectID) {
+				return ""
+			}
+			return fmt.Sprintf("project ID %q is not numeric", tx.ProjectID)
+		}, nil
+	case CheckTxnHash:
+		return func(tx Transaction) string {
+			if txnHashPattern.MatchString(tx.TxnHash) {
+				return ""
+			}
+			return fmt.Sprintf("transaction hash %q is malformed", tx.TxnHash)
+		}, nil
+	case CheckRawConsistent:
+		if e.Tolerance < 0 {
+			return nil, fmt.Errorf("%s has a negative tolerance", e.name())
+		}
+		return func(tx Transaction) string {
+			raw, err := tx.RawValue()
+			if err != nil {
+				return err.Error()
+			}
+			currency, ok := decimals[currencyKey(tx)]
+			if !ok {
+				if raw.Sign() == 0 && tx.CurrencyValue == 0 {
+					return ""
+				}
+				return fmt.Sprintf("decimals of %s are unknown", tx.CurrencySymbol)
+			}
+			if mismatch := valueMismatch(raw, tx.CurrencyValue, currency.Decimals); mismatch > e.Tolerance {
+				return fmt.Sprintf("raw value %s with %d decimals differs from decimal value %g by %.3g", tx.CurrencyValueRaw, currency.Decimals, tx.CurrencyValue, mismatch)
+			}
+			return ""
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown check of %s: %s", e.name(), e.Check)
+	}
+}
@@ -0,0 +1,134 @@
+package chaindataagg_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	chaindataagg "github.com/atkachyshyn/chain-data-agg"
+	"github.com/stretchr/testify/require"
+)
+
+const testTxnHash = "0x0b3b8dc6a3f9ddb06e1a66aa3e8d4a9ab0d6f82c1c6a1c9e0d5d4e1c48f7b1d5"
+
+func TestCheckQuality(t *testing.T) {
+	const (
+		sfl  = "0xd1f9c58e33933a993a3891f8acfe05a68e1afc05"
+		usdc = "0x3c499c542cef5e3811e1192ce70d8cc03d5c3359"
+	)
+	transactions := []chaindataagg.Transaction{
+		{Timestamp: "2024-04-15 02:15:14.000", Event: "BUY_ITEMS", ProjectID: "4974", CurrencySymbol: "SFL", CurrencyAddress: sfl, CurrencyValue: 1.5, CurrencyValueRaw: "1500000000000000000", TxnHash: testTxnHash},
+		{Timestamp: "2024-04-15 03:00:00.000", Event: "SELL_ITEMS", ProjectID: "1660", CurrencySymbol: "USDC", CurrencyAddress: usdc, CurrencyValue: 2, CurrencyValueRaw: "2000000", TxnHash: testTxnHash},
+		// Zero value, unknown event and malformed hash.
+		{Timestamp: "2024-04-15 04:00:00.000", Event: "TRANSFER", ProjectID: "1660", CurrencySymbol: "USDC", CurrencyAddress: usdc, CurrencyValue: 0, CurrencyValueRaw: "0", TxnHash: "0x12"},
+		// Wrong day, non-numeric project and inconsistent raw value.
+		{Timestamp: "2024-04-16 00:00:01.000", Event: "BUY_ITEMS", ProjectID: "abc", CurrencySymbol: "USDC", CurrencyAddress: usdc, CurrencyValue: 1.5, CurrencyValueRaw: "1600000", TxnHash: testTxnHash},
+		// Unparseable timestamp.
+		{Timestamp: "yesterday", Event: "BUY_ITEMS", ProjectID: "43", CurrencySymbol: "USDC", CurrencyAddress: usdc, CurrencyValue: 1, CurrencyValueRaw: "1000000", TxnHash: testTxnHash},
+	}
+
+	report, err := chaindataagg.CheckQuality(transactions, chaindataagg.DefaultExpectations(), chaindataagg.QualityOptions{ExpectedDate: "2024-04-15"})
+	require.NoError(t, err)
+	require.Equal(t, 5, report.Rows)
+	require.Equal(t, 3, report.FailedRows)
+
+	failed := make(map[string]int)
+	for _, result := range report.Results {
+		failed[result.Name] = result.Failed
+		require.Len(t, result.Examples, result.Failed)
+	}
+	require.Equal(t, map[string]int{
+		chaindataagg.CheckPositiveValue:    1,
+		chaindataagg.CheckTimestamp:        2,
+		chaindataagg.CheckEventAllowed:     1,
+		chaindataagg.CheckProjectIDNumeric: 1,
+		chaindataagg.CheckTxnHash:          1,
+		chaindataagg.CheckRawConsistent:    1,
+	}, failed)
+	require.Equal(t, "abc", report.Results[5].Examples[0].ProjectID)
+	// Only the inconsistent raw value is marked.
+	for i, tx := range transactions {
+		require.Equal(t, i == 3, tx.RawMismatch, i)
+	}
+
+	err = report.Err()
+	require.ErrorContains(t, err, "positive_value (1 rows)")
+	require.ErrorContains(t, err, "timestamp (2 rows)")
+	require.NotContains(t, err.Error(), "txn_hash")
+
+	// Warnings alone do not fail.
+	report, err = chaindataagg.CheckQuality(transactions[3:4], chaindataagg.DefaultExpectations(), chaindataagg.QualityOptions{})
+	require.NoError(t, err)
+	require.NoError(t, report.Err())
+	require.Zero(t, report.FailedRows)
+}
+
+func TestCheckQualitySampleData(t *testing.T) {
+	content, err := os.ReadFile("sample_data/sample_data.csv")
+	require.NoError(t, err)
+	transactions, err := chaindataagg.Extract(context.Background(), content, 4)
+	require.NoError(t, err)
+
+	report, err := chaindataagg.CheckQuality(transactions, chaindataagg.DefaultExpectations(), chaindataagg.QualityOptions{Decimals: chaindataagg.DefaultTokenDecimals()})
+	require.NoError(t, err)
+	require.NoError(t, report.Err())
+
+	// The decimal values of all MATIC and some USDC.e transactions are not
+	// scaled by the token decimals.
+	result := report.Results[5]
+	require.Equal(t, chaindataagg.CheckRawConsistent, result.Check)
+	require.Equal(t, 72, result.Failed)
+	require.Contains(t, result.Examples[0].Message, "with 18 decimals")
+
+	// Every failing row is marked, not only the examples.
+	marked := 0
+	for _, tx := range transactions {
+		if tx.RawMismatch {
+			marked++
+		}
+	}
+	require.Equal(t, result.Failed, marked)
+}
+
+func TestReadExpectations(t *testing.T) {
+	expectations, err := chaindataagg.ReadExpectations(chaindataagg.ExpectationsDefault)
+	require.NoError(t, err)
+	require.Equal(t, chaindataagg.DefaultExpectations(), expectations)
+
+	path := filepath.Join(t.TempDir(), "expectations.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+expectations:
+  - name: buys only
+    check: event_allowed
+    severity: warn
+    values: [BUY_ITEMS]
+  - check: positive_value
+`), 0o644))
+	expectations, err = chaindataagg.ReadExpectations(path)
+	require.NoError(t, err)
+	require.Equal(t, []chaindataagg.Expectation{
+		{Name: "buys only", Check: chaindataagg.CheckEventAllowed, Severity: chaindataagg.SeverityWarn, Values: []string{"BUY_ITEMS"}},
+		{Check: chaindataagg.CheckPositiveValue},
+	}, expectations)
+
+	report, err := chaindataagg.CheckQuality([]chaindataagg.Transaction{{Event: "SELL_ITEMS", CurrencyValue: 1}}, expectations, chaindataagg.QualityOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "buys only", report.Results[0].Name)
+	require.Equal(t, 1, report.Results[0].Failed)
+	// Expectations without a severity are errors.
+	require.Equal(t, chaindataagg.SeverityError, report.Results[1].Severity)
+
+	for name, content := range map[string]string{
+		"unknown check":    "expectations:\n  - check: nope\n",
+		"unknown severity": "expectations:\n  - check: txn_hash\n    severity: fatal\n",
+		"no values":        "expectations:\n  - check: event_allowed\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "expectations.yaml")
+			require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+			_, err := chaindataagg.ReadExpectations(path)
+			require.ErrorContains(t, err, "invalid expectations")
+		})
+	}
+}
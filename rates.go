@@ -0,0 +1,259 @@
+package chaindataagg
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// ProviderCoinGecko identifies rates fetched from the CoinGecko API.
+	ProviderCoinGecko = "coingecko"
+)
+
+// RateSnapshot is the token prices output: exchange rates together with the
+// metadata needed to judge whether they can be trusted.
+type RateSnapshot struct {
+	Provider  string    `json:"provider"`
+	BaseURL   string    `json:"base_url,omitempty"`
+	Currency  string    `json:"currency"`
+	FetchedAt time.Time `json:"fetched_at"`
+	// Date is the day the rates apply to, with day boundaries in Timezone.
+	Date     string                  `json:"date,omitempty"`
+	Timezone string                  `json:"timezone,omitempty"`
+	Rates    map[string]float64      `json:"rates"`
+	Tokens   map[string]RateMetadata `json:"tokens,omitempty"`
+	// Quotes are rates in additional currencies keyed by currency and symbol.
+	Quotes map[string]map[string]float64 `json:"quotes,omitempty"`
+	// FX are the units of each additional currency per USD.
+	FX map[string]float64 `json:"fx,omitempty"`
+}
+
+// RateMetadata describes how the rate of a single token was obtained.
+type RateMetadata struct {
+	ID            string    `json:"id,omitempty"`
+	LastUpdatedAt time.Time `json:"last_updated_at"`
+	// Source is the provider name, or the mapping rule kind for mapped rates.
+	Source     string `json:"source,omitempty"`
+	Underlying string `json:"underlying,omitempty"`
+}
+
+// ParseRateSnapshot parses token prices output. Legacy files containing only
+// a symbol to rate map are accepted and yield a snapshot without metadata.
+func ParseRateSnapshot(data []byte) (*RateSnapshot, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, fmt.Errorf("failed to parse rates: %w", err)
+	}
+
+	if _, ok := fields["rates"]; !ok {
+		var rates map[string]float64
+		if err := json.Unmarshal(data, &rates); err != nil {
+			return nil, fmt.Errorf("failed to parse legacy rates: %w", err)
+		}
+		return &RateSnapshot{Currency: "usd", Rates: rates}, nil
+	}
+
+	var snapshot RateSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, fmt.Errorf("failed to parse rate snapshot: %w", err)
+	}
+	if snapshot.Rates == nil {
+		snapshot.Rates = make(map[string]float64)
+	}
+	return &snapshot, nil
+}
+
+// UpdatedAt returns the time the rate of the symbol was last updated, falling
+// back to the snapshot fetch time.
+func (s *RateSnapshot) UpdatedAt(symbol string) time.Time {
+	if meta, ok := s.Tokens[symbol]; ok && !meta.LastUpdatedAt.IsZero() {
+		return meta.LastUpdatedAt
+	}
+	return s.FetchedAt
+}
+
+// setQuote sets the rate of the symbol in an additional currency.
+func (s *RateSnapshot) setQuote(currency, symbol string, rate float64) {
+	if s.Quotes == nil {
+		s.Quotes = make(map[string]map[string]float64)
+	}
+	if _, ok := s.Quotes[currency]; !ok {
+		s.Quotes[currency] = make(map[string]float64)
+	}
+	s.Quotes[currency][symbol] = rate
+}
+
+// deriveFX derives the USD conversion rate of each additional currency as the
+// median ratio between the quote and the USD rate of the provider tokens.
+func (s *RateSnapshot) deriveFX() map[string]float64 {
+	fx := make(map[string]float64)
+	for currency, quotes := range s.Quotes {
+		var ratios []float64
+		for symbol, quote := range quotes {
+			if rate := s.Rates[symbol]; rate > 0 && quote > 0 {
+				ratios = append(ratios, quote/rate)
+			}
+		}
+		if len(ratios) == 0 {
+			continue
+		}
+		sort.Float64s(ratios)
+		if n := len(ratios); n%2 == 1 {
+			fx[currency] = ratios[n/2]
+		} else {
+			fx[currency] = (ratios[n/2-1] + ratios[n/2]) / 2
+		}
+	}
+	return fx
+}
+
+// CheckRateDay verifies that the rates were taken with the same day definition
+// as the aggregation: the same time zone and one of the aggregated dates. A
+// snapshot prices every day of a multi-day input. Snapshots without a day are
+// not checked.
+func CheckRateDay(snapshot *RateSnapshot, loc *time.Location, dates []string) error {
+	if snapshot.Timezone != "" && snapshot.Timezone != loc.String() {
+		return fmt.Errorf("rates use %s day boundaries, aggregation uses %s", snapshot.Timezone, loc)
+	}
+	if snapshot.Date == "" || len(dates) == 0 || slices.Contains(dates, snapshot.Date) {
+		return nil
+	}
+	from, to := dateRange(dates)
+	return fmt.Errorf("rates for %s cannot be used for %s to %s", snapshot.Date, from, to)
+}
+
+// RateCheckMode defines what happens when rate checks find issues.
+type RateCheckMode string
+
+const (
+	// RateCheckFail rejects the rates (default).
+	RateCheckFail RateCheckMode = "fail"
+	// RateCheckWarn reports the issues and keeps the rates.
+	RateCheckWarn RateCheckMode = "warn"
+)
+
+// ParseRateCheckMode parses rate check mode from string value.
+func ParseRateCheckMode(s string) (RateCheckMode, error) {
+	switch mode := RateCheckMode(strings.ToLower(s)); mode {
+	case RateCheckFail, RateCheckWarn:
+		return mode, nil
+	case "":
+		return RateCheckFail, nil
+	default:
+		return "", fmt.Errorf("unknown rate check mode: %s", s)
+	}
+}
+
+// RateCheckOptions configures CheckRates. Zero values disable the check.
+type RateCheckOptions struct {
+	// MaxAge is the maximum time a rate was last updated before the end of
+	// the day the rates apply to, or before now for a day not yet over.
+	MaxAge time.Duration
+	// MaxDeviation is the maximum relative day-over-day change of a rate in
+	// either direction, e.g. 0.5 allows a rate to grow or shrink by 1.5x.
+	MaxDeviation float64
+	Mode         RateCheckMode
+}
+
+// ageReference returns the time rate ages are measured from: the end of the
+// day the rates apply to, or now if the day is not over or unknown.
+func (s *RateSnapshot) ageReference(now time.Time) time.Time {
+	if s.Date == "" {
+		return now
+	}
+	loc := time.UTC
+	if s.Timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(s.Timezone); err != nil {
+			return now
+		}
+	}
+	day, err := time.ParseInLocation(DateFormat, s.Date, loc)
+	if err != nil {
+		return now
+	}
+	if end := day.AddDate(0, 0, 1); end.Before(now) {
+		return end
+	}
+	return now
+}
+
+// RateIssue describes a rate that failed a check.
+type RateIssue struct {
+	Symbol  string
+	Check   string
+	Message string
+}
+
+// CheckRates verifies that the current rates are fresh and sane compared to
+// the previous snapshot, which may be nil. Issues are always returned; an
+// error is returned as well when the mode is fail.
+func CheckRates(current, previous *RateSnapshot, now time.Time, opts RateCheckOptions) ([]RateIssue, error) {
+	mode, err := ParseRateCheckMode(string(opts.Mode))
+	if err != nil {
+		return nil, err
+	}
+	// Rates of a past day are as fresh as they were when the day ended.
+	now = current.ageReference(now)
+
+	symbols := make([]string, 0, len(current.Rates))
+	for symbol := range current.Rates {
+		symbols = append(symbols, symbol)
+	}
+	sort.Strings(symbols)
+
+	var issues []RateIssue
+	for _, symbol := range symbols {
+		rate := current.Rates[symbol]
+		if rate <= 0 || math.IsNaN(rate) || math.IsInf(rate, 0) {
+			issues = append(issues, RateIssue{
+				Symbol:  symbol,
+				Check:   "invalid",
+				Message: fmt.Sprintf("rate %v is not a positive number", rate),
+			})
+			continue
+		}
+
+		if opts.MaxAge > 0 {
+			updatedAt := current.UpdatedAt(symbol)
+			if updatedAt.IsZero() {
+				issues = append(issues, RateIssue{
+					Symbol:  symbol,
+					Check:   "stale",
+					Message: "rate has no fetch timestamp",
+				})
+			} else if age := now.Sub(updatedAt); age > opts.MaxAge {
+				issues = append(issues, RateIssue{
+					Symbol:  symbol,
+					Check:   "stale",
+					Message: fmt.Sprintf("rate is %s old, maximum is %s", age.Round(time.Second), opts.MaxAge),
+				})
+			}
+		}
+
+		if opts.MaxDeviation > 0 && previous != nil {
+			previousRate, ok := previous.Rates[symbol]
+			if !ok || previousRate <= 0 {
+				continue
+			}
+			if deviation := math.Max(rate/previousRate, previousRate/rate) - 1; deviation > opts.MaxDeviation {
+				issues = append(issues, RateIssue{
+					Symbol:  symbol,
+					Check:   "deviation",
+					Message: fmt.Sprintf("rate changed from %v to %v, maximum deviation is %v", previousRate, rate, opts.MaxDeviation),
+				})
+			}
+		}
+	}
+
+	if len(issues) > 0 && mode == RateCheckFail {
+		return issues, fmt.Errorf("%d rates failed checks, first: %s: %s", len(issues), issues[0].Symbol, issues[0].Message)
+	}
+
+	return issues, nil
+}
@@ -0,0 +1,142 @@
+package chaindataagg_test
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	chaindataagg "github.com/atkachyshyn/chain-data-agg"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRateSnapshot(t *testing.T) {
+	t.Run("legacy rates", func(t *testing.T) {
+		snapshot, err := chaindataagg.ParseRateSnapshot([]byte(`{"sfl": 0.05, "matic": 0.7}`))
+		require.NoError(t, err)
+		require.Equal(t, map[string]float64{"sfl": 0.05, "matic": 0.7}, snapshot.Rates)
+		require.True(t, snapshot.FetchedAt.IsZero())
+	})
+
+	t.Run("snapshot", func(t *testing.T) {
+		data := `{
+			"provider": "coingecko",
+			"currency": "usd",
+			"fetched_at": "2024-04-15T10:00:00Z",
+			"rates": {"sfl": 0.05},
+			"tokens": {"sfl": {"id": "sunflower-land", "last_updated_at": "2024-04-15T09:58:00Z"}}
+		}`
+		snapshot, err := chaindataagg.ParseRateSnapshot([]byte(data))
+		require.NoError(t, err)
+		require.Equal(t, chaindataagg.ProviderCoinGecko, snapshot.Provider)
+		require.Equal(t, 0.05, snapshot.Rates["sfl"])
+		require.Equal(t, time.Date(2024, 4, 15, 9, 58, 0, 0, time.UTC), snapshot.UpdatedAt("sfl"))
+		require.Equal(t, time.Date(2024, 4, 15, 10, 0, 0, 0, time.UTC), snapshot.UpdatedAt("matic"))
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := chaindataagg.ParseRateSnapshot([]byte(`[1, 2]`))
+		require.Error(t, err)
+	})
+}
+
+func TestCheckRates(t *testing.T) {
+	now := time.Date(2024, 4, 15, 12, 0, 0, 0, time.UTC)
+	current := &chaindataagg.RateSnapshot{
+		FetchedAt: now.Add(-time.Hour),
+		Rates:     map[string]float64{"sfl": 50, "matic": 0.7, "dead": 0},
+		Tokens: map[string]chaindataagg.RateMetadata{
+			"matic": {ID: "matic-network", LastUpdatedAt: now.Add(-72 * time.Hour)},
+		},
+	}
+	previous := &chaindataagg.RateSnapshot{
+		Rates: map[string]float64{"sfl": 0.05, "matic": 0.69},
+	}
+	opts := chaindataagg.RateCheckOptions{
+		MaxAge:       24 * time.Hour,
+		MaxDeviation: 0.5,
+		Mode:         chaindataagg.RateCheckFail,
+	}
+
+	t.Run("fail", func(t *testing.T) {
+		issues, err := chaindataagg.CheckRates(current, previous, now, opts)
+		require.Error(t, err)
+		require.Equal(t, []string{"dead/invalid", "matic/stale", "sfl/deviation"}, issueKeys(issues))
+	})
+
+	t.Run("warn", func(t *testing.T) {
+		opts := opts
+		opts.Mode = chaindataagg.RateCheckWarn
+		issues, err := chaindataagg.CheckRates(current, previous, now, opts)
+		require.NoError(t, err)
+		require.Len(t, issues, 3)
+	})
+
+	t.Run("legacy rates without timestamps", func(t *testing.T) {
+		legacy := &chaindataagg.RateSnapshot{Rates: map[string]float64{"sfl": 0.05}}
+		issues, err := chaindataagg.CheckRates(legacy, nil, now, opts)
+		require.Error(t, err)
+		require.Equal(t, []string{"sfl/stale"}, issueKeys(issues))
+	})
+
+	t.Run("backfilled day", func(t *testing.T) {
+		// Rates fetched for a day long past are measured against the end of
+		// that day, not the time of the backfill.
+		snapshot := &chaindataagg.RateSnapshot{
+			Date:     "2024-03-01",
+			Timezone: "UTC",
+			Rates:    map[string]float64{"sfl": 0.05, "matic": 0.7},
+			Tokens: map[string]chaindataagg.RateMetadata{
+				"sfl":   {LastUpdatedAt: time.Date(2024, 3, 1, 23, 55, 0, 0, time.UTC)},
+				"matic": {LastUpdatedAt: time.Date(2024, 2, 27, 0, 0, 0, 0, time.UTC)},
+			},
+		}
+		issues, err := chaindataagg.CheckRates(snapshot, nil, now, opts)
+		require.Error(t, err)
+		require.Equal(t, []string{"matic/stale"}, issueKeys(issues))
+		require.Contains(t, issues[0].Message, "96h0m0s old")
+	})
+
+	t.Run("disabled checks", func(t *testing.T) {
+		fresh := &chaindataagg.RateSnapshot{Rates: map[string]float64{"sfl": 50}}
+		issues, err := chaindataagg.CheckRates(fresh, previous, now, chaindataagg.RateCheckOptions{})
+		require.NoError(t, err)
+		require.Empty(t, issues)
+	})
+}
+
+func issueKeys(issues []chaindataagg.RateIssue) []string {
+	keys := make([]string, 0, len(issues))
+	for _, issue := range issues {
+		keys = append(keys, issue.Symbol+"/"+issue.Check)
+	}
+	return keys
+}
+
+func TestCheckRateDay(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	require.NoError(t, err)
+	snapshot := &chaindataagg.RateSnapshot{Date: "2024-04-15", Timezone: "UTC"}
+
+	require.NoError(t, chaindataagg.CheckRateDay(snapshot, time.UTC, []string{"2024-04-15"}))
+	require.ErrorContains(t, chaindataagg.CheckRateDay(snapshot, berlin, []string{"2024-04-15"}), "day boundaries")
+	require.ErrorContains(t, chaindataagg.CheckRateDay(snapshot, time.UTC, []string{"2024-04-16", "2024-04-17"}), "cannot be used for 2024-04-16 to 2024-04-17")
+	require.NoError(t, chaindataagg.CheckRateDay(&chaindataagg.RateSnapshot{}, berlin, []string{"2024-04-16"}))
+}
+
+func TestCheckRateDayMultiDay(t *testing.T) {
+	content, err := os.ReadFile("sample_data/sample_data.csv")
+	require.NoError(t, err)
+	transactions, err := chaindataagg.Extract(context.Background(), content, 4)
+	require.NoError(t, err)
+
+	dates, err := chaindataagg.TransactionDates(transactions, time.UTC, time.UTC)
+	require.NoError(t, err)
+	require.Equal(t, []string{"2024-04-01", "2024-04-02", "2024-04-15", "2024-04-16"}, dates)
+
+	// One snapshot prices all days of the input.
+	snapshot := &chaindataagg.RateSnapshot{Date: "2024-04-15", Timezone: "UTC"}
+	require.NoError(t, chaindataagg.CheckRateDay(snapshot, time.UTC, dates))
+	snapshot.Date = "2024-03-31"
+	require.ErrorContains(t, chaindataagg.CheckRateDay(snapshot, time.UTC, dates), "cannot be used for 2024-04-01 to 2024-04-16")
+}
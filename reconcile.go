@@ -0,0 +1,178 @@
+package chaindataagg
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// Reconciliation statuses of a project and day.
+const (
+	ReconcileOK         = "ok"
+	ReconcileMismatch   = "mismatch"
+	ReconcileMissing    = "missing"
+	ReconcileUnexpected = "unexpected"
+)
+
+// WarehouseTotals are the totals of a project and day read back from a
+// destination.
+type WarehouseTotals struct {
+	Date           string
+	ProjectID      string
+	Rows           int
+	Transactions   int
+	TotalVolumeUSD float64
+}
+
+// Verifier is implemented by sinks whose loaded data can be read back.
+type Verifier interface {
+	Totals(ctx context.Context, dates []string) ([]WarehouseTotals, error)
+}
+
+// ProjectReconciliation compares the expected and loaded totals of a project
+// and day.
+type ProjectReconciliation struct {
+	Date                 string  `json:"date"`
+	ProjectID            string  `json:"project_id"`
+	Status               string  `json:"status"`
+	ExpectedRows         int     `json:"expected_rows"`
+	ActualRows           int     `json:"actual_rows"`
+	ExpectedTransactions int     `json:"expected_transactions"`
+	ActualTransactions   int     `json:"actual_transactions"`
+	ExpectedVolumeUSD    float64 `json:"expected_volume_usd"`
+	ActualVolumeUSD      float64 `json:"actual_volume_usd"`
+}
+
+// ReconciliationReport is the machine-readable result of Reconcile.
+type ReconciliationReport struct {
+	GeneratedAt  time.Time               `json:"generated_at"`
+	Dates        []string                `json:"dates"`
+	Tolerance    float64                 `json:"tolerance"`
+	ExpectedRows int                     `json:"expected_rows"`
+	ActualRows   int                     `json:"actual_rows"`
+	Mismatches   int                     `json:"mismatches"`
+	OK           bool                    `json:"ok"`
+	Projects     []ProjectReconciliation `json:"projects"`
+}
+
+// Err returns an error summarizing the mismatches, if any.
+func (r *ReconciliationReport) Err() error {
+	if r.OK {
+		return nil
+	}
+	return fmt.Errorf("reconciliation failed: %d of %d projects do not match", r.Mismatches, len(r.Projects))
+}
+
+// AggregatedDates returns the distinct dates of the aggregated data in order.
+func AggregatedDates(data []AggregatedData) []string {
+	seen := make(map[string]bool)
+	var dates []string
+	for _, entry := range data {
+		if !seen[entry.Date] {
+			seen[entry.Date] = true
+			dates = append(dates, entry.Date)
+		}
+	}
+	sort.Strings(dates)
+	return dates
+}
+
+// Reconcile compares the transformed data with the totals read back from the
+// destination. Row and transaction counts must match exactly; volumes may
+// differ by the relative tolerance.
+func Reconcile(expected []AggregatedData, actual []WarehouseTotals, tolerance float64) *ReconciliationReport {
+	type key struct{ date, projectID string }
+	projects := make(map[key]*ProjectReconciliation)
+	project := func(date, projectID string) *ProjectReconciliation {
+		k := key{date, projectID}
+		if projects[k] == nil {
+			projects[k] = &ProjectReconciliation{Date: date, ProjectID: projectID}
+		}
+		return projects[k]
+	}
+
+	report := &ReconciliationReport{
+		GeneratedAt: time.Now().UTC(),
+		Dates:       AggregatedDates(expected),
+		Tolerance:   tolerance,
+		OK:          true,
+	}
+
+	for _, entry := range expected {
+		p := project(entry.Date, entry.ProjectID)
+		p.ExpectedRows++
+		p.ExpectedTransactions += entry.Transactions
+		if volume := entry.volumeUSD(); volume != nil {
+			p.ExpectedVolumeUSD += *volume
+		}
+		report.ExpectedRows++
+	}
+	for _, totals := range actual {
+		p := project(totals.Date, totals.ProjectID)
+		p.ActualRows += totals.Rows
+		p.ActualTransactions += totals.Transactions
+		p.ActualVolumeUSD += totals.TotalVolumeUSD
+		report.ActualRows += totals.Rows
+	}
+
+	for _, p := range projects {
+		switch {
+		case p.ActualRows == 0:
+			p.Status = ReconcileMissing
+		case p.ExpectedRows == 0:
+			p.Status = ReconcileUnexpected
+		case p.ActualRows != p.ExpectedRows ||
+			p.ActualTransactions != p.ExpectedTransactions ||
+			!withinTolerance(p.ExpectedVolumeUSD, p.ActualVolumeUSD, tolerance):
+			p.Status = ReconcileMismatch
+		default:
+			p.Status = ReconcileOK
+		}
+		if p.Status != ReconcileOK {
+			report.Mismatches++
+			report.OK = false
+		}
+		report.Projects = append(report.Projects, *p)
+	}
+
+	sort.Slice(report.Projects, func(i, j int) bool {
+		if report.Projects[i].Date != report.Projects[j].Date {
+			return report.Projects[i].Date < report.Projects[j].Date
+		}
+		return report.Projects[i].ProjectID < report.Projects[j].ProjectID
+	})
+
+	return report
+}
+
+// withinTolerance reports whether actual differs from expected by at most the
+// relative tolerance, allowing for float rounding.
+func withinTolerance(expected, actual, tolerance float64) bool {
+	const epsilon = 1e-9
+	return math.Abs(actual-expected) <= tolerance*math.Abs(expected)+epsilon
+}
+
+// dateRange returns the first and last of the dates.
+func dateRange(dates []string) (string, string) {
+	sorted := append([]string(nil), dates...)
+	sort.Strings(sorted)
+	return sorted[0], sorted[len(sorted)-1]
+}
+
+// filterDates keeps the totals of the given dates.
+func filterDates(totals []WarehouseTotals, dates []string) []WarehouseTotals {
+	wanted := make(map[string]bool, len(dates))
+	for _, date := range dates {
+		wanted[date] = true
+	}
+
+	var filtered []WarehouseTotals
+	for _, t := range totals {
+		if wanted[t.Date] {
+			filtered = append(filtered, t)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,83 @@
+package chaindataagg_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	chaindataagg "github.com/atkachyshyn/chain-data-agg"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReconcile(t *testing.T) {
+	expected := []chaindataagg.AggregatedData{
+		{Date: "2024-04-15", ProjectID: "1", Transactions: 2, TotalVolumeUSD: 100},
+		{Date: "2024-04-15", ProjectID: "1", Transactions: 1, RateMissing: true},
+		{Date: "2024-04-15", ProjectID: "2", Transactions: 3, TotalVolumeUSD: 10},
+		{Date: "2024-04-16", ProjectID: "3", Transactions: 1, TotalVolumeUSD: 5},
+	}
+
+	t.Run("match", func(t *testing.T) {
+		actual := []chaindataagg.WarehouseTotals{
+			{Date: "2024-04-15", ProjectID: "1", Rows: 2, Transactions: 3, TotalVolumeUSD: 100.00001},
+			{Date: "2024-04-15", ProjectID: "2", Rows: 1, Transactions: 3, TotalVolumeUSD: 10},
+			{Date: "2024-04-16", ProjectID: "3", Rows: 1, Transactions: 1, TotalVolumeUSD: 5},
+		}
+		report := chaindataagg.Reconcile(expected, actual, 1e-6)
+		require.True(t, report.OK)
+		require.NoError(t, report.Err())
+		require.Equal(t, []string{"2024-04-15", "2024-04-16"}, report.Dates)
+		require.Equal(t, 4, report.ExpectedRows)
+		require.Equal(t, 4, report.ActualRows)
+		require.Len(t, report.Projects, 3)
+	})
+
+	t.Run("mismatch", func(t *testing.T) {
+		actual := []chaindataagg.WarehouseTotals{
+			// Loaded twice.
+			{Date: "2024-04-15", ProjectID: "1", Rows: 4, Transactions: 6, TotalVolumeUSD: 200},
+			{Date: "2024-04-15", ProjectID: "2", Rows: 1, Transactions: 3, TotalVolumeUSD: 11},
+			{Date: "2024-04-16", ProjectID: "4", Rows: 1, Transactions: 1, TotalVolumeUSD: 5},
+		}
+		report := chaindataagg.Reconcile(expected, actual, 0.05)
+		require.False(t, report.OK)
+		require.ErrorContains(t, report.Err(), "4 of 4 projects")
+
+		statuses := make(map[string]string)
+		for _, project := range report.Projects {
+			statuses[project.Date+"/"+project.ProjectID] = project.Status
+		}
+		require.Equal(t, map[string]string{
+			"2024-04-15/1": chaindataagg.ReconcileMismatch,
+			"2024-04-15/2": chaindataagg.ReconcileMismatch,
+			"2024-04-16/3": chaindataagg.ReconcileMissing,
+			"2024-04-16/4": chaindataagg.ReconcileUnexpected,
+		}, statuses)
+	})
+}
+
+func TestSQLiteSinkTotals(t *testing.T) {
+	ctx := context.Background()
+	cfg := &chaindataagg.Config{SQLitePath: filepath.Join(t.TempDir(), "analytics.db")}
+	sink, err := chaindataagg.NewSink(context.Background(), "sqlite", "", cfg)
+	require.NoError(t, err)
+	defer sink.Close()
+
+	data := []chaindataagg.AggregatedData{
+		{Date: "2024-04-14", ProjectID: "1", Transactions: 9, TotalVolumeUSD: 9},
+		{Date: "2024-04-15", ProjectID: "1", Transactions: 2, TotalVolumeUSD: 1.5},
+		{Date: "2024-04-15", ProjectID: "1", Transactions: 1, RateMissing: true},
+	}
+	require.NoError(t, sink.Write(ctx, data))
+
+	verifier, ok := sink.(chaindataagg.Verifier)
+	require.True(t, ok)
+	totals, err := verifier.Totals(ctx, []string{"2024-04-15"})
+	require.NoError(t, err)
+	require.Equal(t, []chaindataagg.WarehouseTotals{
+		{Date: "2024-04-15", ProjectID: "1", Rows: 2, Transactions: 3, TotalVolumeUSD: 1.5},
+	}, totals)
+
+	report := chaindataagg.Reconcile(data[1:], totals, 0)
+	require.True(t, report.OK)
+}
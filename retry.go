@@ -0,0 +1,125 @@
+package chaindataagg
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+)
+
+// RetryPolicy configures Retry. Delays grow exponentially from InitialBackoff
+// up to MaxBackoff, with full jitter.
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// DefaultRetryPolicy is used when no policy is configured.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    5,
+	InitialBackoff: time.Second,
+	MaxBackoff:     30 * time.Second,
+}
+
+// retryableClickHouseCodes are the ClickHouse error codes worth retrying:
+// overload, timeouts, network failures and replicas that are temporarily
+// unavailable or read only.
+var retryableClickHouseCodes = map[int32]string{
+	3:   "UNEXPECTED_END_OF_FILE",
+	32:  "ATTEMPT_TO_READ_AFTER_EOF",
+	159: "TIMEOUT_EXCEEDED",
+	164: "READONLY",
+	202: "TOO_MANY_SIMULTANEOUS_QUERIES",
+	203: "NO_FREE_CONNECTION",
+	209: "SOCKET_TIMEOUT",
+	210: "NETWORK_ERROR",
+	242: "TABLE_IS_READ_ONLY",
+	252: "TOO_MANY_PARTS",
+	285: "TOO_FEW_LIVE_REPLICAS",
+	319: "UNKNOWN_STATUS_OF_INSERT",
+	425: "SYSTEM_ERROR",
+	999: "KEEPER_EXCEPTION",
+}
+
+// IsRetryable reports whether an error is transient. ClickHouse exceptions
+// are classified by code; other errors are retryable when they are network
+// failures.
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var exception *clickhouse.Exception
+	if errors.As(err, &exception) {
+		_, ok := retryableClickHouseCodes[exception.Code]
+		return ok
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, clickhouse.ErrAcquireConnTimeout)
+}
+
+// Retry calls op until it succeeds, fails with an error that is not
+// retryable, or the attempts are exhausted.
+func Retry(ctx context.Context, policy RetryPolicy, op func(ctx context.Context) error) error {
+	attempts := max(policy.MaxAttempts, 1)
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = op(ctx); err == nil {
+			return nil
+		}
+		if !IsRetryable(err) {
+			return err
+		}
+		if attempt == attempts {
+			return fmt.Errorf("giving up after %d attempts: %w", attempts, err)
+		}
+
+		delay := policy.backoff(attempt)
+		slog.Warn("Retrying after transient error",
+			slog.Int("attempt", attempt),
+			slog.Duration("delay", delay),
+			slog.String("error", err.Error()),
+		)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return errors.Join(ctx.Err(), err)
+		case <-timer.C:
+		}
+	}
+}
+
+// backoff returns a random delay up to the exponential backoff of the attempt.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	ceiling := p.InitialBackoff
+	for i := 1; i < attempt && ceiling < p.MaxBackoff; i++ {
+		ceiling *= 2
+	}
+	if p.MaxBackoff > 0 {
+		ceiling = min(ceiling, p.MaxBackoff)
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return rand.N(ceiling + 1)
+}
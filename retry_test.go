@@ -0,0 +1,87 @@
+package chaindataagg_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	chaindataagg "github.com/atkachyshyn/chain-data-agg"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"too many simultaneous queries", &clickhouse.Exception{Code: 202}, true},
+		{"wrapped network error", fmt.Errorf("insert: %w", &clickhouse.Exception{Code: 210}), true},
+		{"syntax error", &clickhouse.Exception{Code: 62}, false},
+		{"unknown table", &clickhouse.Exception{Code: 60}, false},
+		{"connection dropped", io.EOF, true},
+		{"acquire timeout", clickhouse.ErrAcquireConnTimeout, true},
+		{"canceled", context.Canceled, false},
+		{"other", errors.New("boom"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, chaindataagg.IsRetryable(tt.err))
+		})
+	}
+}
+
+func TestRetry(t *testing.T) {
+	ctx := context.Background()
+	policy := chaindataagg.RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond}
+	transient := &clickhouse.Exception{Code: 202}
+
+	t.Run("recovers", func(t *testing.T) {
+		calls := 0
+		err := chaindataagg.Retry(ctx, policy, func(context.Context) error {
+			calls++
+			if calls < 3 {
+				return transient
+			}
+			return nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, 3, calls)
+	})
+
+	t.Run("gives up", func(t *testing.T) {
+		calls := 0
+		err := chaindataagg.Retry(ctx, policy, func(context.Context) error {
+			calls++
+			return transient
+		})
+		require.ErrorIs(t, err, transient)
+		require.ErrorContains(t, err, "after 3 attempts")
+		require.Equal(t, 3, calls)
+	})
+
+	t.Run("fatal", func(t *testing.T) {
+		calls := 0
+		fatal := &clickhouse.Exception{Code: 62}
+		err := chaindataagg.Retry(ctx, policy, func(context.Context) error {
+			calls++
+			return fatal
+		})
+		require.ErrorIs(t, err, fatal)
+		require.Equal(t, 1, calls)
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(ctx)
+		cancel()
+		slow := chaindataagg.RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Hour, MaxBackoff: time.Hour}
+		err := chaindataagg.Retry(ctx, slow, func(context.Context) error {
+			return transient
+		})
+		require.ErrorIs(t, err, context.Canceled)
+	})
+}
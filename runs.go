@@ -0,0 +1,328 @@
+package chaindataagg
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+// Run statuses.
+const (
+	RunRunning     = "running"
+	RunSucceeded   = "succeeded"
+	RunFailed      = "failed"
+	RunInterrupted = "interrupted"
+)
+
+// RunStoreClickHouse selects the pipeline_runs table as the run store.
+const RunStoreClickHouse = "clickhouse"
+
+// ErrRunNotFound is returned for unknown run IDs.
+var ErrRunNotFound = errors.New("run not found")
+
+// Run records an invocation of a command.
+type Run struct {
+	ID        string        `json:"id"`
+	Command   string        `json:"command"`
+	Status    string        `json:"status"`
+	StartedAt time.Time     `json:"started_at"`
+	EndedAt   *time.Time    `json:"ended_at,omitempty"`
+	Stages    []StageResult `json:"stages,omitempty"`
+	Artifacts []Artifact    `json:"artifacts,omitempty"`
+	Error     string        `json:"error,omitempty"`
+
+	// mu guards the run against concurrent stages.
+	mu sync.Mutex
+}
+
+// StageResult are the row counts of a pipeline stage.
+type StageResult struct {
+	Name     string `json:"name"`
+	RowsIn   int    `json:"rows_in"`
+	RowsOut  int    `json:"rows_out"`
+	Rejected int    `json:"rejected,omitempty"`
+}
+
+// Artifact is a file read or written by a run.
+type Artifact struct {
+	// Role is what the run used the file for, e.g. input, output or rates.
+	Role   string `json:"role"`
+	URI    string `json:"uri"`
+	SHA256 string `json:"sha256,omitempty"`
+	Bytes  int    `json:"bytes"`
+}
+
+// NewRun starts the record of a command run with a new, time ordered run ID.
+func NewRun(command string) *Run {
+	now := time.Now().UTC()
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+	return &Run{
+		ID:        now.Format("20060102T150405Z") + "-" + hex.EncodeToString(suffix),
+		Command:   command,
+		Status:    RunRunning,
+		StartedAt: now,
+	}
+}
+
+// AddStage records the result of a stage. It does nothing on a nil run.
+func (r *Run) AddStage(stage StageResult) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Stages = append(r.Stages, stage)
+}
+
+// AddArtifact records a file with the checksum of its content. It does
+// nothing on a nil run.
+func (r *Run) AddArtifact(role, uri string, content []byte) {
+	if r == nil {
+		return
+	}
+	sum := sha256.Sum256(content)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Artifacts = append(r.Artifacts, Artifact{Role: role, URI: uri, SHA256: hex.EncodeToString(sum[:]), Bytes: len(content)})
+}
+
+// Finish ends the run with the error of the command, if any.
+func (r *Run) Finish(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now().UTC()
+	r.EndedAt = &now
+	switch {
+	case err == nil:
+		r.Status = RunSucceeded
+	case errors.Is(err, context.Canceled):
+		r.Status = RunInterrupted
+		r.Error = err.Error()
+	default:
+		r.Status = RunFailed
+		r.Error = err.Error()
+	}
+}
+
+// RunStore keeps run records.
+type RunStore interface {
+	// Save creates or replaces a run record.
+	Save(ctx context.Context, run *Run) error
+	// List returns the latest runs, most recent first.
+	List(ctx context.Context, limit int) ([]*Run, error)
+	// Get returns a run by ID or ErrRunNotFound.
+	Get(ctx context.Context, id string) (*Run, error)
+}
+
+// RunStoreLocation returns where run records are kept: RunsStore if set,
+// otherwise the runs/ folder of the GCP bucket or, without a bucket, a local
+// runs directory.
+func (c *Config) RunStoreLocation() string {
+	switch {
+	case c.RunsStore != "":
+		return c.RunsStore
+	case c.GCPBucketName != "":
+		return "gs://" + c.GCPBucketName + "/runs"
+	default:
+		return "runs"
+	}
+}
+
+// jsonRunStore keeps a JSON file per run in a local directory or under a
+// gs://bucket/prefix.
+type jsonRunStore struct {
+	location string
+}
+
+// NewJSONRunStore constructs a run store over a local directory or a
+// gs://bucket/prefix URI.
+func NewJSONRunStore(location string) RunStore {
+	return &jsonRunStore{location: strings.TrimSuffix(location, "/")}
+}
+
+func (s *jsonRunStore) path(id string) string {
+	return s.location + "/" + id + ".json"
+}
+
+func (s *jsonRunStore) Save(ctx context.Context, run *Run) error {
+	run.mu.Lock()
+	content, err := json.MarshalIndent(run, "", "  ")
+	run.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if _, _, ok := ParseBucketURI(s.path(run.ID)); !ok {
+		if err := os.MkdirAll(s.location, 0o755); err != nil {
+			return fmt.Errorf("failed to create run store: %w", err)
+		}
+	}
+	if err := WriteOutput(ctx, s.path(run.ID), content); err != nil {
+		return fmt.Errorf("failed to save run: %w", err)
+	}
+	return nil
+}
+
+func (s *jsonRunStore) List(ctx context.Context, limit int) ([]*Run, error) {
+	var names []string
+	if bucketName, prefix, ok := ParseBucketURI(s.location + "/"); ok {
+		objects, err := ListBucket(ctx, bucketName, prefix)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list runs: %w", err)
+		}
+		for _, object := range objects {
+			names = append(names, strings.TrimPrefix(object, prefix))
+		}
+	} else {
+		entries, err := os.ReadDir(s.location)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list runs: %w", err)
+		}
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+	}
+
+	// Run IDs start with their start time.
+	var ids []string
+	for _, name := range names {
+		if id, ok := strings.CutSuffix(name, ".json"); ok && !strings.Contains(id, "/") {
+			ids = append(ids, id)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(ids)))
+	if limit > 0 && len(ids) > limit {
+		ids = ids[:limit]
+	}
+
+	runs := make([]*Run, 0, len(ids))
+	for _, id := range ids {
+		run, err := s.Get(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+	return runs, nil
+}
+
+func (s *jsonRunStore) Get(ctx context.Context, id string) (*Run, error) {
+	if id == "" || strings.ContainsAny(id, `/\`) {
+		return nil, fmt.Errorf("%w: %s", ErrRunNotFound, id)
+	}
+	content, err := ReadInput(ctx, s.path(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrRunNotFound, id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read run: %w", err)
+	}
+	var run Run
+	if err := json.Unmarshal(content, &run); err != nil {
+		return nil, fmt.Errorf("failed to parse run %s: %w", id, err)
+	}
+	return &run, nil
+}
+
+// clickHouseRunStore keeps runs in the pipeline_runs table. Rows are never
+// updated: the latest row per run wins.
+type clickHouseRunStore struct {
+	conn driver.Conn
+}
+
+// NewClickHouseRunStore constructs a run store over the pipeline_runs table.
+func NewClickHouseRunStore(conn driver.Conn) RunStore {
+	return &clickHouseRunStore{conn: conn}
+}
+
+func (s *clickHouseRunStore) Save(ctx context.Context, run *Run) error {
+	run.mu.Lock()
+	record, err := json.Marshal(run)
+	status, endedAt, runErr := run.Status, run.EndedAt, run.Error
+	run.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	err = s.conn.Exec(ctx, `
+		INSERT INTO pipeline_runs (id, command, status, started_at, ended_at, error, record, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, now64(3))
+	`, run.ID, run.Command, status, run.StartedAt, endedAt, runErr, string(record))
+	if err != nil {
+		return fmt.Errorf("failed to save run: %w", err)
+	}
+	return nil
+}
+
+func (s *clickHouseRunStore) List(ctx context.Context, limit int) ([]*Run, error) {
+	if limit <= 0 {
+		limit = 1000
+	}
+	var rows []struct {
+		Record string `ch:"record"`
+	}
+	query := `SELECT record FROM pipeline_runs FINAL ORDER BY started_at DESC, id DESC LIMIT ?`
+	if err := s.conn.Select(ctx, &rows, query, limit); err != nil {
+		return nil, fmt.Errorf("failed to list runs: %w", err)
+	}
+
+	runs := make([]*Run, 0, len(rows))
+	for _, row := range rows {
+		var run Run
+		if err := json.Unmarshal([]byte(row.Record), &run); err != nil {
+			return nil, fmt.Errorf("failed to parse run: %w", err)
+		}
+		runs = append(runs, &run)
+	}
+	return runs, nil
+}
+
+func (s *clickHouseRunStore) Get(ctx context.Context, id string) (*Run, error) {
+	var rows []struct {
+		Record string `ch:"record"`
+	}
+	if err := s.conn.Select(ctx, &rows, `SELECT record FROM pipeline_runs FINAL WHERE id = ?`, id); err != nil {
+		return nil, fmt.Errorf("failed to read run: %w", err)
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrRunNotFound, id)
+	}
+	var run Run
+	if err := json.Unmarshal([]byte(rows[0].Record), &run); err != nil {
+		return nil, fmt.Errorf("failed to parse run %s: %w", id, err)
+	}
+	return &run, nil
+}
+
+// OpenRunStore opens the run store at cfg.RunStoreLocation. The returned
+// function closes it.
+func OpenRunStore(ctx context.Context, cfg *Config) (RunStore, func() error, error) {
+	location := cfg.RunStoreLocation()
+	if location != RunStoreClickHouse {
+		return NewJSONRunStore(location), func() error { return nil }, nil
+	}
+
+	options, err := cfg.ClickHouseOptions()
+	if err != nil {
+		return nil, nil, err
+	}
+	conn, err := Connect(ctx, options)
+	if err != nil {
+		return nil, nil, err
+	}
+	return NewClickHouseRunStore(conn), conn.Close, nil
+}
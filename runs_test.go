@@ -0,0 +1,81 @@
+package chaindataagg_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	chaindataagg "github.com/atkachyshyn/chain-data-agg"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJSONRunStore(t *testing.T) {
+	ctx := context.Background()
+	store := chaindataagg.NewJSONRunStore(filepath.Join(t.TempDir(), "runs"))
+
+	runs, err := store.List(ctx, 10)
+	require.NoError(t, err)
+	require.Empty(t, runs)
+
+	var ids []string
+	for i := range 3 {
+		run := chaindataagg.NewRun("aggregator extract")
+		run.ID = fmt.Sprintf("20240415T00000%dZ-0000000%d", i, i)
+		run.AddStage(chaindataagg.StageResult{Name: "extract", RowsIn: 10, RowsOut: 9, Rejected: 1})
+		run.AddArtifact("input", "gs://bucket/input.csv", []byte("csv"))
+		require.NoError(t, store.Save(ctx, run))
+		ids = append(ids, run.ID)
+	}
+
+	runs, err = store.List(ctx, 2)
+	require.NoError(t, err)
+	require.Len(t, runs, 2)
+	require.Equal(t, ids[2], runs[0].ID)
+	require.Equal(t, ids[1], runs[1].ID)
+
+	run, err := store.Get(ctx, ids[0])
+	require.NoError(t, err)
+	require.Equal(t, chaindataagg.RunRunning, run.Status)
+	require.Equal(t, []chaindataagg.StageResult{{Name: "extract", RowsIn: 10, RowsOut: 9, Rejected: 1}}, run.Stages)
+	require.Len(t, run.Artifacts, 1)
+	require.Equal(t, 3, run.Artifacts[0].Bytes)
+	require.Len(t, run.Artifacts[0].SHA256, 64)
+
+	// Saving a run again replaces its record.
+	run.Finish(nil)
+	require.NoError(t, store.Save(ctx, run))
+	run, err = store.Get(ctx, ids[0])
+	require.NoError(t, err)
+	require.Equal(t, chaindataagg.RunSucceeded, run.Status)
+	require.NotNil(t, run.EndedAt)
+
+	_, err = store.Get(ctx, "missing")
+	require.ErrorIs(t, err, chaindataagg.ErrRunNotFound)
+	_, err = store.Get(ctx, "../runs")
+	require.ErrorIs(t, err, chaindataagg.ErrRunNotFound)
+}
+
+func TestRunFinish(t *testing.T) {
+	run := chaindataagg.NewRun("aggregator load")
+	require.Regexp(t, `^\d{8}T\d{6}Z-[0-9a-f]{8}$`, run.ID)
+
+	run.Finish(fmt.Errorf("failed to load: %w", context.Canceled))
+	require.Equal(t, chaindataagg.RunInterrupted, run.Status)
+
+	run.Finish(errors.New("connection refused"))
+	require.Equal(t, chaindataagg.RunFailed, run.Status)
+	require.Equal(t, "connection refused", run.Error)
+
+	// A run that is not recorded ignores its results.
+	var missing *chaindataagg.Run
+	missing.AddStage(chaindataagg.StageResult{Name: "load"})
+	missing.AddArtifact("input", "input.json", nil)
+}
+
+func TestRunStoreLocation(t *testing.T) {
+	require.Equal(t, "runs", (&chaindataagg.Config{}).RunStoreLocation())
+	require.Equal(t, "gs://bucket/runs", (&chaindataagg.Config{GCPBucketName: "bucket"}).RunStoreLocation())
+	require.Equal(t, chaindataagg.RunStoreClickHouse, (&chaindataagg.Config{GCPBucketName: "bucket", RunsStore: "clickhouse"}).RunStoreLocation())
+}
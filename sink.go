@@ -0,0 +1,737 @@
+package chaindataagg
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	_ "github.com/lib/pq"
+	"github.com/parquet-go/parquet-go"
+	"go.opentelemetry.io/otel/attribute"
+	_ "modernc.org/sqlite"
+)
+
+// Supported load destinations.
+const (
+	DestinationClickHouse = "clickhouse"
+	DestinationPostgres   = "postgres"
+	DestinationSQLite     = "sqlite"
+	DestinationCSV        = "csv"
+	DestinationParquet    = "parquet"
+)
+
+// Sink writes aggregated data to a load destination.
+type Sink interface {
+	Write(ctx context.Context, data []AggregatedData) error
+	Close() error
+}
+
+// Aborter is implemented by sinks that write on Close. Abort discards the
+// rows written so far and releases the sink.
+type Aborter interface {
+	Abort() error
+}
+
+// AbortSink releases a sink after a failed load, without writing the rows
+// buffered by sinks that write on Close.
+func AbortSink(sink Sink) error {
+	if aborter, ok := sink.(Aborter); ok {
+		return aborter.Abort()
+	}
+	return sink.Close()
+}
+
+// NewSink constructs the sink for a destination. Destination names are case
+// insensitive. The target is the database DSN for PostgreSQL, the database file
+// for SQLite and the output file (local path or gs://bucket/object) for CSV and
+// Parquet; ClickHouse is configured from cfg.
+func NewSink(ctx context.Context, destination, target string, cfg *Config) (Sink, error) {
+	switch strings.ToLower(destination) {
+	case DestinationClickHouse:
+		options, err := cfg.ClickHouseOptions()
+		if err != nil {
+			return nil, err
+		}
+		return NewClickHouseSink(ctx, options, cfg.ClickHouseRetryPolicy(), cfg.ClickHouseBatchSize)
+	case DestinationPostgres, "postgresql":
+		if target == "" {
+			target = cfg.PostgresDSN
+		}
+		return openSQLSink(ctx, "postgres", target, DestinationPostgres)
+	case DestinationSQLite:
+		if target == "" {
+			target = cfg.SQLitePath
+		}
+		return openSQLSink(ctx, "sqlite", target, DestinationSQLite)
+	case DestinationCSV:
+		return newFileSink(DestinationCSV, target, encodeCSV)
+	case DestinationParquet:
+		return newFileSink(DestinationParquet, target, encodeParquet)
+	default:
+		return nil, fmt.Errorf("unknown destination: %s", destination)
+	}
+}
+
+// DefaultBatchSize is the number of rows sent to ClickHouse per insert.
+const DefaultBatchSize = 10000
+
+// clickHouseSink inserts rows into the marketplace_analytics table.
+type clickHouseSink struct {
+	conn      driver.Conn
+	retry     RetryPolicy
+	batchSize int
+}
+
+// NewClickHouseSink connects to ClickHouse and verifies that the schema is up
+// to date. Connecting and sending batches are retried on transient errors.
+func NewClickHouseSink(ctx context.Context, options *clickhouse.Options, retry RetryPolicy, batchSize int) (Sink, error) {
+	var db driver.Conn
+	err := Retry(ctx, retry, func(ctx context.Context) error {
+		var err error
+		db, err = Connect(ctx, options)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Refuse to load into an outdated schema.
+	migrator, err := NewMigrator(NewClickHouseMigrationStore(db))
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := migrator.CheckSchema(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return NewClickHouseConnSink(db, retry, batchSize), nil
+}
+
+// NewClickHouseConnSink constructs a sink over an open connection, closed by
+// the sink. Unlike NewClickHouseSink, it does not check the schema.
+func NewClickHouseConnSink(conn driver.Conn, retry RetryPolicy, batchSize int) Sink {
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+	return &clickHouseSink{conn: conn, retry: retry, batchSize: batchSize}
+}
+
+// Write sends the rows in batches. Each batch carries a deduplication token
+// derived from its content, so ClickHouse drops a batch that is sent again
+// after a retry or a repeated load.
+func (s *clickHouseSink) Write(ctx context.Context, data []AggregatedData) (err error) {
+	defer observeStage("load", time.Now())
+	ctx, span := startSpan(ctx, "load", attribute.String("destination", DestinationClickHouse), attribute.Int("rows", len(data)))
+	defer func() { endSpan(span, err) }()
+	rowsIn.WithLabelValues("load").Add(float64(len(data)))
+
+	for start := 0; start < len(data); start += s.batchSize {
+		batch := data[start:min(start+s.batchSize, len(data))]
+		token, err := deduplicationToken(batch)
+		if err != nil {
+			return err
+		}
+
+		err = s.writeBatch(ctx, start/s.batchSize, batch, token)
+		if err != nil {
+			return fmt.Errorf("failed to insert data: %w", err)
+		}
+		rowsLoaded.WithLabelValues(DestinationClickHouse).Add(float64(len(batch)))
+	}
+	return nil
+}
+
+// writeBatch sends a batch, retrying transient errors, in a span of its own.
+func (s *clickHouseSink) writeBatch(ctx context.Context, index int, batch []AggregatedData, token string) (err error) {
+	ctx, span := startSpan(ctx, "load.batch", attribute.Int("batch", index), attribute.Int("rows", len(batch)))
+	defer func() { endSpan(span, err) }()
+
+	attempts := 0
+	defer func() { span.SetAttributes(attribute.Int("attempts", attempts)) }()
+	return Retry(ctx, s.retry, func(ctx context.Context) error {
+		attempts++
+		return s.sendBatch(ctx, batch, token)
+	})
+}
+
+func (s *clickHouseSink) sendBatch(ctx context.Context, data []AggregatedData, token string) error {
+	insertCtx := clickhouse.Context(ctx, clickhouse.WithSettings(clickhouse.Settings{
+		"insert_deduplicate":         1,
+		"insert_deduplication_token": token,
+	}))
+
+	batch, err := s.conn.PrepareBatch(insertCtx, `
+		INSERT INTO marketplace_analytics (
+			date, project_id, transactions, total_volume_usd, rate_missing, volumes,
+			run_id, source_uri, source_generation, price_snapshot_uri, price_snapshot_generation,
+			suspicious_transactions, suspicious_volume_usd
+		)
+	`)
+	if err != nil {
+		return err
+	}
+	defer batch.Abort()
+
+	for _, entry := range data {
+		lineage := entry.lineage()
+		err := batch.Append(
+			entry.Date, entry.ProjectID, uint32(entry.Transactions), entry.volumeUSD(), entry.RateMissing, entry.volumes(),
+			lineage.RunID, lineage.SourceURI, lineage.SourceGeneration, lineage.PriceSnapshotURI, lineage.PriceSnapshotGeneration,
+			uint32(entry.SuspiciousTransactions), entry.SuspiciousVolumeUSD,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	if err := batch.Send(); err != nil {
+		return err
+	}
+	// The lineage insert has content of its own, so it does not carry the
+	// token of the batch.
+	return s.recordLineage(ctx, data)
+}
+
+// recordLineage records the inputs of the runs that computed the rows, if
+// their rows were loaded: a batch dropped as a duplicate of one loaded by an
+// earlier run leaves no rows of the new run. Inputs recorded again are
+// collapsed by the pipeline_lineage engine.
+func (s *clickHouseSink) recordLineage(ctx context.Context, data []AggregatedData) error {
+	inputs := lineageInputs(data)
+	if len(inputs) == 0 {
+		return nil
+	}
+	loaded, err := s.loadedRuns(ctx, data)
+	if err != nil {
+		return fmt.Errorf("failed to read loaded runs: %w", err)
+	}
+	inputs = slices.DeleteFunc(inputs, func(input LineageInput) bool { return !loaded[input.RunID] })
+	if len(inputs) == 0 {
+		return nil
+	}
+
+	batch, err := s.conn.PrepareBatch(ctx, `INSERT INTO pipeline_lineage (run_id, role, uri, generation)`)
+	if err != nil {
+		return err
+	}
+	defer batch.Abort()
+
+	for _, input := range inputs {
+		if err := batch.Append(input.RunID, input.Role, input.URI, input.Generation); err != nil {
+			return err
+		}
+	}
+	return batch.Send()
+}
+
+// loadedRuns returns which runs of the rows have rows in the table on the
+// days of the rows.
+func (s *clickHouseSink) loadedRuns(ctx context.Context, data []AggregatedData) (map[string]bool, error) {
+	var runIDs []string
+	for _, entry := range data {
+		if runID := entry.lineage().RunID; runID != "" && !slices.Contains(runIDs, runID) {
+			runIDs = append(runIDs, runID)
+		}
+	}
+	from, to := dateRange(AggregatedDates(data))
+
+	rows, err := s.conn.Query(ctx, `
+		SELECT DISTINCT run_id
+		FROM marketplace_analytics
+		WHERE date BETWEEN toDate(?) AND toDate(?) AND run_id IN (?)
+	`, from, to, runIDs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	loaded := make(map[string]bool)
+	for rows.Next() {
+		var runID string
+		if err := rows.Scan(&runID); err != nil {
+			return nil, err
+		}
+		loaded[runID] = true
+	}
+	return loaded, rows.Err()
+}
+
+// deduplicationToken hashes the content of a batch. Lineage is left out, so
+// rows computed again from the same inputs are not loaded twice.
+func deduplicationToken(data []AggregatedData) (string, error) {
+	rows := make([]AggregatedData, len(data))
+	for i, entry := range data {
+		entry.Lineage = nil
+		rows[i] = entry
+	}
+	content, err := json.Marshal(rows)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash batch: %w", err)
+	}
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Totals reads back the totals of the given dates.
+func (s *clickHouseSink) Totals(ctx context.Context, dates []string) ([]WarehouseTotals, error) {
+	if len(dates) == 0 {
+		return nil, nil
+	}
+	from, to := dateRange(dates)
+
+	var rows []struct {
+		Date           string  `ch:"date"`
+		ProjectID      string  `ch:"project_id"`
+		Rows           uint64  `ch:"rows"`
+		Transactions   uint64  `ch:"transactions"`
+		TotalVolumeUSD float64 `ch:"total_volume_usd"`
+	}
+	query := `
+		SELECT
+			toString(date) AS date,
+			project_id,
+			count() AS rows,
+			sum(transactions) AS transactions,
+			sum(ifNull(total_volume_usd, 0)) AS total_volume_usd
+		FROM marketplace_analytics
+		WHERE date BETWEEN toDate(?) AND toDate(?)
+		GROUP BY date, project_id
+	`
+	if err := s.conn.Select(ctx, &rows, query, from, to); err != nil {
+		return nil, fmt.Errorf("failed to query totals: %w", err)
+	}
+
+	totals := make([]WarehouseTotals, 0, len(rows))
+	for _, row := range rows {
+		totals = append(totals, WarehouseTotals{
+			Date:           row.Date,
+			ProjectID:      row.ProjectID,
+			Rows:           int(row.Rows),
+			Transactions:   int(row.Transactions),
+			TotalVolumeUSD: row.TotalVolumeUSD,
+		})
+	}
+	return filterDates(totals, dates), nil
+}
+
+func (s *clickHouseSink) Close() error {
+	return s.conn.Close()
+}
+
+// volumeUSD returns the USD volume, nil for rows without an exchange rate.
+func (d AggregatedData) volumeUSD() *float64 {
+	if d.RateMissing {
+		return nil
+	}
+	volume := d.TotalVolumeUSD
+	return &volume
+}
+
+// sqlDialects hold the statements of the SQL sinks. Rows are upserted, so
+// loading the same data twice does not duplicate it.
+var sqlDialects = map[string]struct {
+	createTable string
+	// addedColumns, the lineage and wash trade columns, are added to tables
+	// created without them.
+	addedColumns []string
+	upsert       string
+	totals       string
+}{
+	DestinationPostgres: {
+		createTable: `
+			CREATE TABLE IF NOT EXISTS marketplace_analytics (
+				date DATE NOT NULL,
+				project_id TEXT NOT NULL,
+				transactions INTEGER NOT NULL,
+				total_volume_usd DOUBLE PRECISION,
+				rate_missing BOOLEAN NOT NULL DEFAULT FALSE,
+				volumes JSONB NOT NULL DEFAULT '{}',
+				PRIMARY KEY (date, project_id, rate_missing)
+			)`,
+		addedColumns: []string{
+			"run_id TEXT NOT NULL DEFAULT ''",
+			"source_uri TEXT NOT NULL DEFAULT ''",
+			"source_generation BIGINT NOT NULL DEFAULT 0",
+			"price_snapshot_uri TEXT NOT NULL DEFAULT ''",
+			"price_snapshot_generation BIGINT NOT NULL DEFAULT 0",
+			"suspicious_transactions INTEGER NOT NULL DEFAULT 0",
+			"suspicious_volume_usd DOUBLE PRECISION NOT NULL DEFAULT 0",
+		},
+		upsert: `
+			INSERT INTO marketplace_analytics (
+				date, project_id, transactions, total_volume_usd, rate_missing, volumes,
+				run_id, source_uri, source_generation, price_snapshot_uri, price_snapshot_generation,
+				suspicious_transactions, suspicious_volume_usd
+			)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+			ON CONFLICT (date, project_id, rate_missing) DO UPDATE SET
+				transactions = EXCLUDED.transactions,
+				total_volume_usd = EXCLUDED.total_volume_usd,
+				volumes = EXCLUDED.volumes,
+				run_id = EXCLUDED.run_id,
+				source_uri = EXCLUDED.source_uri,
+				source_generation = EXCLUDED.source_generation,
+				price_snapshot_uri = EXCLUDED.price_snapshot_uri,
+				price_snapshot_generation = EXCLUDED.price_snapshot_generation,
+				suspicious_transactions = EXCLUDED.suspicious_transactions,
+				suspicious_volume_usd = EXCLUDED.suspicious_volume_usd`,
+		totals: `
+			SELECT date::text, project_id, COUNT(*), SUM(transactions), COALESCE(SUM(total_volume_usd), 0)
+			FROM marketplace_analytics
+			WHERE date BETWEEN $1 AND $2
+			GROUP BY date, project_id`,
+	},
+	DestinationSQLite: {
+		createTable: `
+			CREATE TABLE IF NOT EXISTS marketplace_analytics (
+				date TEXT NOT NULL,
+				project_id TEXT NOT NULL,
+				transactions INTEGER NOT NULL,
+				total_volume_usd REAL,
+				rate_missing INTEGER NOT NULL DEFAULT 0,
+				volumes TEXT NOT NULL DEFAULT '{}',
+				PRIMARY KEY (date, project_id, rate_missing)
+			)`,
+		addedColumns: []string{
+			"run_id TEXT NOT NULL DEFAULT ''",
+			"source_uri TEXT NOT NULL DEFAULT ''",
+			"source_generation INTEGER NOT NULL DEFAULT 0",
+			"price_snapshot_uri TEXT NOT NULL DEFAULT ''",
+			"price_snapshot_generation INTEGER NOT NULL DEFAULT 0",
+			"suspicious_transactions INTEGER NOT NULL DEFAULT 0",
+			"suspicious_volume_usd REAL NOT NULL DEFAULT 0",
+		},
+		upsert: `
+			INSERT INTO marketplace_analytics (
+				date, project_id, transactions, total_volume_usd, rate_missing, volumes,
+				run_id, source_uri, source_generation, price_snapshot_uri, price_snapshot_generation,
+				suspicious_transactions, suspicious_volume_usd
+			)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (date, project_id, rate_missing) DO UPDATE SET
+				transactions = excluded.transactions,
+				total_volume_usd = excluded.total_volume_usd,
+				volumes = excluded.volumes,
+				run_id = excluded.run_id,
+				source_uri = excluded.source_uri,
+				source_generation = excluded.source_generation,
+				price_snapshot_uri = excluded.price_snapshot_uri,
+				price_snapshot_generation = excluded.price_snapshot_generation,
+				suspicious_transactions = excluded.suspicious_transactions,
+				suspicious_volume_usd = excluded.suspicious_volume_usd`,
+		totals: `
+			SELECT date, project_id, COUNT(*), SUM(transactions), COALESCE(SUM(total_volume_usd), 0)
+			FROM marketplace_analytics
+			WHERE date BETWEEN ? AND ?
+			GROUP BY date, project_id`,
+	},
+}
+
+// sqlSink upserts rows into a marketplace_analytics table through database/sql.
+type sqlSink struct {
+	db      *sql.DB
+	dialect string
+	upsert  string
+	totals  string
+}
+
+func openSQLSink(ctx context.Context, driverName, dsn, dialect string) (Sink, error) {
+	if dsn == "" {
+		return nil, fmt.Errorf("no %s target configured", dialect)
+	}
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", dialect, err)
+	}
+	sink, err := NewSQLSink(ctx, db, dialect)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return sink, nil
+}
+
+// NewSQLSink constructs a sink over an open PostgreSQL or SQLite database and
+// creates the marketplace_analytics table if it does not exist, or adds the
+// lineage and wash trade columns it lacks.
+func NewSQLSink(ctx context.Context, db *sql.DB, dialect string) (Sink, error) {
+	statements, ok := sqlDialects[dialect]
+	if !ok {
+		return nil, fmt.Errorf("unknown SQL dialect: %s", dialect)
+	}
+	if _, err := db.ExecContext(ctx, statements.createTable); err != nil {
+		return nil, fmt.Errorf("failed to create table: %w", err)
+	}
+	if err := addMissingColumns(ctx, db, statements.addedColumns); err != nil {
+		return nil, err
+	}
+	return &sqlSink{db: db, dialect: dialect, upsert: statements.upsert, totals: statements.totals}, nil
+}
+
+// addMissingColumns adds the columns, given as "name type", that the
+// marketplace_analytics table lacks.
+func addMissingColumns(ctx context.Context, db *sql.DB, columns []string) error {
+	rows, err := db.QueryContext(ctx, `SELECT * FROM marketplace_analytics LIMIT 0`)
+	if err != nil {
+		return fmt.Errorf("failed to read table columns: %w", err)
+	}
+	existing, err := rows.Columns()
+	rows.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read table columns: %w", err)
+	}
+
+	for _, column := range columns {
+		name, _, _ := strings.Cut(column, " ")
+		if slices.Contains(existing, name) {
+			continue
+		}
+		if _, err := db.ExecContext(ctx, `ALTER TABLE marketplace_analytics ADD COLUMN `+column); err != nil {
+			return fmt.Errorf("failed to add column %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (s *sqlSink) Write(ctx context.Context, data []AggregatedData) (err error) {
+	defer observeStage("load", time.Now())
+	ctx, span := startSpan(ctx, "load", attribute.String("destination", s.dialect), attribute.Int("rows", len(data)))
+	defer func() { endSpan(span, err) }()
+	rowsIn.WithLabelValues("load").Add(float64(len(data)))
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		// Rollback is a no-op after commit.
+		_ = tx.Rollback()
+	}()
+
+	stmt, err := tx.PrepareContext(ctx, s.upsert)
+	if err != nil {
+		return fmt.Errorf("failed to prepare insert: %w", err)
+	}
+	defer stmt.Close()
+
+	for _, entry := range data {
+		volumes, err := json.Marshal(entry.volumes())
+		if err != nil {
+			return err
+		}
+		lineage := entry.lineage()
+		if _, err := stmt.ExecContext(ctx,
+			entry.Date, entry.ProjectID, entry.Transactions, entry.volumeUSD(), entry.RateMissing, string(volumes),
+			lineage.RunID, lineage.SourceURI, lineage.SourceGeneration, lineage.PriceSnapshotURI, lineage.PriceSnapshotGeneration,
+			entry.SuspiciousTransactions, entry.SuspiciousVolumeUSD,
+		); err != nil {
+			return fmt.Errorf("failed to insert data: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit: %w", err)
+	}
+	rowsLoaded.WithLabelValues(s.dialect).Add(float64(len(data)))
+	return nil
+}
+
+// Totals reads back the totals of the given dates.
+func (s *sqlSink) Totals(ctx context.Context, dates []string) ([]WarehouseTotals, error) {
+	if len(dates) == 0 {
+		return nil, nil
+	}
+	from, to := dateRange(dates)
+
+	rows, err := s.db.QueryContext(ctx, s.totals, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query totals: %w", err)
+	}
+	defer rows.Close()
+
+	var totals []WarehouseTotals
+	for rows.Next() {
+		var t WarehouseTotals
+		if err := rows.Scan(&t.Date, &t.ProjectID, &t.Rows, &t.Transactions, &t.TotalVolumeUSD); err != nil {
+			return nil, fmt.Errorf("failed to read totals: %w", err)
+		}
+		totals = append(totals, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read totals: %w", err)
+	}
+	return filterDates(totals, dates), nil
+}
+
+func (s *sqlSink) Close() error {
+	return s.db.Close()
+}
+
+// lineage returns the lineage of the row, empty if unknown.
+func (d AggregatedData) lineage() Lineage {
+	if d.Lineage == nil {
+		return Lineage{}
+	}
+	return *d.Lineage
+}
+
+// volumes returns the additional currency volumes, never nil.
+func (d AggregatedData) volumes() map[string]float64 {
+	if d.Volumes == nil {
+		return map[string]float64{}
+	}
+	return d.Volumes
+}
+
+// fileSink encodes all rows into a single file, written on Close.
+type fileSink struct {
+	format string
+	target string
+	encode func([]AggregatedData) ([]byte, error)
+	data   []AggregatedData
+	// ctx is the context of the last Write, as Close takes none.
+	ctx context.Context
+}
+
+func newFileSink(format, target string, encode func([]AggregatedData) ([]byte, error)) (Sink, error) {
+	if target == "" {
+		return nil, fmt.Errorf("no output file configured")
+	}
+	return &fileSink{format: format, target: target, encode: encode, ctx: context.Background()}, nil
+}
+
+func (s *fileSink) Write(ctx context.Context, data []AggregatedData) error {
+	rowsIn.WithLabelValues("load").Add(float64(len(data)))
+	s.data = append(s.data, data...)
+	s.ctx = ctx
+	return nil
+}
+
+// Close writes the file with all rows written so far.
+func (s *fileSink) Close() (err error) {
+	defer observeStage("load", time.Now())
+	ctx, span := startSpan(s.ctx, "load", attribute.String("destination", s.format), attribute.Int("rows", len(s.data)))
+	defer func() { endSpan(span, err) }()
+
+	content, err := s.encode(s.data)
+	if err != nil {
+		return err
+	}
+
+	if err := WriteOutput(ctx, s.target, content); err != nil {
+		return err
+	}
+	rowsLoaded.WithLabelValues(s.format).Add(float64(len(s.data)))
+	return nil
+}
+
+// Abort discards the rows written so far, so no file is written.
+func (s *fileSink) Abort() error {
+	s.data = nil
+	return nil
+}
+
+func encodeCSV(data []AggregatedData) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	header := []string{
+		"date", "project_id", "transactions", "total_volume_usd", "rate_missing", "volumes",
+		"run_id", "source_uri", "source_generation", "price_snapshot_uri", "price_snapshot_generation",
+		"suspicious_transactions", "suspicious_volume_usd",
+	}
+	if err := writer.Write(header); err != nil {
+		return nil, err
+	}
+
+	for _, entry := range data {
+		volumeUSD := ""
+		if !entry.RateMissing {
+			volumeUSD = strconv.FormatFloat(entry.TotalVolumeUSD, 'f', -1, 64)
+		}
+		volumes, err := json.Marshal(entry.volumes())
+		if err != nil {
+			return nil, err
+		}
+		lineage := entry.lineage()
+		record := []string{
+			entry.Date,
+			entry.ProjectID,
+			strconv.Itoa(entry.Transactions),
+			volumeUSD,
+			strconv.FormatBool(entry.RateMissing),
+			string(volumes),
+			lineage.RunID,
+			lineage.SourceURI,
+			strconv.FormatInt(lineage.SourceGeneration, 10),
+			lineage.PriceSnapshotURI,
+			strconv.FormatInt(lineage.PriceSnapshotGeneration, 10),
+			strconv.Itoa(entry.SuspiciousTransactions),
+			strconv.FormatFloat(entry.SuspiciousVolumeUSD, 'f', -1, 64),
+		}
+		if err := writer.Write(record); err != nil {
+			return nil, err
+		}
+	}
+
+	writer.Flush()
+	return buf.Bytes(), writer.Error()
+}
+
+// parquetRow is the Parquet schema of aggregated data.
+type parquetRow struct {
+	Date           string             `parquet:"date"`
+	ProjectID      string             `parquet:"project_id"`
+	Transactions   int64              `parquet:"transactions"`
+	TotalVolumeUSD *float64           `parquet:"total_volume_usd,optional"`
+	RateMissing    bool               `parquet:"rate_missing"`
+	Volumes        map[string]float64 `parquet:"volumes"`
+
+	RunID                   string `parquet:"run_id"`
+	SourceURI               string `parquet:"source_uri"`
+	SourceGeneration        int64  `parquet:"source_generation"`
+	PriceSnapshotURI        string `parquet:"price_snapshot_uri"`
+	PriceSnapshotGeneration int64  `parquet:"price_snapshot_generation"`
+
+	SuspiciousTransactions int64   `parquet:"suspicious_transactions"`
+	SuspiciousVolumeUSD    float64 `parquet:"suspicious_volume_usd"`
+}
+
+func encodeParquet(data []AggregatedData) ([]byte, error) {
+	rows := make([]parquetRow, 0, len(data))
+	for _, entry := range data {
+		lineage := entry.lineage()
+		rows = append(rows, parquetRow{
+			Date:                    entry.Date,
+			ProjectID:               entry.ProjectID,
+			Transactions:            int64(entry.Transactions),
+			TotalVolumeUSD:          entry.volumeUSD(),
+			RateMissing:             entry.RateMissing,
+			Volumes:                 entry.volumes(),
+			RunID:                   lineage.RunID,
+			SourceURI:               lineage.SourceURI,
+			SourceGeneration:        lineage.SourceGeneration,
+			PriceSnapshotURI:        lineage.PriceSnapshotURI,
+			PriceSnapshotGeneration: lineage.PriceSnapshotGeneration,
+			SuspiciousTransactions:  int64(entry.SuspiciousTransactions),
+			SuspiciousVolumeUSD:     entry.SuspiciousVolumeUSD,
+		})
+	}
+
+	var buf bytes.Buffer
+	if err := parquet.Write(&buf, rows); err != nil {
+		return nil, fmt.Errorf("failed to encode parquet: %w", err)
+	}
+	return buf.Bytes(), nil
+}
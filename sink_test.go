@@ -0,0 +1,327 @@
+package chaindataagg_test
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/DATA-DOG/go-sqlmock"
+	chaindataagg "github.com/atkachyshyn/chain-data-agg"
+	"github.com/parquet-go/parquet-go"
+	"github.com/stretchr/testify/require"
+)
+
+var sinkData = []chaindataagg.AggregatedData{
+	{Date: "2024-04-15", ProjectID: "4974", Transactions: 2, TotalVolumeUSD: 1.5, Volumes: map[string]float64{"eur": 1.4}, Lineage: &chaindataagg.Lineage{
+		RunID:                   "20240416T000000Z-00000000",
+		SourceURI:               "gs://bucket/sample_data.csv",
+		SourceGeneration:        7,
+		PriceSnapshotURI:        "gs://bucket/rates/2024-04-15.json",
+		PriceSnapshotGeneration: 8,
+	}, SuspiciousTransactions: 1, SuspiciousVolumeUSD: 0.5},
+	{Date: "2024-04-15", ProjectID: "4974", Transactions: 1, RateMissing: true},
+}
+
+func TestNewSink(t *testing.T) {
+	cfg := &chaindataagg.Config{}
+
+	_, err := chaindataagg.NewSink(context.Background(), "bigquery", "", cfg)
+	require.ErrorContains(t, err, "unknown destination")
+
+	_, err = chaindataagg.NewSink(context.Background(), "postgres", "", cfg)
+	require.ErrorContains(t, err, "no postgres target")
+
+	_, err = chaindataagg.NewSink(context.Background(), "CSV", "", cfg)
+	require.Error(t, err)
+}
+
+func TestSQLiteSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "analytics.db")
+	cfg := &chaindataagg.Config{SQLitePath: path}
+
+	// Loading twice must not duplicate rows.
+	for range 2 {
+		sink, err := chaindataagg.NewSink(context.Background(), "sqlite", "", cfg)
+		require.NoError(t, err)
+		require.NoError(t, sink.Write(context.Background(), sinkData))
+		require.NoError(t, sink.Close())
+	}
+
+	db, err := sql.Open("sqlite", path)
+	require.NoError(t, err)
+	defer db.Close()
+
+	var count int
+	require.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM marketplace_analytics`).Scan(&count))
+	require.Equal(t, 2, count)
+
+	var volume sql.NullFloat64
+	var volumes string
+	require.NoError(t, db.QueryRow(`SELECT total_volume_usd, volumes FROM marketplace_analytics WHERE rate_missing = 1`).Scan(&volume, &volumes))
+	require.False(t, volume.Valid)
+	require.Equal(t, "{}", volumes)
+
+	var lineage chaindataagg.Lineage
+	require.NoError(t, db.QueryRow(`
+		SELECT run_id, source_uri, source_generation, price_snapshot_uri, price_snapshot_generation
+		FROM marketplace_analytics WHERE rate_missing = 0
+	`).Scan(&lineage.RunID, &lineage.SourceURI, &lineage.SourceGeneration, &lineage.PriceSnapshotURI, &lineage.PriceSnapshotGeneration))
+	require.Equal(t, *sinkData[0].Lineage, lineage)
+
+	var suspiciousTransactions int
+	var suspiciousVolume float64
+	require.NoError(t, db.QueryRow(`
+		SELECT suspicious_transactions, suspicious_volume_usd
+		FROM marketplace_analytics WHERE rate_missing = 0
+	`).Scan(&suspiciousTransactions, &suspiciousVolume))
+	require.Equal(t, 1, suspiciousTransactions)
+	require.Equal(t, 0.5, suspiciousVolume)
+}
+
+func TestSQLiteSinkAddsLineageColumns(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "analytics.db")
+	db, err := sql.Open("sqlite", path)
+	require.NoError(t, err)
+	defer db.Close()
+	// A table created before lineage was loaded.
+	_, err = db.Exec(`
+		CREATE TABLE marketplace_analytics (
+			date TEXT NOT NULL,
+			project_id TEXT NOT NULL,
+			transactions INTEGER NOT NULL,
+			total_volume_usd REAL,
+			rate_missing INTEGER NOT NULL DEFAULT 0,
+			volumes TEXT NOT NULL DEFAULT '{}',
+			PRIMARY KEY (date, project_id, rate_missing)
+		)`)
+	require.NoError(t, err)
+
+	sink, err := chaindataagg.NewSink(context.Background(), "sqlite", path, &chaindataagg.Config{})
+	require.NoError(t, err)
+	require.NoError(t, sink.Write(context.Background(), sinkData))
+	require.NoError(t, sink.Close())
+
+	var runID string
+	var suspiciousTransactions int
+	require.NoError(t, db.QueryRow(`SELECT run_id, suspicious_transactions FROM marketplace_analytics WHERE rate_missing = 0`).Scan(&runID, &suspiciousTransactions))
+	require.Equal(t, sinkData[0].Lineage.RunID, runID)
+	require.Equal(t, 1, suspiciousTransactions)
+}
+
+func TestPostgresSink(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS marketplace_analytics")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	// The table lacks the lineage generations and the wash trade columns.
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM marketplace_analytics LIMIT 0")).
+		WillReturnRows(sqlmock.NewRows([]string{"date", "project_id", "transactions", "total_volume_usd", "rate_missing", "volumes", "run_id", "source_uri", "price_snapshot_uri"}))
+	mock.ExpectExec(regexp.QuoteMeta("ALTER TABLE marketplace_analytics ADD COLUMN source_generation BIGINT")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("ALTER TABLE marketplace_analytics ADD COLUMN price_snapshot_generation BIGINT")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("ALTER TABLE marketplace_analytics ADD COLUMN suspicious_transactions INTEGER")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("ALTER TABLE marketplace_analytics ADD COLUMN suspicious_volume_usd DOUBLE PRECISION")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectBegin()
+	prepare := mock.ExpectPrepare(regexp.QuoteMeta("ON CONFLICT (date, project_id, rate_missing)"))
+	lineage := sinkData[0].Lineage
+	prepare.ExpectExec().
+		WithArgs("2024-04-15", "4974", 2, 1.5, false, `{"eur":1.4}`, lineage.RunID, lineage.SourceURI, lineage.SourceGeneration, lineage.PriceSnapshotURI, lineage.PriceSnapshotGeneration, 1, 0.5).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	prepare.ExpectExec().
+		WithArgs("2024-04-15", "4974", 1, nil, true, `{}`, "", "", 0, "", 0, 0, 0.0).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectClose()
+
+	sink, err := chaindataagg.NewSQLSink(context.Background(), db, chaindataagg.DestinationPostgres)
+	require.NoError(t, err)
+	require.NoError(t, sink.Write(context.Background(), sinkData))
+	require.NoError(t, sink.Close())
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+// fakeClickHouse keeps the rows inserted into marketplace_analytics and
+// pipeline_lineage. Like insert deduplication, it drops a batch of analytics
+// rows with the same content as an earlier one, lineage aside.
+type fakeClickHouse struct {
+	driver.Conn
+	contents  map[string]bool
+	analytics [][]any
+	lineage   [][]any
+}
+
+func (f *fakeClickHouse) PrepareBatch(ctx context.Context, query string, opts ...driver.PrepareBatchOption) (driver.Batch, error) {
+	return &fakeBatch{conn: f, lineage: strings.Contains(query, "pipeline_lineage")}, nil
+}
+
+func (f *fakeClickHouse) Query(ctx context.Context, query string, args ...any) (driver.Rows, error) {
+	runIDs := args[2].([]string)
+	seen := make(map[string]bool)
+	rows := &fakeRows{}
+	for _, row := range f.analytics {
+		if runID := row[6].(string); slices.Contains(runIDs, runID) && !seen[runID] {
+			seen[runID] = true
+			rows.values = append(rows.values, runID)
+		}
+	}
+	return rows, nil
+}
+
+func (f *fakeClickHouse) Close() error {
+	return nil
+}
+
+type fakeBatch struct {
+	driver.Batch
+	conn    *fakeClickHouse
+	lineage bool
+	rows    [][]any
+}
+
+func (b *fakeBatch) Append(v ...any) error {
+	b.rows = append(b.rows, v)
+	return nil
+}
+
+func (b *fakeBatch) Abort() error {
+	return nil
+}
+
+func (b *fakeBatch) Send() error {
+	if b.lineage {
+		b.conn.lineage = append(b.conn.lineage, b.rows...)
+		return nil
+	}
+	var content []any
+	for _, row := range b.rows {
+		for i, value := range row {
+			if volume, ok := value.(*float64); ok && volume != nil {
+				value = *volume
+			}
+			if i < 6 || i > 10 {
+				content = append(content, value)
+			}
+		}
+	}
+	key := fmt.Sprint(content...)
+	if !b.conn.contents[key] {
+		b.conn.contents[key] = true
+		b.conn.analytics = append(b.conn.analytics, b.rows...)
+	}
+	return nil
+}
+
+type fakeRows struct {
+	driver.Rows
+	values []string
+}
+
+func (r *fakeRows) Next() bool {
+	return len(r.values) > 0
+}
+
+func (r *fakeRows) Scan(dest ...any) error {
+	*dest[0].(*string) = r.values[0]
+	r.values = r.values[1:]
+	return nil
+}
+
+func (r *fakeRows) Err() error {
+	return nil
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func TestClickHouseSinkLineage(t *testing.T) {
+	conn := &fakeClickHouse{contents: make(map[string]bool)}
+	sink := chaindataagg.NewClickHouseConnSink(conn, chaindataagg.RetryPolicy{}, 0)
+	require.NoError(t, sink.Write(context.Background(), sinkData))
+	require.Len(t, conn.analytics, 2)
+	require.Len(t, conn.lineage, 2)
+
+	// A re-run computing the same rows is deduplicated, so its lineage must
+	// not be recorded.
+	rerun := slices.Clone(sinkData)
+	lineage := *rerun[0].Lineage
+	lineage.RunID = "20240417T000000Z-00000000"
+	rerun[0].Lineage = &lineage
+	require.NoError(t, sink.Write(context.Background(), rerun))
+	require.Len(t, conn.analytics, 2)
+	require.Len(t, conn.lineage, 2)
+	for _, row := range conn.lineage {
+		require.Equal(t, sinkData[0].Lineage.RunID, row[0])
+	}
+	require.NoError(t, sink.Close())
+}
+
+func TestCSVSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "analytics.csv")
+	sink, err := chaindataagg.NewSink(context.Background(), "csv", path, &chaindataagg.Config{})
+	require.NoError(t, err)
+	require.NoError(t, sink.Write(context.Background(), sinkData))
+	require.NoError(t, sink.Close())
+
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+
+	records, err := csv.NewReader(file).ReadAll()
+	require.NoError(t, err)
+	require.Equal(t, [][]string{
+		{"date", "project_id", "transactions", "total_volume_usd", "rate_missing", "volumes", "run_id", "source_uri", "source_generation", "price_snapshot_uri", "price_snapshot_generation", "suspicious_transactions", "suspicious_volume_usd"},
+		{"2024-04-15", "4974", "2", "1.5", "false", `{"eur":1.4}`, "20240416T000000Z-00000000", "gs://bucket/sample_data.csv", "7", "gs://bucket/rates/2024-04-15.json", "8", "1", "0.5"},
+		{"2024-04-15", "4974", "1", "", "true", "{}", "", "", "0", "", "0", "0", "0"},
+	}, records)
+}
+
+func TestAbortSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "analytics.csv")
+	sink, err := chaindataagg.NewSink(context.Background(), "csv", path, &chaindataagg.Config{})
+	require.NoError(t, err)
+	require.NoError(t, sink.Write(context.Background(), sinkData))
+
+	// A failed load must not write the rows buffered so far.
+	require.NoError(t, chaindataagg.AbortSink(sink))
+	require.NoFileExists(t, path)
+}
+
+func TestParquetSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "analytics.parquet")
+	sink, err := chaindataagg.NewSink(context.Background(), "parquet", path, &chaindataagg.Config{})
+	require.NoError(t, err)
+	require.NoError(t, sink.Write(context.Background(), sinkData))
+	require.NoError(t, sink.Close())
+
+	type row struct {
+		ProjectID      string   `parquet:"project_id"`
+		Transactions   int64    `parquet:"transactions"`
+		TotalVolumeUSD *float64 `parquet:"total_volume_usd,optional"`
+		RunID          string   `parquet:"run_id"`
+
+		SuspiciousTransactions int64   `parquet:"suspicious_transactions"`
+		SuspiciousVolumeUSD    float64 `parquet:"suspicious_volume_usd"`
+	}
+	rows, err := parquet.ReadFile[row](path)
+	require.NoError(t, err)
+	require.Len(t, rows, 2)
+	require.Equal(t, int64(2), rows[0].Transactions)
+	require.Equal(t, 1.5, *rows[0].TotalVolumeUSD)
+	require.Nil(t, rows[1].TotalVolumeUSD)
+	require.Equal(t, sinkData[0].Lineage.RunID, rows[0].RunID)
+	require.Equal(t, int64(1), rows[0].SuspiciousTransactions)
+	require.Equal(t, 0.5, rows[0].SuspiciousVolumeUSD)
+}
@@ -1,16 +1,19 @@
 package chaindataagg
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/schollz/progressbar/v3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -28,10 +31,18 @@ type TokenPrice struct {
 }
 
 // FetchTokenList fetches the list of tokens from CoinGecko.
-func FetchTokenList(baseURL string, whiteList []string) ([]Token, error) {
+func FetchTokenList(ctx context.Context, baseURL string, whiteList []string) (_ []Token, err error) {
+	ctx, span := startSpan(ctx, "prices.token_list")
+	defer func() { endSpan(span, err) }()
+
 	url := fmt.Sprintf("%s/coins/list?include_platform=true", baseURL)
 
-	resp, err := http.Get(url)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	client := &http.Client{Transport: tracingTransport(http.DefaultTransport)}
+	resp, err := client.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch token list: %w", err)
 	}
@@ -58,40 +69,59 @@ func FetchTokenList(baseURL string, whiteList []string) ([]Token, error) {
 	return tokensFiltered, nil
 }
 
-func CalculateDailyPrices(baseURL, apiKey string, tokenIDs []Token) (map[string]float64, error) {
+// CalculateDailyPrices fetches prices for the given tokens in USD and the
+// additional quote currencies and returns them as a rate snapshot keyed by
+// token symbol.
+func CalculateDailyPrices(ctx context.Context, baseURL, apiKey string, tokenIDs []Token, currencies []string) (_ *RateSnapshot, err error) {
+	defer observeStage("prices", time.Now())
+	ctx, span := startSpan(ctx, "prices", attribute.Int("tokens", len(tokenIDs)))
+	defer func() { endSpan(span, err) }()
+
 	// Batch tokens to limit the number of tokens per request.
-	batches := batchTokens(tokenIDs, 50)
+	var batches [][]Token
+	if len(tokenIDs) > 0 {
+		batches = batchTokens(tokenIDs, 50)
+	}
+
+	// USD is always fetched, it is the base currency of the snapshot.
+	currencies = QuoteCurrencies(currencies)
 
 	client := &http.Client{
 		Timeout: 10 * time.Second,
-		Transport: &http.Transport{
+		Transport: tracingTransport(&http.Transport{
 			MaxIdleConns:        50,
 			MaxIdleConnsPerHost: 20,
 			IdleConnTimeout:     90 * time.Second,
-		},
+		}),
 	}
 
-	prices := make(map[string]float64)
+	quotes := make(map[string]map[string]float64)
 	pricesFull := make(map[string]map[string]float64)
 	var mu sync.Mutex
 
-	bar := progressbar.Default(int64(len(batches)), "Processing token batches")
+	bar := newProgressBar(int64(len(batches)), "Processing token batches")
+
+	fetchedAt := time.Now().UTC()
 
-	var g errgroup.Group
+	// The first failed batch cancels the others.
+	g, ctx := errgroup.WithContext(ctx)
 
-	for _, batch := range batches {
-		batch := batch
+	for i, batch := range batches {
+		i, batch := i, batch
 
-		g.Go(func() error {
-			batchPricesFull, batchPrices, err := fetchBatchPricesWithRetry(client, baseURL, apiKey, batch)
+		g.Go(func() (err error) {
+			ctx, span := startSpan(ctx, "prices.batch", attribute.Int("batch", i), attribute.Int("tokens", len(batch)))
+			defer func() { endSpan(span, err) }()
+
+			batchPricesFull, batchQuotes, err := fetchBatchPricesWithRetry(ctx, client, baseURL, apiKey, batch, currencies)
 			if err != nil {
 				return fmt.Errorf("failed to fetch batch prices: %w", err)
 			}
 
 			// Merge batch prices into the result map.
 			mu.Lock()
-			for token, price := range batchPrices {
-				prices[token] = price
+			for token, quote := range batchQuotes {
+				quotes[token] = quote
 			}
 			mu.Unlock()
 
@@ -121,30 +151,55 @@ func CalculateDailyPrices(baseURL, apiKey string, tokenIDs []Token) (map[string]
 	// Finish progress bar.
 	_ = bar.Finish()
 
-	prcs := make(map[string]float64)
+	snapshot := &RateSnapshot{
+		Provider:  ProviderCoinGecko,
+		BaseURL:   baseURL,
+		Currency:  "usd",
+		FetchedAt: fetchedAt,
+		Rates:     make(map[string]float64),
+		Tokens:    make(map[string]RateMetadata),
+	}
 	for k, v := range pricesFull {
-		fmt.Println(k)
-		fmt.Println("|")
 		for kk, vv := range v {
-			prcs[k] = vv
-			fmt.Println("|---", kk, "=", vv)
+			snapshot.Rates[k] = vv
+			snapshot.Tokens[k] = RateMetadata{ID: kk, LastUpdatedAt: lastUpdatedAt(quotes[kk]), Source: ProviderCoinGecko}
+			for _, currency := range currencies[1:] {
+				if price, ok := quotes[kk][currency]; ok {
+					snapshot.setQuote(currency, k, price)
+				}
+			}
+			slog.Debug("Token price", slog.String("symbol", k), slog.String("id", kk), slog.Float64("price", vv))
 			break
 		}
 	}
+	snapshot.FX = snapshot.deriveFX()
 
-	return prcs, nil
+	return snapshot, nil
+}
+
+// QuoteCurrencies normalizes a list of quote currencies: lower case, without
+// duplicates and starting with USD.
+func QuoteCurrencies(currencies []string) []string {
+	result := []string{"usd"}
+	for _, currency := range currencies {
+		currency = strings.ToLower(strings.TrimSpace(currency))
+		if currency != "" && !stringInSlice(currency, result) {
+			result = append(result, currency)
+		}
+	}
+	return result
 }
 
-func fetchBatchPricesWithRetry(client *http.Client, baseURL, apiKey string, tokens []Token) (map[string]map[string]float64, map[string]float64, error) {
+func fetchBatchPricesWithRetry(ctx context.Context, client *http.Client, baseURL, apiKey string, tokens []Token, currencies []string) (map[string]map[string]float64, map[string]map[string]float64, error) {
 	var tokenIDs []string
 	for _, token := range tokens {
 		tokenIDs = append(tokenIDs, token.ID)
 	}
-	url := fmt.Sprintf("%s/simple/price?ids=%s&vs_currencies=usd", baseURL, strings.Join(tokenIDs, ","))
+	url := fmt.Sprintf("%s/simple/price?ids=%s&vs_currencies=%s&include_last_updated_at=true", baseURL, strings.Join(tokenIDs, ","), strings.Join(currencies, ","))
 
 	var data map[string]map[string]float64
 	for retries := 0; retries < 5; retries++ {
-		req, err := http.NewRequest("GET", url, nil)
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 		if err != nil {
 			return nil, nil, fmt.Errorf("failed to create request: %w", err)
 		}
@@ -158,6 +213,7 @@ func fetchBatchPricesWithRetry(client *http.Client, baseURL, apiKey string, toke
 			return nil, nil, fmt.Errorf("failed to fetch token prices: %w", err)
 		}
 		defer resp.Body.Close()
+		recordPriceRequest(resp.StatusCode)
 
 		// Handle HTTP status codes.
 		if resp.StatusCode == http.StatusOK {
@@ -171,7 +227,13 @@ func fetchBatchPricesWithRetry(client *http.Client, baseURL, apiKey string, toke
 			// Handle rate limit exceeded.
 			retryAfter := parseRetryAfter(resp)
 			if retries < 4 && retryAfter > 0 {
-				time.Sleep(retryAfter)
+				priceRateLimitRetries.Inc()
+				trace.SpanFromContext(ctx).AddEvent("rate limited", trace.WithAttributes(attribute.String("retry_after", retryAfter.String())))
+				select {
+				case <-ctx.Done():
+					return nil, nil, ctx.Err()
+				case <-time.After(retryAfter):
+				}
 				continue
 			}
 			return nil, nil, fmt.Errorf("CoinGecko API returned status: 429 Too Many Requests")
@@ -191,7 +253,15 @@ func fetchBatchPricesWithRetry(client *http.Client, baseURL, apiKey string, toke
 
 	pricesFull := buildPricesFull(tokens, prices)
 
-	return pricesFull, prices, nil
+	return pricesFull, data, nil
+}
+
+// lastUpdatedAt returns the time CoinGecko last updated a token quote.
+func lastUpdatedAt(quote map[string]float64) time.Time {
+	if updated, ok := quote["last_updated_at"]; ok && updated > 0 {
+		return time.Unix(int64(updated), 0).UTC()
+	}
+	return time.Time{}
 }
 
 func parseRetryAfter(resp *http.Response) time.Duration {
@@ -0,0 +1,43 @@
+package chaindataagg_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	chaindataagg "github.com/atkachyshyn/chain-data-agg"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuoteCurrencies(t *testing.T) {
+	require.Equal(t, []string{"usd"}, chaindataagg.QuoteCurrencies(nil))
+	require.Equal(t, []string{"usd", "eur", "gbp"}, chaindataagg.QuoteCurrencies([]string{"EUR", "usd", " gbp", "eur"}))
+}
+
+func TestCalculateDailyPrices(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/simple/price", r.URL.Path)
+		require.Equal(t, "usd,eur", r.URL.Query().Get("vs_currencies"))
+		fmt.Fprint(w, `{
+			"sunflower-land": {"usd": 0.05, "eur": 0.045, "last_updated_at": 1713175200},
+			"matic-network": {"usd": 0.7, "eur": 0.63, "last_updated_at": 1713175200}
+		}`)
+	}))
+	defer server.Close()
+
+	tokens := []chaindataagg.Token{
+		{ID: "sunflower-land", Symbol: "sfl"},
+		{ID: "matic-network", Symbol: "matic"},
+	}
+	snapshot, err := chaindataagg.CalculateDailyPrices(context.Background(), server.URL, "", tokens, []string{"eur"})
+	require.NoError(t, err)
+
+	require.Equal(t, chaindataagg.ProviderCoinGecko, snapshot.Provider)
+	require.Equal(t, map[string]float64{"sfl": 0.05, "matic": 0.7}, snapshot.Rates)
+	require.Equal(t, "sunflower-land", snapshot.Tokens["sfl"].ID)
+	require.Equal(t, int64(1713175200), snapshot.Tokens["sfl"].LastUpdatedAt.Unix())
+	require.InDelta(t, 0.045, snapshot.Quotes["eur"]["sfl"], 1e-9)
+	require.InDelta(t, 0.9, snapshot.FX["eur"], 1e-9)
+}
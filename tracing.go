@@ -0,0 +1,134 @@
+package chaindataagg
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Trace exporters.
+const (
+	TraceExporterNone   = "none"
+	TraceExporterStdout = "stdout"
+	TraceExporterOTLP   = "otlp"
+)
+
+// tracerName names the tracer of the pipeline spans.
+const tracerName = "github.com/atkachyshyn/chain-data-agg"
+
+// StartTracing installs a tracer provider exporting to cfg.TraceExporter and
+// starts the root span of a run. The returned function ends the span and
+// flushes the exported spans.
+func StartTracing(ctx context.Context, cfg *Config, service, run string) (context.Context, func() error, error) {
+	var exporter sdktrace.SpanExporter
+	switch strings.ToLower(cfg.TraceExporter) {
+	case "", TraceExporterNone:
+		return ctx, func() error { return nil }, nil
+	case TraceExporterStdout:
+		// Spans go to stderr, stdout carries reports and dry run summaries.
+		stdout, err := stdouttrace.New(stdouttrace.WithWriter(os.Stderr))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create trace exporter: %w", err)
+		}
+		exporter = stdout
+	case TraceExporterOTLP:
+		otlp, err := otlptracehttp.New(ctx, otlpOptions(cfg.TraceEndpoint)...)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create trace exporter: %w", err)
+		}
+		exporter = otlp
+	default:
+		return nil, nil, fmt.Errorf("unknown trace exporter: %s", cfg.TraceExporter)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", service)))
+	if err != nil {
+		return nil, nil, err
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	ctx, span := provider.Tracer(tracerName).Start(ctx, run)
+	return ctx, func() error {
+		span.End()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := provider.Shutdown(ctx); err != nil {
+			return fmt.Errorf("failed to flush traces: %w", err)
+		}
+		return nil
+	}, nil
+}
+
+// otlpOptions points the OTLP exporter at the collector base URL, like
+// OTEL_EXPORTER_OTLP_ENDPOINT. Without an endpoint the exporter reads the
+// standard OTEL_EXPORTER_OTLP_* variables.
+func otlpOptions(endpoint string) []otlptracehttp.Option {
+	u, err := parseOTLPEndpoint(endpoint)
+	if endpoint == "" || err != nil {
+		return nil
+	}
+	options := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(u.Host),
+		otlptracehttp.WithURLPath(path.Join("/", u.Path, "v1/traces")),
+	}
+	if u.Scheme == "http" {
+		options = append(options, otlptracehttp.WithInsecure())
+	}
+	return options
+}
+
+// parseOTLPEndpoint parses a collector base URL. A bare host:port is reached
+// over HTTPS, like the exporter's own endpoint option.
+func parseOTLPEndpoint(endpoint string) (*url.URL, error) {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("no host in %q", endpoint)
+	}
+	return u, nil
+}
+
+// startSpan starts a span of a pipeline step with the provider of the span in
+// ctx, so steps outside a run traced by StartTracing are not traced.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	tracer := trace.SpanFromContext(ctx).TracerProvider().Tracer(tracerName)
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan records err on the span, if any, and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// tracingTransport propagates the trace context of outgoing requests and
+// creates a client span for each of them.
+func tracingTransport(base http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(base)
+}
@@ -0,0 +1,93 @@
+package chaindataagg_test
+
+import (
+	"context"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	chaindataagg "github.com/atkachyshyn/chain-data-agg"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStartTracing(t *testing.T) {
+	var (
+		mu          sync.Mutex
+		exports     int
+		traceparent string
+	)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/v1/traces", r.URL.Path)
+		mu.Lock()
+		exports++
+		mu.Unlock()
+	}))
+	defer collector.Close()
+
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		traceparent = r.Header.Get("traceparent")
+		mu.Unlock()
+		fmt.Fprint(w, `{"sunflower-land": {"usd": 0.05}}`)
+	}))
+	defer provider.Close()
+
+	cfg := &chaindataagg.Config{TraceExporter: chaindataagg.TraceExporterOTLP, TraceEndpoint: collector.URL}
+	ctx, stop, err := chaindataagg.StartTracing(context.Background(), cfg, "token-prices", "run")
+	require.NoError(t, err)
+
+	_, err = chaindataagg.CalculateDailyPrices(ctx, provider.URL, "", []chaindataagg.Token{{ID: "sunflower-land", Symbol: "sfl"}}, nil)
+	require.NoError(t, err)
+	require.NoError(t, stop())
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, 1, exports)
+	// The request carries the trace of the run.
+	require.Len(t, strings.Split(traceparent, "-"), 4)
+}
+
+func TestStartTracingHostPort(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		exports int
+	)
+	collector := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/v1/traces", r.URL.Path)
+		mu.Lock()
+		exports++
+		mu.Unlock()
+	}))
+	defer collector.Close()
+
+	// A bare host:port is reached over HTTPS.
+	certificate := filepath.Join(t.TempDir(), "collector.pem")
+	require.NoError(t, os.WriteFile(certificate, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: collector.Certificate().Raw}), 0o644))
+	t.Setenv("OTEL_EXPORTER_OTLP_CERTIFICATE", certificate)
+
+	cfg := &chaindataagg.Config{TraceExporter: chaindataagg.TraceExporterOTLP, TraceEndpoint: strings.TrimPrefix(collector.URL, "https://")}
+	_, stop, err := chaindataagg.StartTracing(context.Background(), cfg, "aggregator", "extract")
+	require.NoError(t, err)
+	require.NoError(t, stop())
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, 1, exports)
+}
+
+func TestStartTracingDisabled(t *testing.T) {
+	ctx := context.Background()
+	traced, stop, err := chaindataagg.StartTracing(ctx, &chaindataagg.Config{}, "aggregator", "extract")
+	require.NoError(t, err)
+	require.Equal(t, ctx, traced)
+	require.NoError(t, stop())
+
+	_, _, err = chaindataagg.StartTracing(ctx, &chaindataagg.Config{TraceExporter: "zipkin"}, "aggregator", "extract")
+	require.ErrorContains(t, err, "unknown trace exporter")
+}
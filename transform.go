@@ -1,50 +1,272 @@
 package chaindataagg
 
 import (
+	"context"
 	"fmt"
+	"log/slog"
+	"sort"
 	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// MissingRatePolicy defines how Transform treats transactions paid in a
+// currency without an exchange rate.
+type MissingRatePolicy string
+
+const (
+	// MissingRateFail aborts the transformation (default).
+	MissingRateFail MissingRatePolicy = "fail"
+	// MissingRateSkip drops the transaction and counts it in the summary.
+	MissingRateSkip MissingRatePolicy = "skip"
+	// MissingRateLastKnown converts the transaction with the last known rate
+	// from the price history.
+	MissingRateLastKnown MissingRatePolicy = "last-known"
+	// MissingRateFlag aggregates the transaction into a separate row flagged
+	// as rate_missing, with no USD volume.
+	MissingRateFlag MissingRatePolicy = "flag"
 )
 
+// ParseMissingRatePolicy parses missing rate policy from string value.
+func ParseMissingRatePolicy(s string) (MissingRatePolicy, error) {
+	switch policy := MissingRatePolicy(strings.ToLower(s)); policy {
+	case MissingRateFail, MissingRateSkip, MissingRateLastKnown, MissingRateFlag:
+		return policy, nil
+	case "":
+		return MissingRateFail, nil
+	default:
+		return "", fmt.Errorf("unknown missing rate policy: %s", s)
+	}
+}
+
 type AggregatedData struct {
 	Date           string
 	ProjectID      string
 	Transactions   int
 	TotalVolumeUSD float64
+	RateMissing    bool
+	// Volumes are the total volumes in the additional reporting currencies.
+	Volumes map[string]float64 `json:",omitempty"`
+	// Lineage identifies the inputs of the row, if recorded.
+	Lineage *Lineage `json:",omitempty"`
+	// SuspiciousTransactions and SuspiciousVolumeUSD are the part of the row
+	// tagged as possible wash trades.
+	SuspiciousTransactions int     `json:",omitempty"`
+	SuspiciousVolumeUSD    float64 `json:",omitempty"`
+}
+
+// TransformOptions configures TransformWithOptions.
+type TransformOptions struct {
+	MissingRatePolicy MissingRatePolicy
+	// LastKnownRates are the most recent rates from the price history, used
+	// by the last-known policy.
+	LastKnownRates map[string]float64
+	// PriceMapping pegs or redirects currencies before rates are looked up.
+	PriceMapping *PriceMapping
+	// Currencies are the additional reporting currencies.
+	Currencies []string
+	// Quotes are rates in the additional currencies keyed by currency and
+	// symbol.
+	Quotes map[string]map[string]float64
+	// FX are the units of each additional currency per USD, used to convert
+	// pegged and fallback rates which have no quote.
+	FX map[string]float64
+	// SourceLocation is the time zone of timestamps without a zone (UTC by
+	// default).
+	SourceLocation *time.Location
+	// DayLocation defines the day boundaries for aggregation (UTC by default).
+	DayLocation *time.Location
+	// Lineage is attached to every row, if set.
+	Lineage *Lineage
+	// Suspicious marks the transactions tagged by DetectWashTrades, by index.
+	Suspicious []bool
+}
+
+// MissingRate describes transactions paid in a currency without a rate.
+type MissingRate struct {
+	Symbol       string
+	Transactions int
+	// Volume is the total volume in the transaction currency.
+	Volume float64
+	// FallbackRate is the last known rate applied, if any.
+	FallbackRate float64 `json:",omitempty"`
+}
+
+// TransformSummary reports the outcome of a transformation.
+type TransformSummary struct {
+	Transactions int
+	Skipped      int
+	Groups       int
+	MissingRates []MissingRate
+	// PricedSymbols are the symbols priced with a current rate.
+	PricedSymbols []string
+}
+
+// TransactionDates returns the distinct days of the transactions in the day
+// location, sorted.
+func TransactionDates(transactions []Transaction, source, day *time.Location) ([]string, error) {
+	if day == nil {
+		day = time.UTC
+	}
+	seen := make(map[string]bool)
+	var dates []string
+	for _, tx := range transactions {
+		ts, err := tx.Time(source)
+		if err != nil {
+			return nil, err
+		}
+		if date := ts.In(day).Format(DateFormat); !seen[date] {
+			seen[date] = true
+			dates = append(dates, date)
+		}
+	}
+	sort.Strings(dates)
+	return dates, nil
+}
+
+func Transform(ctx context.Context, transactions []Transaction, currencyRates map[string]float64) ([]AggregatedData, error) {
+	aggregatedData, _, err := TransformWithOptions(ctx, transactions, currencyRates, TransformOptions{})
+	return aggregatedData, err
 }
 
-func Transform(transactions []Transaction, currencyRates map[string]float64) ([]AggregatedData, error) {
+// TransformWithOptions aggregates transactions per day and project, applying
+// the configured policy to transactions without an exchange rate.
+func TransformWithOptions(ctx context.Context, transactions []Transaction, currencyRates map[string]float64, opts TransformOptions) (_ []AggregatedData, _ TransformSummary, err error) {
+	defer observeStage("transform", time.Now())
+	_, span := startSpan(ctx, "transform", attribute.Int("transactions", len(transactions)))
+	defer func() { endSpan(span, err) }()
+	rowsIn.WithLabelValues("transform").Add(float64(len(transactions)))
+
+	policy, err := ParseMissingRatePolicy(string(opts.MissingRatePolicy))
+	if err != nil {
+		return nil, TransformSummary{}, err
+	}
+
+	// USD is always reported as TotalVolumeUSD.
+	currencies := QuoteCurrencies(opts.Currencies)[1:]
+
 	data := make(map[string]AggregatedData)
+	missing := make(map[string]*MissingRate)
+	priced := make(map[string]bool)
+	summary := TransformSummary{}
+
+	dayLocation := opts.DayLocation
+	if dayLocation == nil {
+		dayLocation = time.UTC
+	}
 
 	for i, tx := range transactions {
-		currencySymbol := strings.ToLower(tx.CurrencySymbol)
-		date := strings.Split(tx.Timestamp, " ")[0]
+		if i%10000 == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, TransformSummary{}, err
+			}
+		}
+		ts, err := tx.Time(opts.SourceLocation)
+		if err != nil {
+			return nil, TransformSummary{}, err
+		}
+		date := ts.In(dayLocation).Format(DateFormat)
 		key := date + "_" + tx.ProjectID
-		rate, ok := currencyRates[currencySymbol]
-		if !ok {
-			return nil, fmt.Errorf("missing exchange rate for %s", currencySymbol)
+		rate, currencySymbol, ok := opts.PriceMapping.rate(tx.CurrencySymbol, tx.CurrencyAddress, currencyRates)
+		rateMissing := false
+		// Quotes apply only to rates looked up directly by symbol.
+		rule, _ := opts.PriceMapping.Match(tx.CurrencySymbol, tx.CurrencyAddress)
+		useQuotes := ok && rule.Peg == 0
+		if ok {
+			priced[currencySymbol] = true
+		} else {
+			if policy == MissingRateFail {
+				return nil, TransformSummary{}, fmt.Errorf("missing exchange rate for %s", currencySymbol)
+			}
+
+			if _, exists := missing[currencySymbol]; !exists {
+				missing[currencySymbol] = &MissingRate{Symbol: currencySymbol}
+			}
+			missing[currencySymbol].Transactions++
+			missing[currencySymbol].Volume += tx.CurrencyValue
+
+			switch policy {
+			case MissingRateSkip:
+				summary.Skipped++
+				continue
+			case MissingRateLastKnown:
+				rate, ok = opts.LastKnownRates[currencySymbol]
+				if !ok {
+					return nil, TransformSummary{}, fmt.Errorf("missing exchange rate for %s: no last known rate", currencySymbol)
+				}
+				missing[currencySymbol].FallbackRate = rate
+			case MissingRateFlag:
+				rateMissing = true
+				key += "_rate_missing"
+			}
 		}
 
 		volumeUSD := tx.CurrencyValue * rate
-		fmt.Println("[", i, "] ", tx.CurrencyValue, "*", rate, "=", volumeUSD)
+		slog.Debug("Transaction volume",
+			slog.Int("index", i),
+			slog.Float64("value", tx.CurrencyValue),
+			slog.Float64("rate", rate),
+			slog.Float64("volumeUSD", volumeUSD),
+		)
 		if _, exists := data[key]; !exists {
 			data[key] = AggregatedData{
 				Date:           date,
 				ProjectID:      tx.ProjectID,
 				Transactions:   0,
 				TotalVolumeUSD: 0,
+				RateMissing:    rateMissing,
+				Lineage:        opts.Lineage,
 			}
 		}
 
 		entry := data[key]
 		entry.Transactions++
 		entry.TotalVolumeUSD += volumeUSD
+		if i < len(opts.Suspicious) && opts.Suspicious[i] {
+			entry.SuspiciousTransactions++
+			entry.SuspiciousVolumeUSD += volumeUSD
+		}
+		if !rateMissing {
+			for _, currency := range currencies {
+				quote, ok := opts.Quotes[currency][currencySymbol]
+				if !ok || !useQuotes {
+					fx, ok := opts.FX[currency]
+					if !ok {
+						return nil, TransformSummary{}, fmt.Errorf("missing %s exchange rate for %s", currency, currencySymbol)
+					}
+					quote = rate * fx
+				}
+				if entry.Volumes == nil {
+					entry.Volumes = make(map[string]float64)
+				}
+				entry.Volumes[currency] += tx.CurrencyValue * quote
+			}
+		}
 		data[key] = entry
+		summary.Transactions++
 	}
 
 	var aggregatedData []AggregatedData
 	for _, entry := range data {
 		aggregatedData = append(aggregatedData, entry)
 	}
+	summary.Groups = len(aggregatedData)
+	rowsRejected.WithLabelValues("transform").Add(float64(summary.Skipped))
+	groupsOut.Add(float64(summary.Groups))
+
+	for _, entry := range missing {
+		summary.MissingRates = append(summary.MissingRates, *entry)
+	}
+	sort.Slice(summary.MissingRates, func(i, j int) bool {
+		return summary.MissingRates[i].Symbol < summary.MissingRates[j].Symbol
+	})
+
+	for symbol := range priced {
+		summary.PricedSymbols = append(summary.PricedSymbols, symbol)
+	}
+	sort.Strings(summary.PricedSymbols)
+	span.SetAttributes(attribute.Int("groups", summary.Groups), attribute.Int("skipped", summary.Skipped))
 
-	return aggregatedData, nil
+	return aggregatedData, summary, nil
 }
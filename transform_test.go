@@ -1,9 +1,12 @@
 package chaindataagg_test
 
 import (
+	"context"
 	"testing"
+	"time"
 
 	chaindataagg "github.com/atkachyshyn/chain-data-agg"
+	"github.com/stretchr/testify/require"
 )
 
 func TestTransform(t *testing.T) {
@@ -13,7 +16,7 @@ func TestTransform(t *testing.T) {
 	rates := map[string]float64{"btc": 1.0}
 
 	t.Run("valid input", func(t *testing.T) {
-		aggregated, err := chaindataagg.Transform(transactions, rates)
+		aggregated, err := chaindataagg.Transform(context.Background(), transactions, rates)
 		if err != nil {
 			t.Fatalf("expected no error, got %v", err)
 		}
@@ -25,3 +28,141 @@ func TestTransform(t *testing.T) {
 		}
 	})
 }
+
+func TestTransformMissingRatePolicy(t *testing.T) {
+	transactions := []chaindataagg.Transaction{
+		{Timestamp: "2024-01-01 10:00:00.000", ProjectID: "1", CurrencySymbol: "BTC", CurrencyValue: 2.0},
+		{Timestamp: "2024-01-01 11:00:00.000", ProjectID: "1", CurrencySymbol: "XYZ", CurrencyValue: 3.0},
+		{Timestamp: "2024-01-01 12:00:00.000", ProjectID: "1", CurrencySymbol: "xyz", CurrencyValue: 4.0},
+	}
+	rates := map[string]float64{"btc": 10.0}
+
+	t.Run("fail", func(t *testing.T) {
+		_, _, err := chaindataagg.TransformWithOptions(context.Background(), transactions, rates, chaindataagg.TransformOptions{
+			MissingRatePolicy: chaindataagg.MissingRateFail,
+		})
+		require.ErrorContains(t, err, "missing exchange rate for xyz")
+	})
+
+	t.Run("skip", func(t *testing.T) {
+		aggregated, summary, err := chaindataagg.TransformWithOptions(context.Background(), transactions, rates, chaindataagg.TransformOptions{
+			MissingRatePolicy: chaindataagg.MissingRateSkip,
+		})
+		require.NoError(t, err)
+		require.Len(t, aggregated, 1)
+		require.Equal(t, 1, aggregated[0].Transactions)
+		require.InDelta(t, 20.0, aggregated[0].TotalVolumeUSD, 1e-9)
+		require.Equal(t, 2, summary.Skipped)
+		require.Equal(t, []string{"btc"}, summary.PricedSymbols)
+		require.Equal(t, []chaindataagg.MissingRate{{Symbol: "xyz", Transactions: 2, Volume: 7.0}}, summary.MissingRates)
+	})
+
+	t.Run("last known", func(t *testing.T) {
+		aggregated, summary, err := chaindataagg.TransformWithOptions(context.Background(), transactions, rates, chaindataagg.TransformOptions{
+			MissingRatePolicy: chaindataagg.MissingRateLastKnown,
+			LastKnownRates:    map[string]float64{"xyz": 0.5},
+		})
+		require.NoError(t, err)
+		require.Len(t, aggregated, 1)
+		require.Equal(t, 3, aggregated[0].Transactions)
+		require.InDelta(t, 23.5, aggregated[0].TotalVolumeUSD, 1e-9)
+		require.Len(t, summary.MissingRates, 1)
+		require.InDelta(t, 0.5, summary.MissingRates[0].FallbackRate, 1e-9)
+	})
+
+	t.Run("last known without history", func(t *testing.T) {
+		_, _, err := chaindataagg.TransformWithOptions(context.Background(), transactions, rates, chaindataagg.TransformOptions{
+			MissingRatePolicy: chaindataagg.MissingRateLastKnown,
+		})
+		require.ErrorContains(t, err, "no last known rate")
+	})
+
+	t.Run("flag", func(t *testing.T) {
+		aggregated, summary, err := chaindataagg.TransformWithOptions(context.Background(), transactions, rates, chaindataagg.TransformOptions{
+			MissingRatePolicy: chaindataagg.MissingRateFlag,
+		})
+		require.NoError(t, err)
+		require.Len(t, aggregated, 2)
+		for _, entry := range aggregated {
+			if entry.RateMissing {
+				require.Equal(t, 2, entry.Transactions)
+				require.Zero(t, entry.TotalVolumeUSD)
+			} else {
+				require.Equal(t, 1, entry.Transactions)
+			}
+		}
+		require.Equal(t, 2, summary.Groups)
+	})
+
+	t.Run("unknown policy", func(t *testing.T) {
+		_, err := chaindataagg.ParseMissingRatePolicy("guess")
+		require.Error(t, err)
+	})
+}
+
+func TestTransformReportingCurrencies(t *testing.T) {
+	mapping, err := chaindataagg.ParsePriceMapping([]byte(`{"rules": [{"symbol": "usdc", "peg": 1}]}`))
+	require.NoError(t, err)
+
+	transactions := []chaindataagg.Transaction{
+		{Timestamp: "2024-04-15 02:15:07.167", ProjectID: "1", CurrencySymbol: "SFL", CurrencyValue: 100},
+		{Timestamp: "2024-04-15 02:16:07.167", ProjectID: "1", CurrencySymbol: "USDC", CurrencyValue: 10},
+	}
+	rates := map[string]float64{"sfl": 0.05}
+
+	t.Run("quotes and fx", func(t *testing.T) {
+		aggregated, _, err := chaindataagg.TransformWithOptions(context.Background(), transactions, rates, chaindataagg.TransformOptions{
+			PriceMapping: mapping,
+			Currencies:   []string{"EUR", "usd"},
+			Quotes:       map[string]map[string]float64{"eur": {"sfl": 0.046, "usdc": 5}},
+			FX:           map[string]float64{"eur": 0.9},
+		})
+		require.NoError(t, err)
+		require.Len(t, aggregated, 1)
+		require.InDelta(t, 15.0, aggregated[0].TotalVolumeUSD, 1e-9)
+		require.Len(t, aggregated[0].Volumes, 1)
+		// The pegged currency is converted with FX rather than its quote.
+		require.InDelta(t, 100*0.046+10*0.9, aggregated[0].Volumes["eur"], 1e-9)
+	})
+
+	t.Run("missing fx", func(t *testing.T) {
+		_, _, err := chaindataagg.TransformWithOptions(context.Background(), transactions, rates, chaindataagg.TransformOptions{
+			PriceMapping: mapping,
+			Currencies:   []string{"gbp"},
+		})
+		require.ErrorContains(t, err, "missing gbp exchange rate")
+	})
+}
+
+func TestTransformDayBoundaries(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	require.NoError(t, err)
+
+	transactions := []chaindataagg.Transaction{
+		{Timestamp: "2024-04-15 02:15:07.167", ProjectID: "1", CurrencySymbol: "SFL", CurrencyValue: 1},
+		{Timestamp: "2024-04-15 05:15:07.167", ProjectID: "1", CurrencySymbol: "SFL", CurrencyValue: 1},
+	}
+	rates := map[string]float64{"sfl": 1}
+
+	t.Run("utc", func(t *testing.T) {
+		aggregated, _, err := chaindataagg.TransformWithOptions(context.Background(), transactions, rates, chaindataagg.TransformOptions{})
+		require.NoError(t, err)
+		require.Len(t, aggregated, 1)
+		require.Equal(t, "2024-04-15", aggregated[0].Date)
+	})
+
+	t.Run("local business day", func(t *testing.T) {
+		aggregated, _, err := chaindataagg.TransformWithOptions(context.Background(), transactions, rates, chaindataagg.TransformOptions{
+			DayLocation: newYork,
+		})
+		require.NoError(t, err)
+		require.Len(t, aggregated, 2)
+		dates := []string{aggregated[0].Date, aggregated[1].Date}
+		require.ElementsMatch(t, []string{"2024-04-14", "2024-04-15"}, dates)
+	})
+
+	t.Run("invalid timestamp", func(t *testing.T) {
+		_, _, err := chaindataagg.TransformWithOptions(context.Background(), []chaindataagg.Transaction{{Timestamp: "yesterday"}}, rates, chaindataagg.TransformOptions{})
+		require.ErrorContains(t, err, "failed to parse timestamp")
+	})
+}
@@ -1,25 +1,170 @@
 package chaindataagg
 
 import (
+	"context"
 	"encoding/csv"
+	"fmt"
 	"log/slog"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/schollz/progressbar/v3"
+)
+
+const (
+	DateFormat = "2006-01-02"
 )
 
+// ExitInterrupted is the exit code of a run stopped by SIGINT or SIGTERM.
+const ExitInterrupted = 130
+
+// SignalContext returns a context canceled on SIGINT or SIGTERM. A second
+// signal terminates the process immediately.
+func SignalContext() context.Context {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	return ctx
+}
+
+// timestampFormats are the layouts accepted for transaction timestamps.
+// Layouts without a zone are interpreted in the source location.
+var timestampFormats = []string{
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999Z07:00",
+}
+
+// Supported log formats.
 const (
-	DateFormat = "YYYY-MM-DD"
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+var (
+	// logLevel and jsonLogs are shared by all loggers, so loggers created
+	// before the configuration is loaded follow ConfigureLogging.
+	logLevel = new(slog.LevelVar)
+	jsonLogs atomic.Bool
 )
 
 // NewLogger constructs new logger.
 func NewLogger(stage string) *slog.Logger {
-	leveler := new(slog.LevelVar)
-	leveler.Set(slog.LevelInfo)
-	handler := slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
-		Level: leveler,
-	})
-	baseLogger := slog.New(handler)
-	return baseLogger.With(slog.String("stage", stage))
+	return slog.New(newLogHandler()).With(slog.String("stage", stage))
+}
+
+// ConfigureLogging sets the level and format of all loggers, and makes them
+// the default logger. JSON logs use the field names of Google Cloud Logging.
+func ConfigureLogging(level, format string) error {
+	parsed, err := ParseLevel(level)
+	if err != nil {
+		return fmt.Errorf("invalid log level: %w", err)
+	}
+
+	switch strings.ToLower(format) {
+	case "", LogFormatText:
+		jsonLogs.Store(false)
+	case LogFormatJSON:
+		jsonLogs.Store(true)
+	default:
+		return fmt.Errorf("unknown log format: %s", format)
+	}
+
+	logLevel.Set(parsed)
+	slog.SetDefault(slog.New(newLogHandler()))
+	return nil
+}
+
+// logHandler writes text or JSON logs depending on the configured format.
+type logHandler struct {
+	text slog.Handler
+	json slog.Handler
+}
+
+func newLogHandler() *logHandler {
+	return &logHandler{
+		text: slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: logLevel}),
+		json: slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: logLevel, ReplaceAttr: cloudLoggingAttr}),
+	}
+}
+
+func (h *logHandler) current() slog.Handler {
+	if jsonLogs.Load() {
+		return h.json
+	}
+	return h.text
+}
+
+func (h *logHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.current().Enabled(ctx, level)
+}
+
+func (h *logHandler) Handle(ctx context.Context, record slog.Record) error {
+	return h.current().Handle(ctx, record)
+}
+
+func (h *logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &logHandler{text: h.text.WithAttrs(attrs), json: h.json.WithAttrs(attrs)}
+}
+
+func (h *logHandler) WithGroup(name string) slog.Handler {
+	return &logHandler{text: h.text.WithGroup(name), json: h.json.WithGroup(name)}
+}
+
+// cloudLoggingAttr renames the built-in attributes to the severity and
+// message fields recognized by Google Cloud Logging.
+func cloudLoggingAttr(groups []string, attr slog.Attr) slog.Attr {
+	if len(groups) > 0 {
+		return attr
+	}
+
+	switch attr.Key {
+	case slog.LevelKey:
+		level, _ := attr.Value.Any().(slog.Level)
+		severity := "DEBUG"
+		switch {
+		case level >= slog.LevelError:
+			severity = "ERROR"
+		case level >= slog.LevelWarn:
+			severity = "WARNING"
+		case level >= slog.LevelInfo:
+			severity = "INFO"
+		}
+		return slog.String("severity", severity)
+	case slog.MessageKey:
+		attr.Key = "message"
+	}
+	return attr
+}
+
+// newProgressBar constructs a progress bar, silent when logging JSON.
+func newProgressBar(max int64, description string) *progressbar.ProgressBar {
+	if jsonLogs.Load() {
+		return progressbar.DefaultSilent(max, description)
+	}
+	return progressbar.Default(max, description)
+}
+
+// ParseTimestamp parses a transaction timestamp. Timestamps without a zone
+// are interpreted in the given location.
+func ParseTimestamp(ts string, loc *time.Location) (time.Time, error) {
+	if loc == nil {
+		loc = time.UTC
+	}
+	for _, layout := range timestampFormats {
+		if t, err := time.ParseInLocation(layout, ts, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("failed to parse timestamp %q", ts)
 }
 
 // ParseLevel parses log level from string value.
@@ -1,10 +1,16 @@
 package chaindataagg_test
 
 import (
+	"encoding/json"
+	"io"
+	"log/slog"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	chaindataagg "github.com/atkachyshyn/chain-data-agg"
+	"github.com/stretchr/testify/require"
 )
 
 func TestParseCSV(t *testing.T) {
@@ -30,3 +36,67 @@ func TestParseCSV(t *testing.T) {
 		}
 	})
 }
+
+func TestParseTimestamp(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		ts       string
+		loc      *time.Location
+		expected time.Time
+	}{
+		{"without zone in UTC", "2024-04-15 02:15:07.167", nil, time.Date(2024, 4, 15, 2, 15, 7, 167000000, time.UTC)},
+		{"without zone in source location", "2024-04-15 02:15:07", berlin, time.Date(2024, 4, 15, 0, 15, 7, 0, time.UTC)},
+		{"with zone", "2024-01-01T00:00:00Z", berlin, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"with offset", "2024-04-15 02:15:07+02:00", nil, time.Date(2024, 4, 15, 0, 15, 7, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parsed, err := chaindataagg.ParseTimestamp(tt.ts, tt.loc)
+			require.NoError(t, err)
+			require.True(t, tt.expected.Equal(parsed), "expected %s, got %s", tt.expected, parsed)
+		})
+	}
+
+	_, err = chaindataagg.ParseTimestamp("15/04/2024", nil)
+	require.Error(t, err)
+}
+
+func TestConfigureLogging(t *testing.T) {
+	// Loggers write to the stdout of the time they are created.
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	stdout := os.Stdout
+	os.Stdout = w
+	logger := chaindataagg.NewLogger("test")
+	os.Stdout = stdout
+	t.Cleanup(func() {
+		require.NoError(t, chaindataagg.ConfigureLogging("info", "text"))
+	})
+
+	logger.Debug("hidden")
+	require.NoError(t, chaindataagg.ConfigureLogging("DEBUG", "json"))
+	logger.Debug("shown", slog.Int("rows", 3))
+	logger.Warn("warning")
+	require.NoError(t, w.Close())
+
+	output, err := io.ReadAll(r)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	require.Len(t, lines, 2)
+
+	var entry map[string]any
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &entry))
+	require.Equal(t, "DEBUG", entry["severity"])
+	require.Equal(t, "shown", entry["message"])
+	require.Equal(t, "test", entry["stage"])
+	require.Equal(t, float64(3), entry["rows"])
+
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &entry))
+	require.Equal(t, "WARNING", entry["severity"])
+
+	require.Error(t, chaindataagg.ConfigureLogging("info", "xml"))
+	require.Error(t, chaindataagg.ConfigureLogging("loud", "text"))
+}
@@ -0,0 +1,187 @@
+package chaindataagg
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Wash-trade heuristics.
+const (
+	// WashTradeBounce tags trades of an NFT bouncing between a few users
+	// within the window.
+	WashTradeBounce = "nft_bounce"
+	// WashTradeSameSession tags an NFT bought and sold in the same session.
+	WashTradeSameSession = "same_session"
+)
+
+// WashTradeOptions configures DetectWashTrades.
+type WashTradeOptions struct {
+	// Window is the time within which trades of an NFT count as a bounce.
+	Window time.Duration
+	// MinTrades is the number of trades of an NFT within the window, between
+	// at most MaxUsers users, that make a bounce.
+	MinTrades int
+	MaxUsers  int
+	// SourceLocation is the time zone of timestamps without one (UTC by
+	// default).
+	SourceLocation *time.Location
+}
+
+// SuspiciousTrade is a transaction tagged as a possible wash trade.
+type SuspiciousTrade struct {
+	Timestamp         string   `json:"ts"`
+	Event             string   `json:"event"`
+	ProjectID         string   `json:"project_id"`
+	UserID            string   `json:"user_id"`
+	SessionID         string   `json:"session_id"`
+	CollectionAddress string   `json:"collection_address"`
+	TokenID           string   `json:"token_id"`
+	TxnHash           string   `json:"txn_hash,omitempty"`
+	CurrencySymbol    string   `json:"currency_symbol"`
+	CurrencyValue     float64  `json:"currency_value"`
+	Reasons           []string `json:"reasons"`
+}
+
+// DetectWashTrades tags the transactions matching a wash-trade heuristic. It
+// returns the tagged trades in input order and, by transaction index, whether
+// a transaction is tagged. Transactions without a user, collection or token
+// ID are never tagged.
+func DetectWashTrades(transactions []Transaction, opts WashTradeOptions) ([]SuspiciousTrade, []bool, error) {
+	if opts.Window <= 0 || opts.MinTrades < 2 || opts.MaxUsers < 2 {
+		return nil, nil, fmt.Errorf("wash-trade window must be positive and min trades and max users at least 2")
+	}
+
+	// Trades by NFT, and by session and NFT.
+	times := make([]time.Time, len(transactions))
+	byNFT := make(map[string][]int)
+	bySession := make(map[string][]int)
+	for i, tx := range transactions {
+		if tx.UserID == "" || tx.CollectionAddress == "" || tx.TokenID == "" {
+			continue
+		}
+		ts, err := tx.Time(opts.SourceLocation)
+		if err != nil {
+			return nil, nil, err
+		}
+		times[i] = ts
+		nft := strings.ToLower(tx.CollectionAddress) + "/" + tx.TokenID
+		byNFT[nft] = append(byNFT[nft], i)
+		if tx.SessionID != "" {
+			bySession[tx.SessionID+"/"+nft] = append(bySession[tx.SessionID+"/"+nft], i)
+		}
+	}
+
+	reasons := make(map[int][]string)
+	tag := func(i int, reason string) {
+		if n := len(reasons[i]); n == 0 || reasons[i][n-1] != reason {
+			reasons[i] = append(reasons[i], reason)
+		}
+	}
+
+	for _, trades := range byNFT {
+		sort.SliceStable(trades, func(a, b int) bool { return times[trades[a]].Before(times[trades[b]]) })
+		// Every window starting at a trade with enough trades between few
+		// enough users is a bounce.
+		for start := range trades {
+			users := make(map[string]bool)
+			end := start
+			for ; end < len(trades) && times[trades[end]].Sub(times[trades[start]]) <= opts.Window; end++ {
+				users[transactions[trades[end]].UserID] = true
+			}
+			if end-start >= opts.MinTrades && len(users) >= 2 && len(users) <= opts.MaxUsers {
+				for _, i := range trades[start:end] {
+					tag(i, WashTradeBounce)
+				}
+			}
+		}
+	}
+
+	for _, trades := range bySession {
+		var bought, sold bool
+		for _, i := range trades {
+			bought = bought || transactions[i].Event == EventBuyItems
+			sold = sold || transactions[i].Event == EventSellItems
+		}
+		if bought && sold {
+			for _, i := range trades {
+				tag(i, WashTradeSameSession)
+			}
+		}
+	}
+
+	var suspicious []SuspiciousTrade
+	flagged := make([]bool, len(transactions))
+	for i, tx := range transactions {
+		if len(reasons[i]) == 0 {
+			continue
+		}
+		flagged[i] = true
+		suspicious = append(suspicious, SuspiciousTrade{
+			Timestamp:         tx.Timestamp,
+			Event:             tx.Event,
+			ProjectID:         tx.ProjectID,
+			UserID:            tx.UserID,
+			SessionID:         tx.SessionID,
+			CollectionAddress: tx.CollectionAddress,
+			TokenID:           tx.TokenID,
+			TxnHash:           tx.TxnHash,
+			CurrencySymbol:    tx.CurrencySymbol,
+			CurrencyValue:     tx.CurrencyValue,
+			Reasons:           reasons[i],
+		})
+	}
+	return suspicious, flagged, nil
+}
+
+// WashTradeAggregate is the volume of a project and day with and without the
+// suspicious trades.
+type WashTradeAggregate struct {
+	Date                   string  `json:"date"`
+	ProjectID              string  `json:"project_id"`
+	Transactions           int     `json:"transactions"`
+	SuspiciousTransactions int     `json:"suspicious_transactions"`
+	VolumeUSD              float64 `json:"volume_usd"`
+	SuspiciousVolumeUSD    float64 `json:"suspicious_volume_usd"`
+	CleanVolumeUSD         float64 `json:"clean_volume_usd"`
+}
+
+// WashTradeReport is the outcome of the wash-trade heuristics.
+type WashTradeReport struct {
+	Trades     []SuspiciousTrade    `json:"trades"`
+	Aggregates []WashTradeAggregate `json:"aggregates"`
+}
+
+// WashTradeAggregates returns the volumes of every project and day of data
+// transformed with suspicious trades marked. Rows without an exchange rate
+// are left out of the volumes.
+func WashTradeAggregates(data []AggregatedData) []WashTradeAggregate {
+	var aggregates []WashTradeAggregate
+	index := make(map[string]int)
+	for _, entry := range data {
+		key := entry.Date + "_" + entry.ProjectID
+		i, ok := index[key]
+		if !ok {
+			i = len(aggregates)
+			index[key] = i
+			aggregates = append(aggregates, WashTradeAggregate{Date: entry.Date, ProjectID: entry.ProjectID})
+		}
+		aggregate := &aggregates[i]
+		aggregate.Transactions += entry.Transactions
+		aggregate.SuspiciousTransactions += entry.SuspiciousTransactions
+		if !entry.RateMissing {
+			aggregate.VolumeUSD += entry.TotalVolumeUSD
+			aggregate.SuspiciousVolumeUSD += entry.SuspiciousVolumeUSD
+			aggregate.CleanVolumeUSD += entry.TotalVolumeUSD - entry.SuspiciousVolumeUSD
+		}
+	}
+
+	sort.Slice(aggregates, func(i, j int) bool {
+		if aggregates[i].Date != aggregates[j].Date {
+			return aggregates[i].Date < aggregates[j].Date
+		}
+		return aggregates[i].ProjectID < aggregates[j].ProjectID
+	})
+	return aggregates
+}
@@ -0,0 +1,103 @@
+package chaindataagg_test
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	chaindataagg "github.com/atkachyshyn/chain-data-agg"
+	"github.com/stretchr/testify/require"
+)
+
+var washTradeOptions = chaindataagg.WashTradeOptions{Window: time.Hour, MinTrades: 3, MaxUsers: 2}
+
+// nftTrade returns a trade of token 7 of a collection.
+func nftTrade(ts, event, user, session string, value float64) chaindataagg.Transaction {
+	return chaindataagg.Transaction{
+		Timestamp:         "2024-04-15 " + ts,
+		Event:             event,
+		ProjectID:         "4974",
+		CurrencySymbol:    "SFL",
+		CurrencyValue:     value,
+		UserID:            user,
+		SessionID:         session,
+		CollectionAddress: "0x22d5f9b75c524fec1d6619787e582644cd4d7422",
+		TokenID:           "7",
+	}
+}
+
+func TestDetectWashTrades(t *testing.T) {
+	transactions := []chaindataagg.Transaction{
+		// Token 7 bounces between alice and bob.
+		nftTrade("10:00:00.000", chaindataagg.EventSellItems, "alice", "a1", 10),
+		nftTrade("10:20:00.000", chaindataagg.EventBuyItems, "bob", "b1", 10),
+		nftTrade("10:50:00.000", chaindataagg.EventSellItems, "bob", "b2", 10),
+		// Out of the window of the first trade, within the window of the second.
+		nftTrade("11:15:00.000", chaindataagg.EventBuyItems, "alice", "a2", 10),
+		// A third user hours later.
+		nftTrade("15:00:00.000", chaindataagg.EventBuyItems, "carol", "c1", 10),
+		// Bought and sold in the same session.
+		nftTrade("16:00:00.000", chaindataagg.EventBuyItems, "dave", "d1", 5),
+		nftTrade("18:00:00.000", chaindataagg.EventSellItems, "dave", "d1", 5),
+		// No token ID.
+		{Timestamp: "2024-04-15 10:30:00.000", Event: chaindataagg.EventBuyItems, UserID: "alice", SessionID: "a1", CollectionAddress: "0x22d5"},
+	}
+
+	suspicious, flagged, err := chaindataagg.DetectWashTrades(transactions, washTradeOptions)
+	require.NoError(t, err)
+	require.Equal(t, []bool{true, true, true, true, false, true, true, false}, flagged)
+	require.Len(t, suspicious, 6)
+	require.Equal(t, "alice", suspicious[0].UserID)
+	require.Equal(t, []string{chaindataagg.WashTradeBounce}, suspicious[3].Reasons)
+	require.Equal(t, []string{chaindataagg.WashTradeSameSession}, suspicious[4].Reasons)
+
+	// A single user trading repeatedly is not a bounce.
+	_, flagged, err = chaindataagg.DetectWashTrades([]chaindataagg.Transaction{
+		nftTrade("10:00:00.000", chaindataagg.EventBuyItems, "alice", "a1", 10),
+		nftTrade("10:10:00.000", chaindataagg.EventBuyItems, "alice", "a2", 10),
+		nftTrade("10:20:00.000", chaindataagg.EventBuyItems, "alice", "a3", 10),
+	}, washTradeOptions)
+	require.NoError(t, err)
+	require.Equal(t, []bool{false, false, false}, flagged)
+
+	_, _, err = chaindataagg.DetectWashTrades(transactions, chaindataagg.WashTradeOptions{Window: time.Hour, MinTrades: 1, MaxUsers: 2})
+	require.ErrorContains(t, err, "at least 2")
+}
+
+func TestWashTradeAggregates(t *testing.T) {
+	transactions := []chaindataagg.Transaction{
+		nftTrade("16:00:00.000", chaindataagg.EventBuyItems, "dave", "d1", 5),
+		nftTrade("16:05:00.000", chaindataagg.EventSellItems, "dave", "d1", 5),
+		nftTrade("19:00:00.000", chaindataagg.EventBuyItems, "erin", "e1", 20),
+	}
+	_, flagged, err := chaindataagg.DetectWashTrades(transactions, washTradeOptions)
+	require.NoError(t, err)
+
+	data, _, err := chaindataagg.TransformWithOptions(context.Background(), transactions, map[string]float64{"sfl": 2}, chaindataagg.TransformOptions{Suspicious: flagged})
+	require.NoError(t, err)
+	require.Equal(t, []chaindataagg.WashTradeAggregate{{
+		Date:                   "2024-04-15",
+		ProjectID:              "4974",
+		Transactions:           3,
+		SuspiciousTransactions: 2,
+		VolumeUSD:              60,
+		SuspiciousVolumeUSD:    20,
+		CleanVolumeUSD:         40,
+	}}, chaindataagg.WashTradeAggregates(data))
+}
+
+func TestDetectWashTradesSampleData(t *testing.T) {
+	content, err := os.ReadFile("sample_data/sample_data.csv")
+	require.NoError(t, err)
+	transactions, err := chaindataagg.Extract(context.Background(), content, 4)
+	require.NoError(t, err)
+
+	suspicious, _, err := chaindataagg.DetectWashTrades(transactions, washTradeOptions)
+	require.NoError(t, err)
+	require.NotEmpty(t, suspicious)
+	for _, trade := range suspicious {
+		require.NotEmpty(t, trade.Reasons)
+		require.NotEmpty(t, trade.TokenID)
+	}
+}